@@ -0,0 +1,307 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"token-ring/multicast"
+	"token-ring/peer"
+	"token-ring/peergossip"
+)
+
+// HTTP/JSON admin API over the running peers of every module.
+//
+//	GET  /peers                      - state of every peer
+//	GET  /peers/{port}               - state of a single peer
+//	POST /peers/{port}/{action}      - control action, arguments as query params:
+//		peer:       lock, unlock, fw, leave
+//		peergossip: gossip?word=, leave
+//		multicast:  multicast?msg=, leave
+//
+// The API isn't authenticated: Serve binds addrs without a host (ex: ":8080") to loopback only,
+// exposing it on other interfaces takes an explicit host (ex: "0.0.0.0:8080").
+type Server struct {
+	mu    sync.Mutex
+	pools map[string][]interface{}
+}
+
+// Peer state as returned by the API, State is the peer Status snapshot
+type Node struct {
+	Module string      `json:"module"`
+	State  interface{} `json:"state"`
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+func NewServer() *Server {
+	return &Server{pools: make(map[string][]interface{})}
+}
+
+// Serves the admin API on addr (ex: ":8080", loopback only)
+func Serve(addr string) *Server {
+	s := NewServer()
+	go func() {
+		if err := http.ListenAndServe(loopback(addr), s); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+	return s
+}
+
+// SetPool replaces the peers exposed for module (pool elements are *peer.Peer, *peergossip.Peer or *multicast.Peer)
+func (s *Server) SetPool(module string, pool []interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pools[module] = pool
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if path[0] != "peers" || len(path) > 3 {
+		writeJSON(w, http.StatusNotFound, errorBody{Error: "not found"})
+		return
+	}
+
+	if len(path) == 1 {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.nodes())
+		return
+	}
+
+	port, err := strconv.Atoi(path[1])
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: fmt.Sprintf("invalid port %q", path[1])})
+		return
+	}
+	p, ok := s.peer(uint16(port))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorBody{Error: fmt.Sprintf("no peer at %d", port)})
+		return
+	}
+
+	if len(path) == 2 {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.snapshot(p))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+		return
+	}
+	if err := s.act(p, path[2], r); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.snapshot(p))
+}
+
+// every peer, sorted by port
+func (s *Server) nodes() []Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes := make([]Node, 0)
+	for module, pool := range s.pools {
+		for _, p := range pool {
+			nodes = append(nodes, Node{Module: module, State: status(p)})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return port(nodes[i].State) < port(nodes[j].State) })
+	return nodes
+}
+
+// running peer at addr
+func (s *Server) peer(addr uint16) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pool := range s.pools {
+		for _, p := range pool {
+			if port(p) == addr {
+				return p, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) snapshot(p interface{}) Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Node{Module: s.module(p), State: status(p)}
+}
+
+// actions go through the peer methods (they take the peer lock), the ones making calls run in
+// the background
+func (s *Server) act(p interface{}, action string, r *http.Request) error {
+	switch p := p.(type) {
+	case *peer.Peer:
+		switch action {
+		case "lock":
+			p.SetLock(true)
+		case "unlock":
+			p.SetLock(false)
+		case "fw":
+			go p.Bind()
+		case "leave":
+			s.leave(p)
+		default:
+			return fmt.Errorf("unknown peer action %q", action)
+		}
+	case *peergossip.Peer:
+		switch action {
+		case "gossip":
+			word := r.URL.Query().Get("word")
+			// the word is the last field of a Word message, it may hold ":"
+			if word == "" {
+				return fmt.Errorf("invalid word %q", word)
+			}
+			go p.Gossip(word, p.Port)
+		case "leave":
+			s.leave(p)
+		default:
+			return fmt.Errorf("unknown peergossip action %q", action)
+		}
+	case *multicast.Peer:
+		switch action {
+		case "multicast":
+			msg := r.URL.Query().Get("msg")
+			if msg == "" || strings.Contains(msg, ":") {
+				return fmt.Errorf("invalid msg %q", msg)
+			}
+			go p.PingAll(fmt.Sprintf("ping-%s", msg))
+		case "leave":
+			s.leave(p)
+		default:
+			return fmt.Errorf("unknown multicast action %q", action)
+		}
+	}
+	return nil
+}
+
+// Removes a peer from its module: the token ring is closed around it,
+// gossip/multicast registries stop referencing it.
+func (s *Server) leave(leaving interface{}) {
+	addr := port(leaving)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	module := s.module(leaving)
+	pool := make([]interface{}, 0)
+	for _, p := range s.pools[module] {
+		if port(p) == addr {
+			continue
+		}
+		pool = append(pool, p)
+		switch p := p.(type) {
+		case *peer.Peer:
+			if p.Status().Next == addr {
+				next := leaving.(*peer.Peer).Status().Next
+				p.SetNext(next)
+				for _, q := range s.pools[module] {
+					if port(q) == next {
+						q.(*peer.Peer).SetPrev(p.Port)
+					}
+				}
+			}
+		case *peergossip.Peer:
+			p.SetRegistry(remove(p.Status().Registry, addr))
+		case *multicast.Peer:
+			p.SetRegistry(remove(p.Status().Registry, addr))
+		}
+	}
+	s.pools[module] = pool
+
+	switch p := leaving.(type) {
+	case *peergossip.Peer:
+		p.SetRegistry(make([]uint16, 0))
+	case *multicast.Peer:
+		p.SetRegistry(make([]uint16, 0))
+	}
+}
+
+// module of a pooled peer (s.mu must be held)
+func (s *Server) module(p interface{}) string {
+	for module, pool := range s.pools {
+		for _, q := range pool {
+			if q == p {
+				return module
+			}
+		}
+	}
+	return ""
+}
+
+// aux
+
+// addr on the loopback interface unless it names a host
+func loopback(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// port of a peer or of its Status
+func port(p interface{}) uint16 {
+	switch p := p.(type) {
+	case *peer.Peer:
+		return p.Port
+	case *peergossip.Peer:
+		return p.Port
+	case *multicast.Peer:
+		return p.Port
+	case peer.Status:
+		return p.Port
+	case peergossip.Status:
+		return p.Port
+	case multicast.Status:
+		return p.Port
+	}
+	return 0
+}
+
+// Status snapshot of a peer, encoded instead of the live peer (its state changes while encoding)
+func status(p interface{}) interface{} {
+	switch p := p.(type) {
+	case *peer.Peer:
+		return p.Status()
+	case *peergossip.Peer:
+		return p.Status()
+	case *multicast.Peer:
+		return p.Status()
+	}
+	return p
+}
+
+func remove(registry []uint16, addr uint16) []uint16 {
+	res := make([]uint16, 0)
+	for _, v := range registry {
+		if v != addr {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
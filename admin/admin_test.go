@@ -0,0 +1,150 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+	"token-ring/peer"
+	"token-ring/peergossip"
+	"token-ring/rpc"
+)
+
+// peers talk over the in-memory transport, the test ports don't collide with other packages
+func TestMain(m *testing.M) {
+	rpc.SetTransport(rpc.NewMemTransport())
+	os.Exit(m.Run())
+}
+
+func TestAdminPeer(t *testing.T) {
+	p1 := peer.NewPeer(4540, 4541, 0)
+	p2 := peer.NewPeer(4541, 4542, 0)
+	p3 := peer.NewPeer(4542, 4540, 0)
+	peer.Ring(p1, p2, p3)
+	time.Sleep(100 * time.Millisecond)
+
+	s := NewServer()
+	s.SetPool("peer", []interface{}{p1, p2, p3})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := make([]Node, 0)
+	if err := json.NewDecoder(res.Body).Decode(&nodes); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(nodes) != 3 {
+		t.Fatalf("expected 3 peers, got %d", len(nodes))
+	}
+
+	res, err = http.Post(fmt.Sprintf("%s/peers/%d/lock", srv.URL, p3.Port), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if p3.Status().Lock != 1 {
+		t.Fatalf("expected peer %d locked", p3.Port)
+	}
+
+	res, err = http.Post(fmt.Sprintf("%s/peers/%d/fw", srv.URL, p1.Port), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	// forwarded in the background
+	for i := 0; i < 50 && p2.Status().Token == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p2.Status().Token != 1 || p3.Status().Token != 0 {
+		t.Fatalf("expected token to stop at locked peer, got %d %d", p2.Status().Token, p3.Status().Token)
+	}
+
+	res, err = http.Post(fmt.Sprintf("%s/peers/%d/leave", srv.URL, p2.Port), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if p1.Status().Next != p3.Port {
+		t.Fatalf("expected ring closed around %d, next is %d", p2.Port, p1.Status().Next)
+	}
+
+	res, err = http.Get(fmt.Sprintf("%s/peers/%d", srv.URL, p2.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 after leave, got %d", res.StatusCode)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	for addr, want := range map[string]string{":8080": "127.0.0.1:8080", "0.0.0.0:8080": "0.0.0.0:8080", "localhost:80": "localhost:80"} {
+		if got := loopback(addr); got != want {
+			t.Fatalf("%s: expected %s, got %s", addr, want, got)
+		}
+	}
+}
+
+// reads while peers gossip (run with -race)
+func TestAdminGossip(t *testing.T) {
+	pool := []interface{}{}
+	for i := 0; i < 3; i++ {
+		pool = append(pool, peergossip.NewPeer(uint16(4550+i)))
+	}
+	time.Sleep(100 * time.Millisecond)
+	pool[0].(*peergossip.Peer).Register(4551)
+	pool[1].(*peergossip.Peer).Register(4552)
+
+	s := NewServer()
+	s.SetPool("peergossip", pool)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for i := 0; i < 20; i++ {
+		res, err := http.Post(fmt.Sprintf("%s/peers/4550/gossip?word=w:%d", srv.URL, i), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		res, err = http.Get(srv.URL + "/peers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	for i := 0; i < 50 && pool[2].(*peergossip.Peer).Known() < 20; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err := http.Get(srv.URL + "/peers/4552")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := struct {
+		State peergossip.Status `json:"state"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&node); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(node.State.Words) != 20 || len(node.State.Registry) != 1 || len(pool[2].(*peergossip.Peer).Rumors("w:7")) != 1 {
+		t.Fatalf("%+v", node.State)
+	}
+
+	res, err = http.Post(srv.URL+"/peers/4550/gossip?word=", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an empty word rejected, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	crand "crypto/rand"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Signed messages between peers. Every node (peer port) owns an ed25519 keypair and seals
+// each message body it sends to a receiver port as:
+//
+//	<receiver port>|<sender port>|<seq>|<payload>|<signature (b64)>
+//
+// Receivers open bodies against a Keyring (port -> public key): the body must be addressed to
+// them (a message sealed for a peer can't be replayed to another sharing the keys), the signature
+// must match the sender key and seq must not have been seen on that link (sliding window,
+// messages sent concurrently may arrive out of order). Callers check the sender against the
+// identity claimed in the payload (ex: the port in a gossip word), so a peer can't speak for another.
+
+// replay window size (messages per link), wide enough for bursts of concurrent sends (dense
+// gossip meshes), seqs are kept in a map since a 64 bit bitmap is too narrow for them
+const window = 1024
+
+var ErrForged = errors.New("invalid signature")
+var ErrReplayed = errors.New("replayed message")
+var ErrUnknown = errors.New("unknown sender")
+var ErrMalformed = errors.New("malformed sealed message")
+var ErrMisdirected = errors.New("message sealed for another receiver")
+
+// Keys of every peer created in this process are added to Default. Set KeyDir to
+// share keys between processes on the same host: node keys are kept in
+// <KeyDir>/<port>.key and unknown senders are looked up in <KeyDir>/<port>.pub.
+var Default = NewKeyring()
+var KeyDir = ""
+
+type Node struct {
+	Port uint16
+	priv ed25519.PrivateKey
+	seq  uint64
+}
+
+type Keyring struct {
+	mu   sync.Mutex
+	keys map[uint16]ed25519.PublicKey
+	seen map[link]*replay
+}
+
+// receiver, sender
+type link [2]uint16
+
+// highest seq seen and the seqs seen in the window bellow it
+type replay struct {
+	max  uint64
+	seen map[uint64]bool
+}
+
+// Identity of the local operator (orchestrator shell, admin API), port 0
+var Operator = NewNode(0, Default)
+
+// NewNode creates (or loads from KeyDir) the keypair of port and adds its public key to ring
+func NewNode(port uint16, ring *Keyring) *Node {
+	priv, err := loadKey(port)
+	if err != nil {
+		_, priv, err = ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		storeKey(port, priv)
+	}
+	// seq starts at the current time so a restarted node isn't taken for a replay
+	n := &Node{Port: port, priv: priv, seq: uint64(time.Now().UnixNano())}
+	ring.Add(port, n.Public())
+	return n
+}
+
+func (n *Node) Public() ed25519.PublicKey {
+	return n.priv.Public().(ed25519.PublicKey)
+}
+
+// Seal signs payload for receiver to with a fresh sequence number
+func (n *Node) Seal(to uint16, payload string) string {
+	seq := atomic.AddUint64(&n.seq, 1)
+	msg := fmt.Sprintf("%d|%d|%d|%s", to, n.Port, seq, payload)
+	return msg + "|" + b64.StdEncoding.EncodeToString(ed25519.Sign(n.priv, []byte(msg)))
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[uint16]ed25519.PublicKey),
+		seen: make(map[link]*replay),
+	}
+}
+
+func (k *Keyring) Add(port uint16, pub ed25519.PublicKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[port] = pub
+	for l := range k.seen {
+		if l[1] == port {
+			delete(k.seen, l)
+		}
+	}
+}
+
+// Open verifies a body sealed for receiver to and returns its payload and authenticated sender
+func (k *Keyring) Open(to uint16, body string) (string, uint16, error) {
+	cut := strings.LastIndex(body, "|")
+	if cut < 0 {
+		return "", 0, ErrMalformed
+	}
+	msg := body[:cut]
+	split := strings.SplitN(msg, "|", 4)
+	if len(split) != 4 {
+		return "", 0, ErrMalformed
+	}
+	sig, err := b64.StdEncoding.DecodeString(body[cut+1:])
+	if err != nil {
+		return "", 0, ErrMalformed
+	}
+	receiver, err := strconv.ParseUint(split[0], 10, 16)
+	if err != nil {
+		return "", 0, ErrMalformed
+	}
+	port, err := strconv.ParseUint(split[1], 10, 16)
+	if err != nil {
+		return "", 0, ErrMalformed
+	}
+	seq, err := strconv.ParseUint(split[2], 10, 64)
+	if err != nil {
+		return "", 0, ErrMalformed
+	}
+	sender := uint16(port)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pub, ok := k.keys[sender]
+	if !ok {
+		pub, err = loadPublic(sender)
+		if err != nil {
+			return "", sender, ErrUnknown
+		}
+		k.keys[sender] = pub
+	}
+	if !ed25519.Verify(pub, []byte(msg), sig) {
+		return "", sender, ErrForged
+	}
+	if uint16(receiver) != to {
+		return "", sender, ErrMisdirected
+	}
+	if !k.accept(link{to, sender}, seq) {
+		return "", sender, ErrReplayed
+	}
+	return split[3], sender, nil
+}
+
+// marks seq as seen on l, false if it was already seen or is older than the window (k.mu must be held)
+func (k *Keyring) accept(l link, seq uint64) bool {
+	r, ok := k.seen[l]
+	if !ok {
+		r = &replay{seen: make(map[uint64]bool)}
+		k.seen[l] = r
+	}
+	if seq == 0 || r.seen[seq] || (r.max >= window && seq <= r.max-window) {
+		return false
+	}
+	r.seen[seq] = true
+	if seq > r.max {
+		r.max = seq
+		if len(r.seen) > 2*window {
+			for v := range r.seen {
+				if r.max >= window && v <= r.max-window {
+					delete(r.seen, v)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// grpc error returned to senders of messages that fail Open
+func Reject(err error) error {
+	return status.Error(codes.Unauthenticated, err.Error())
+}
+
+// Rejected reports whether a call failed on a Reject error (the message, not the connection, failed)
+func Rejected(err error) bool {
+	return status.Code(err) == codes.Unauthenticated
+}
+
+// aux
+
+func loadKey(port uint16) (ed25519.PrivateKey, error) {
+	if KeyDir == "" {
+		return nil, os.ErrNotExist
+	}
+	b, err := os.ReadFile(filepath.Join(KeyDir, fmt.Sprintf("%d.key", port)))
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrMalformed
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func storeKey(port uint16, priv ed25519.PrivateKey) {
+	if KeyDir == "" {
+		return
+	}
+	if err := os.MkdirAll(KeyDir, 0700); err != nil {
+		return
+	}
+	os.WriteFile(filepath.Join(KeyDir, fmt.Sprintf("%d.key", port)), []byte(hex.EncodeToString(priv.Seed())), 0600)
+	os.WriteFile(filepath.Join(KeyDir, fmt.Sprintf("%d.pub", port)), []byte(hex.EncodeToString(priv.Public().(ed25519.PublicKey))), 0644)
+}
+
+func loadPublic(port uint16) (ed25519.PublicKey, error) {
+	if KeyDir == "" {
+		return nil, os.ErrNotExist
+	}
+	b, err := os.ReadFile(filepath.Join(KeyDir, fmt.Sprintf("%d.pub", port)))
+	if err != nil {
+		return nil, err
+	}
+	pub, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, ErrMalformed
+	}
+	return pub, nil
+}
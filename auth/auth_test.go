@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	ring := NewKeyring()
+	n1 := NewNode(4641, ring)
+	n2 := NewNode(4642, NewKeyring()) // key unknown to ring
+
+	sealed := n1.Seal(4640, "hello:4641")
+	body, sender, err := ring.Open(4640, sealed)
+	if err != nil || body != "hello:4641" || sender != 4641 {
+		t.Fatalf("unexpected open result %q %d %v", body, sender, err)
+	}
+	if _, _, err := ring.Open(4640, sealed); err != ErrReplayed {
+		t.Fatalf("expected replay to be rejected, got %v", err)
+	}
+	if _, _, err := ring.Open(4640, strings.Replace(n1.Seal(4640, "hello:4641"), "hello", "olleh", 1)); err != ErrForged {
+		t.Fatalf("expected tampered payload to be rejected, got %v", err)
+	}
+	// n2 claiming to be n1
+	forged := strings.Replace(n2.Seal(4640, "hello:4641"), "|4642|", "|4641|", 1)
+	if _, _, err := ring.Open(4640, forged); err != ErrForged {
+		t.Fatalf("expected spoofed sender to be rejected, got %v", err)
+	}
+	if _, _, err := ring.Open(4640, n2.Seal(4640, "hello:4642")); err != ErrUnknown {
+		t.Fatalf("expected unknown sender to be rejected, got %v", err)
+	}
+	if _, _, err := ring.Open(4640, "hello:4641"); err != ErrMalformed {
+		t.Fatalf("expected unsealed body to be rejected, got %v", err)
+	}
+	// sealed for 4640, replayed to another receiver sharing the keys
+	if _, _, err := ring.Open(4643, n1.Seal(4640, "hello:4641")); err != ErrMisdirected {
+		t.Fatalf("expected misdirected message to be rejected, got %v", err)
+	}
+	if body, _, err := ring.Open(4640, n1.Seal(4640, "a|b|c")); err != nil || body != "a|b|c" {
+		t.Fatalf("unexpected open result %q %v", body, err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	ring := NewKeyring()
+	n := NewNode(4641, ring)
+	sealed := make([]string, 0)
+	for i := 0; i < window+2; i++ {
+		sealed = append(sealed, n.Seal(4640, "w"))
+	}
+
+	// out of order delivery within the window is accepted
+	if _, _, err := ring.Open(4640, sealed[3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ring.Open(4640, sealed[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ring.Open(4640, sealed[window+1]); err != nil {
+		t.Fatal(err)
+	}
+	// older than the window
+	if _, _, err := ring.Open(4640, sealed[0]); err != ErrReplayed {
+		t.Fatalf("expected message older than the window to be rejected, got %v", err)
+	}
+	// windows are per receiver
+	if _, _, err := ring.Open(4643, n.Seal(4643, "w")); err != nil {
+		t.Fatal(err)
+	}
+}
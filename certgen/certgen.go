@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"token-ring/certs"
+)
+
+// Creates a local CA (or reuses the one in -out) and a certificate per node:
+//
+//	go run ./certgen -out certs -nodes node1,node2 -ips 10.0.0.2
+//	go run ./orchestrator -tls-ca certs/ca.crt -tls-cert certs/node1.crt -tls-key certs/node1.key
+func main() {
+	outFlg := flag.String("out", "certs", "output directory")
+	nodesFlg := flag.String("nodes", "node", "comma separated node names, one certificate each")
+	ipsFlg := flag.String("ips", "", "comma separated extra IPs added to every node certificate (localhost is always included)")
+	flag.Parse()
+
+	ips := make([]net.IP, 0)
+	if *ipsFlg != "" {
+		for _, v := range strings.Split(*ipsFlg, ",") {
+			ip := net.ParseIP(strings.TrimSpace(v))
+			if ip == nil {
+				fmt.Fprintf(os.Stderr, "invalid ip %q\n", v)
+				os.Exit(2)
+			}
+			ips = append(ips, ip)
+		}
+	}
+
+	ca, err := certs.LoadCA(*outFlg)
+	if err != nil {
+		ca, err = certs.NewCA("token-ring local CA")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := ca.Write(*outFlg); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Created CA %s/ca.crt\n", *outFlg)
+	}
+
+	for _, name := range strings.Split(*nodesFlg, ",") {
+		name = strings.TrimSpace(name)
+		pair, err := ca.Issue(name, ips)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := pair.Write(*outFlg, name); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Created %s/%s.crt\n", *outFlg, name)
+	}
+}
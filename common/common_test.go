@@ -48,14 +48,168 @@ func TestPoissonTime(t *testing.T) {
 	fmt.Printf("Start: %v\n", start)
 	fmt.Printf("Timestamps: %v\n", timestamps)
 	// ---
-	for i < len(timestamps) {
-		v := timestamps[i]
-		if time.Since(start).Seconds() >= v {
+	s := NewScheduler()
+	defer s.Stop()
+	fired := make(chan struct{})
+	for _, v := range timestamps {
+		s.At(start.Add(time.Duration(v*float64(time.Second))), func() {
 			fmt.Println("Event trigger")
-			i += 1
-		} else {
-			evtime := start.Add(time.Duration(v))
-			time.Sleep(time.Since(evtime))
+			fired <- struct{}{}
+		})
+	}
+	for range timestamps {
+		<-fired
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := NewScheduler()
+	defer s.Stop()
+	order := make(chan int, 10)
+	start := time.Now()
+	// out of order, ties in scheduling order
+	s.After(60*time.Millisecond, func() { order <- 3 })
+	s.After(20*time.Millisecond, func() { order <- 1 })
+	s.After(40*time.Millisecond, func() { order <- 2 })
+	s.After(60*time.Millisecond, func() { order <- 4 })
+	cancelled := s.After(30*time.Millisecond, func() { order <- -1 })
+	s.At(start.Add(-time.Second), func() { order <- 0 }) // past: right away
+	if !s.Cancel(cancelled) || s.Cancel(cancelled) {
+		t.Fatal("cancel")
+	}
+	for i := 0; i <= 4; i++ {
+		if v := <-order; v != i {
+			t.Fatalf("timer %d fired at position %d", v, i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("last timer fired after %v", elapsed)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("%d timers left", s.Len())
+	}
+
+	// an earlier timer added while sleeping on a later one
+	s.After(time.Hour, func() { order <- -1 })
+	s.After(10*time.Millisecond, func() { order <- 5 })
+	select {
+	case v := <-order:
+		if v != 5 {
+			t.Fatalf("timer %d fired", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("scheduler kept sleeping on the later timer")
+	}
+
+	s.Stop()
+	if s.Len() != 0 || s.After(0, func() {}) != nil {
+		t.Fatal("timers after stop")
+	}
+}
+
+func TestVirtualScheduler(t *testing.T) {
+	start := time.Unix(0, 0)
+	s := NewVirtualScheduler(start)
+	order := make([]int, 0)
+	s.After(2*time.Second, func() { order = append(order, 3) })
+	s.After(time.Second, func() {
+		order = append(order, 1)
+		s.Go(func() { order = append(order, 2) }) // due now, after this one
+		s.Advance(500 * time.Millisecond)         // a blocking call
+	})
+	s.After(3*time.Second, func() { order = append(order, 4) })
+	if steps := s.Run(start.Add(2*time.Second), 0); steps != 3 || !s.Now().Equal(start.Add(2*time.Second)) {
+		t.Fatalf("%d steps, now %s", steps, s.Now().Sub(start))
+	}
+	if steps := s.Run(time.Time{}, 1); steps != 1 || fmt.Sprint(order) != "[1 2 3 4]" || s.Len() != 0 {
+		t.Fatalf("%d steps, order %v", steps, order)
+	}
+
+	// events and periodic timers, all in virtual time
+	n, ticks := 0, 0
+	s.Each(EventConfig{Dist: Constant, Rate: 1, Count: 5}, func(e Event) { n += 1 })
+	stop := s.Every(time.Second, func() { ticks += 1 })
+	s.Run(s.Now().Add(10*time.Second+time.Millisecond), 0)
+	stop()
+	if n != 5 || ticks != 10 || s.Len() != 0 {
+		t.Fatalf("%d events, %d ticks, %d timers left", n, ticks, s.Len())
+	}
+
+	// calls awaited by two callbacks overlap, each resumes when its reply comes
+	s = NewVirtualScheduler(start)
+	replied := make([]time.Duration, 0)
+	call := func(d time.Duration) {
+		s.Await(func(done func()) { s.After(d, done) })
+		replied = append(replied, s.Now().Sub(start))
+	}
+	s.After(time.Second, func() { call(2 * time.Second) })
+	s.After(time.Second, func() { call(time.Second) })
+	if s.Run(time.Time{}, 0); fmt.Sprint(replied) != "[2s 3s]" || s.Len() != 0 {
+		t.Fatalf("replies at %v", replied)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	// same seed, same times
+	gen := func(cfg EventConfig) []time.Duration {
+		res := make([]time.Duration, 0)
+		g := NewEventGenerator(cfg)
+		for e, ok := g.Next(); ok; e, ok = g.Next() {
+			res = append(res, e.At)
+		}
+		return res
+	}
+	for _, dist := range []Distribution{Poisson, Uniform, Constant, Bursty} {
+		cfg := EventConfig{Dist: dist, Rate: 2, Seed: 7, Count: 2000}
+		a, b := gen(cfg), gen(cfg)
+		if len(a) != 2000 || fmt.Sprint(a) != fmt.Sprint(b) {
+			t.Fatalf("%s: %d events, not reproducible", dist, len(a))
+		}
+		// mean inter-arrival of 1/Rate (bursty is faster)
+		mean := a[len(a)-1].Seconds() / float64(len(a))
+		if dist != Bursty && (mean < 0.45 || mean > 0.55) {
+			t.Errorf("%s: mean inter-arrival %.3fs, expected 0.5s", dist, mean)
+		}
+		if dist == Bursty && mean >= 0.45 {
+			t.Errorf("bursty: mean inter-arrival %.3fs, expected < 0.5s", mean)
+		}
+	}
+	if a := gen(EventConfig{Dist: Constant, Rate: 10, Count: 3}); fmt.Sprint(a) != "[100ms 200ms 300ms]" {
+		t.Errorf("constant: %v", a)
+	}
+	if a := gen(EventConfig{Dist: Constant, Rate: 10, Duration: 450 * time.Millisecond}); len(a) != 4 {
+		t.Errorf("duration: %d events, expected 4", len(a))
+	}
+
+	// delivered on a channel as they happen, closed at the end
+	start := time.Now()
+	events, _ := Events(EventConfig{Dist: Constant, Rate: 50, Count: 5})
+	n := 0
+	for e := range events {
+		if e.Seq != n || time.Since(start) < e.At {
+			t.Fatalf("event %d (%d) at %v delivered early", e.Seq, n, e.At)
+		}
+		n += 1
+	}
+	if n != 5 {
+		t.Fatalf("%d events, expected 5", n)
+	}
+	events, stop := Events(EventConfig{Dist: Constant, Rate: 1})
+	stop()
+	if _, ok := <-events; ok {
+		t.Fatal("event after stop")
+	}
+
+	cfg, err := ParseEvents("bursty:2/min:5", EventConfig{Seed: 3})
+	if err != nil || cfg.Dist != Bursty || cfg.Rate != 2.0/60 || cfg.BurstFactor != 5 || cfg.Seed != 3 {
+		t.Fatalf("parse: %+v %v", cfg, err)
+	}
+	if cfg, err := ParseEvents("poisson:1/30s", EventConfig{}); err != nil || cfg.Rate != 1.0/30 {
+		t.Fatalf("parse: %+v %v", cfg, err)
+	}
+	for _, spec := range []string{"gauss", "poisson:0", "poisson:x", "uniform:1:2", "poisson:1/x"} {
+		if _, err := ParseEvents(spec, EventConfig{}); err == nil {
+			t.Errorf("%q parsed", spec)
 		}
 	}
 }
@@ -0,0 +1,261 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Event generators: times of the events driving the modules (words gossiped, multicast pings).
+	Inter-arrival times follow a distribution of mean 1/Rate seconds:
+
+	poisson    exponential inter-arrivals (a Poisson process)
+	uniform    uniform inter-arrivals in [0, 2/Rate]
+	constant   exactly 1/Rate apart
+	bursty     two state Markov-modulated Poisson process (MMPP): Poisson at Rate while quiet and at
+	           Rate*BurstFactor during bursts, states last QuietLen and BurstLen on average
+
+	Generators are seeded, the same config always yields the same times.
+*/
+
+type Distribution int
+
+const (
+	Poisson Distribution = iota
+	Uniform
+	Constant
+	Bursty
+)
+
+var Distributions = []string{"poisson", "uniform", "constant", "bursty"}
+
+func (d Distribution) String() string {
+	if int(d) < len(Distributions) {
+		return Distributions[d]
+	}
+	return fmt.Sprintf("Distribution(%d)", int(d))
+}
+
+type EventConfig struct {
+	Dist     Distribution
+	Rate     float64       // events per second (quiet rate of bursty)
+	Seed     int64         // rng seed
+	Duration time.Duration // no events past it (0 - unlimited)
+	Count    int           // events generated (0 - unlimited)
+	// bursty only (0 - 10, 10/Rate and 1/Rate)
+	BurstFactor float64
+	QuietLen    time.Duration
+	BurstLen    time.Duration
+}
+
+type Event struct {
+	Seq int           // from 0
+	At  time.Duration // since the generator started
+}
+
+type EventGenerator struct {
+	cfg   EventConfig
+	rng   *rand.Rand
+	t     float64 // seconds, time of the last event
+	seq   int
+	burst bool
+}
+
+func NewEventGenerator(cfg EventConfig) *EventGenerator {
+	if cfg.BurstFactor == 0 {
+		cfg.BurstFactor = 10
+	}
+	if cfg.QuietLen == 0 && cfg.Rate > 0 {
+		cfg.QuietLen = time.Duration(10 / cfg.Rate * float64(time.Second))
+	}
+	if cfg.BurstLen == 0 && cfg.Rate > 0 {
+		cfg.BurstLen = time.Duration(1 / cfg.Rate * float64(time.Second))
+	}
+	return &EventGenerator{cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+// Next event, false once Count or Duration is reached
+func (g *EventGenerator) Next() (Event, bool) {
+	if g.cfg.Rate <= 0 || (g.cfg.Count > 0 && g.seq >= g.cfg.Count) {
+		return Event{}, false
+	}
+	g.t += g.interArrival()
+	at := time.Duration(g.t * float64(time.Second))
+	if g.cfg.Duration > 0 && at > g.cfg.Duration {
+		return Event{}, false
+	}
+	e := Event{Seq: g.seq, At: at}
+	g.seq += 1
+	return e, true
+}
+
+// seconds until the next event
+func (g *EventGenerator) interArrival() float64 {
+	switch g.cfg.Dist {
+	case Uniform:
+		return g.rng.Float64() * 2 / g.cfg.Rate
+	case Constant:
+		return 1 / g.cfg.Rate
+	case Bursty:
+		// memoryless: race the next arrival against the state change, from the current state
+		var waited float64
+		for {
+			rate, stay := g.cfg.Rate, g.cfg.QuietLen.Seconds()
+			if g.burst {
+				rate, stay = g.cfg.Rate*g.cfg.BurstFactor, g.cfg.BurstLen.Seconds()
+			}
+			arrival, change := g.rng.ExpFloat64()/rate, g.rng.ExpFloat64()*stay
+			if arrival <= change {
+				return waited + arrival
+			}
+			waited += change
+			g.burst = !g.burst
+		}
+	}
+	return g.rng.ExpFloat64() / g.cfg.Rate
+}
+
+// Each runs f on every event of cfg, timed by s from now (f runs on the scheduler, it must not
+// block), until the generator is done or stop is called
+func (s *Scheduler) Each(cfg EventConfig, f func(Event)) (stop func()) {
+	g := NewEventGenerator(cfg)
+	start := s.Now()
+	var mu sync.Mutex
+	var timer *Timer
+	stopped := false
+	var schedule func()
+	schedule = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		e, ok := g.Next()
+		if stopped || !ok {
+			return
+		}
+		timer = s.At(start.Add(e.At), func() {
+			f(e)
+			schedule()
+		})
+	}
+	schedule()
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		s.Cancel(timer)
+	}
+}
+
+// Events delivers the events of cfg on the returned channel as they happen, timed by the
+// DefaultScheduler (closed once the generator is done or stop is called)
+func Events(cfg EventConfig) (events <-chan Event, stop func()) {
+	return DefaultScheduler().Events(cfg)
+}
+
+// Events of cfg timed by s, see Events
+func (s *Scheduler) Events(cfg EventConfig) (events <-chan Event, stop func()) {
+	ch := make(chan Event)
+	done := make(chan struct{})
+	g := NewEventGenerator(cfg)
+	start := s.Now()
+	var mu sync.Mutex
+	var timer *Timer
+	stopped := false
+
+	var schedule func()
+	// the next event is only scheduled once the previous one was received
+	deliver := func(e Event) {
+		select {
+		case <-done:
+		case ch <- e:
+		}
+		schedule()
+	}
+	schedule = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		e, ok := g.Next()
+		if stopped || !ok {
+			close(ch)
+			return
+		}
+		if timer = s.At(start.Add(e.At), func() { go deliver(e) }); timer == nil {
+			close(ch)
+		}
+	}
+	schedule()
+	return ch, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		stopped = true
+		close(done)
+		// a timer that already fired closes ch through deliver
+		if s.Cancel(timer) {
+			close(ch)
+		}
+	}
+}
+
+// ParseEvents: <dist>[:<rate>] with rate in events per second (ex: 2, 0.5) or per unit (ex: 2/min,
+// 10/s, 1/30s), bursty takes :<factor> after the rate. Unset fields are taken from def.
+func ParseEvents(spec string, def EventConfig) (EventConfig, error) {
+	cfg := def
+	split := strings.Split(spec, ":")
+	dist := -1
+	for i, name := range Distributions {
+		if name == split[0] {
+			dist = i
+		}
+	}
+	if dist < 0 || len(split) > 3 || (len(split) == 3 && Distribution(dist) != Bursty) {
+		return cfg, fmt.Errorf("invalid events %q (<dist>[:rate] with dist %s, bursty:rate:factor)", spec, strings.Join(Distributions, ", "))
+	}
+	cfg.Dist = Distribution(dist)
+	if len(split) > 1 {
+		rate, err := parseRate(split[1])
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Rate = rate
+	}
+	if len(split) > 2 {
+		factor, err := strconv.ParseFloat(split[2], 64)
+		if err != nil || factor < 1 {
+			return cfg, fmt.Errorf("invalid burst factor %q", split[2])
+		}
+		cfg.BurstFactor = factor
+	}
+	return cfg, nil
+}
+
+// aux
+
+// events per second of "<n>" or "<n>/<duration>" (the duration unit alone counts as 1, ex: 2/min)
+func parseRate(s string) (float64, error) {
+	n, per, found := strings.Cut(s, "/")
+	rate, err := strconv.ParseFloat(n, 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	if !found {
+		return rate, nil
+	}
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	if per == "1min" {
+		per = "1m"
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate / d.Seconds(), nil
+}
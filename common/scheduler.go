@@ -0,0 +1,338 @@
+package common
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+/*
+	Timer-heap scheduler: timers are kept in a min-heap by due time and a single goroutine sleeps
+	until the earliest one is due (or a new earlier timer is added), so pending events cost no CPU.
+	Timer callbacks run on that goroutine, in due time order, and must not block (hand long work
+	to a goroutine, see Go).
+
+	A virtual scheduler (NewVirtualScheduler) keeps its own clock instead: nothing sleeps, Run pops
+	the timers in due order and moves the clock to each one, and Go hands work to a timer due now
+	instead of a goroutine, so code timed by a Scheduler runs in virtual time, one callback at a time.
+	Its callbacks may block in Await (a call waiting for its reply): the callback parks, the other
+	timers run meanwhile, and it resumes from a timer of its own, still one callback at a time.
+*/
+
+type Scheduler struct {
+	mu      sync.Mutex
+	timers  timerHeap
+	seq     uint64        // ties broken by scheduling order
+	wake    chan struct{} // the earliest timer changed
+	done    chan struct{}
+	stopped bool
+	// virtual clock (NewVirtualScheduler), the running callback returned or parked (see Await)
+	virtual bool
+	now     time.Time
+	yield   chan struct{}
+}
+
+type Timer struct {
+	at    time.Time
+	seq   uint64
+	f     func()
+	index int // in the heap, -1 once fired or cancelled
+	// parked callback to resume instead of f (see Await)
+	resume chan struct{}
+}
+
+func NewScheduler() *Scheduler {
+	s := &Scheduler{
+		timers: make(timerHeap, 0),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// NewVirtualScheduler in virtual time from start, its timers only run through Run
+func NewVirtualScheduler(start time.Time) *Scheduler {
+	return &Scheduler{
+		timers:  make(timerHeap, 0),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		virtual: true,
+		now:     start,
+		yield:   make(chan struct{}),
+	}
+}
+
+var defaultScheduler struct {
+	once sync.Once
+	s    *Scheduler
+}
+
+// DefaultScheduler shared by the module event generators
+func DefaultScheduler() *Scheduler {
+	defaultScheduler.once.Do(func() { defaultScheduler.s = NewScheduler() })
+	return defaultScheduler.s
+}
+
+// At runs f at t (right away if t has passed), nil once the scheduler is stopped
+func (s *Scheduler) At(t time.Time, f func()) *Timer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil
+	}
+	s.seq += 1
+	timer := &Timer{at: t, seq: s.seq, f: f}
+	heap.Push(&s.timers, timer)
+	if timer.index == 0 {
+		s.signal()
+	}
+	return timer
+}
+
+// After runs f after d
+func (s *Scheduler) After(d time.Duration, f func()) *Timer {
+	return s.At(s.Now().Add(d), f)
+}
+
+// Now on the scheduler clock (time.Now unless virtual)
+func (s *Scheduler) Now() time.Time {
+	if !s.virtual {
+		return time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Go runs f on its own goroutine, virtual schedulers run it as a timer due now (after the current one)
+func (s *Scheduler) Go(f func()) {
+	if !s.virtual {
+		go f()
+		return
+	}
+	s.At(s.Now(), f)
+}
+
+// Advance moves a virtual clock forward by d (the time a blocking call takes), timers due meanwhile
+// run late. Real clocks can't be moved.
+func (s *Scheduler) Advance(d time.Duration) {
+	if !s.virtual {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+// Every runs f every d (handed over with Go, f may block) until stop
+func (s *Scheduler) Every(d time.Duration, f func()) (stop func()) {
+	var mu sync.Mutex
+	var timer *Timer
+	stopped := false
+	var schedule func()
+	schedule = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			timer = s.After(d, func() {
+				s.Go(f)
+				schedule()
+			})
+		}
+	}
+	schedule()
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		s.Cancel(timer)
+	}
+}
+
+// Run runs the timers of a virtual scheduler due up to until (zero - until there are none left),
+// at most max of them (0 - unlimited), then moves the clock to until. Returns the timers run.
+func (s *Scheduler) Run(until time.Time, max int) int {
+	steps := 0
+	for s.virtual && (max == 0 || steps < max) {
+		s.mu.Lock()
+		if len(s.timers) == 0 || (!until.IsZero() && s.timers[0].at.After(until)) {
+			if !until.IsZero() && until.After(s.now) {
+				s.now = until
+			}
+			s.mu.Unlock()
+			return steps
+		}
+		timer := heap.Pop(&s.timers).(*Timer)
+		if timer.at.After(s.now) {
+			s.now = timer.at
+		}
+		s.mu.Unlock()
+		s.step(timer)
+		steps += 1
+	}
+	return steps
+}
+
+// runs a virtual timer callback on a goroutine of its own (or resumes a parked one) until it
+// returns or parks
+func (s *Scheduler) step(timer *Timer) {
+	if timer.resume != nil {
+		timer.resume <- struct{}{}
+	} else {
+		go func() {
+			timer.f()
+			s.yield <- struct{}{}
+		}()
+	}
+	<-s.yield
+}
+
+// Await runs start and waits until it calls done (once, from any callback). A virtual scheduler
+// callback (the caller, run by Run) parks meanwhile: Run goes on with the other timers and the
+// clock moves, the caller resumes from a timer due when done is called.
+func (s *Scheduler) Await(start func(done func())) {
+	resume := make(chan struct{})
+	if !s.virtual {
+		start(func() { close(resume) })
+		<-resume
+		return
+	}
+	start(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.seq += 1
+		heap.Push(&s.timers, &Timer{at: s.now, seq: s.seq, resume: resume})
+	})
+	s.yield <- struct{}{}
+	<-resume
+}
+
+// Cancel timer, false if it already fired (or was cancelled)
+func (s *Scheduler) Cancel(timer *Timer) bool {
+	if timer == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer.index < 0 {
+		return false
+	}
+	first := timer.index == 0
+	heap.Remove(&s.timers, timer.index)
+	if first {
+		s.signal()
+	}
+	return true
+}
+
+// Len pending timers
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.timers)
+}
+
+// Stop drops the pending timers, no timer fires afterwards (Events channels waiting on one stay open)
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	for _, timer := range s.timers {
+		timer.index = -1
+	}
+	s.timers = s.timers[:0]
+	close(s.done)
+}
+
+func (s *Scheduler) run() {
+	sleep := time.NewTimer(time.Hour)
+	defer sleep.Stop()
+	for {
+		s.mu.Lock()
+		due := make([]*Timer, 0)
+		now := time.Now()
+		for len(s.timers) > 0 && !s.timers[0].at.After(now) {
+			due = append(due, heap.Pop(&s.timers).(*Timer))
+		}
+		var next <-chan time.Time
+		if len(s.timers) > 0 {
+			if !sleep.Stop() {
+				select {
+				case <-sleep.C:
+				default:
+				}
+			}
+			sleep.Reset(s.timers[0].at.Sub(now))
+			next = sleep.C
+		}
+		s.mu.Unlock()
+
+		for _, timer := range due {
+			if s.isStopped() {
+				break
+			}
+			timer.f()
+		}
+		if len(due) > 0 {
+			continue
+		}
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		case <-next:
+		}
+	}
+}
+
+func (s *Scheduler) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// wakes run up to recompute its sleep (s.mu must be held)
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// aux
+
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	timer := x.(*Timer)
+	timer.index = len(*h)
+	*h = append(*h, timer)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	timer := old[len(old)-1]
+	old[len(old)-1] = nil
+	timer.index = -1
+	*h = old[:len(old)-1]
+	return timer
+}
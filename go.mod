@@ -2,18 +2,20 @@ module token-ring
 
 go 1.18
 
-require google.golang.org/grpc v1.50.1
+require (
+	github.com/fatih/color v1.13.0
+	golang.org/x/exp v0.0.0-20221031165847-c99f073a8326
+	google.golang.org/grpc v1.50.1
+	google.golang.org/protobuf v1.27.1
+)
 
 require (
-	github.com/fatih/color v1.13.0 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/mattn/go-colorable v0.1.9 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
-	golang.org/x/exp v0.0.0-20221031165847-c99f073a8326 // indirect
 	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
 	golang.org/x/sys v0.1.0 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	gonum.org/v1/gonum v0.12.0 // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
-	google.golang.org/protobuf v1.27.1 // indirect
 )
@@ -0,0 +1,333 @@
+package hyparview
+
+import (
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+	"token-ring/common"
+)
+
+// HyParView peer sampling (Leitão et al.): every node keeps a small symmetric active view, the
+// neighbours it gossips to, and a larger passive view of backup nodes. Nodes join through a
+// contact (random walks spread the newcomer over active and passive views), periodically shuffle
+// passive views with random walks, and replace failed or disconnected active neighbours from the
+// passive view, which keeps the overlay connected under churn.
+//
+// The package doesn't do any networking, messages go out through the Send func given to New and
+// come in through Handle (see peergossip for the gRPC transport).
+
+type Kind string
+
+const (
+	Join          Kind = "join"
+	ForwardJoin   Kind = "forward-join"
+	Disconnect    Kind = "disconnect"
+	Neighbor      Kind = "neighbor"
+	NeighborReply Kind = "neighbor-reply"
+	Shuffle       Kind = "shuffle"
+	ShuffleReply  Kind = "shuffle-reply"
+)
+
+type Message struct {
+	Kind     Kind     `json:"kind"`
+	Node     uint16   `json:"node,omitempty"`     // joining node (forward-join), shuffle origin
+	TTL      int      `json:"ttl,omitempty"`      // random walk hops left
+	Priority bool     `json:"priority,omitempty"` // neighbor: the sender has no active neighbours
+	Accept   bool     `json:"accept,omitempty"`   // neighbor-reply
+	Nodes    []uint16 `json:"nodes,omitempty"`    // shuffle sample
+}
+
+type Config struct {
+	ActiveSize     int           // active view (log n + c)
+	PassiveSize    int           // passive view (k * (log n + c))
+	ARWL           int           // active random walk length (join, shuffle)
+	PRWL           int           // passive random walk length, forward-join adds to the passive view here
+	ShuffleActive  int           // active nodes sent per shuffle (ka)
+	ShufflePassive int           // passive nodes sent per shuffle (kp)
+	ShufflePeriod  time.Duration // Start: shuffle (and repair) period
+}
+
+var DefaultConfig = Config{ActiveSize: 5, PassiveSize: 30, ARWL: 6, PRWL: 3, ShuffleActive: 3, ShufflePassive: 4, ShufflePeriod: 10 * time.Second}
+
+// Send delivers m to node to, an error means to is unreachable
+type Send func(to uint16, m Message) error
+
+type View struct {
+	mu      sync.Mutex
+	self    uint16
+	cfg     Config
+	send    Send
+	active  []uint16
+	passive []uint16
+	// passive nodes asked to replace a neighbour since the last accept or shuffle
+	tried []uint16
+	// random choices (seeded by self) and shuffle timer, set before Join and Start to replace them
+	Rand  *mrand.Rand
+	Sched *common.Scheduler
+}
+
+type envelope struct {
+	to uint16
+	m  Message
+}
+
+func New(self uint16, cfg Config, send Send) *View {
+	return &View{
+		self:    self,
+		cfg:     cfg,
+		send:    send,
+		active:  make([]uint16, 0),
+		passive: make([]uint16, 0),
+		tried:   make([]uint16, 0),
+		Rand:    common.NewRand(int64(self)),
+		Sched:   common.DefaultScheduler(),
+	}
+}
+
+// Join the overlay through contact
+func (v *View) Join(contact uint16) {
+	v.mu.Lock()
+	out := v.addActive(contact, false)
+	v.mu.Unlock()
+	v.dispatch(append(out, envelope{contact, Message{Kind: Join}}))
+}
+
+// Handle processes a message from node from
+func (v *View) Handle(from uint16, m Message) {
+	v.mu.Lock()
+	out := make([]envelope, 0)
+	switch m.Kind {
+	case Join:
+		out = append(out, v.addActive(from, false)...)
+		for _, n := range v.active {
+			if n != from {
+				out = append(out, envelope{n, Message{Kind: ForwardJoin, Node: from, TTL: v.cfg.ARWL}})
+			}
+		}
+	case ForwardJoin:
+		if m.TTL <= 0 || len(v.active) <= 1 {
+			out = append(out, v.addActive(m.Node, true)...)
+			break
+		}
+		if m.TTL == v.cfg.PRWL {
+			v.addPassive(m.Node)
+		}
+		if n, ok := v.pick(v.active, from, m.Node); ok {
+			out = append(out, envelope{n, Message{Kind: ForwardJoin, Node: m.Node, TTL: m.TTL - 1}})
+		} else {
+			out = append(out, v.addActive(m.Node, true)...)
+		}
+	case Disconnect:
+		if contains(v.active, from) {
+			v.active = remove(v.active, from)
+			v.addPassive(from)
+			out = append(out, v.replace(from)...)
+		}
+	case Neighbor:
+		accept := m.Priority || len(v.active) < v.cfg.ActiveSize || contains(v.active, from)
+		if accept {
+			out = append(out, v.addActive(from, false)...)
+		}
+		out = append(out, envelope{from, Message{Kind: NeighborReply, Accept: accept}})
+	case NeighborReply:
+		if m.Accept {
+			v.tried = v.tried[:0]
+			out = append(out, v.addActive(from, false)...)
+		} else {
+			out = append(out, v.replace(from)...)
+		}
+	case Shuffle:
+		if m.TTL-1 > 0 && len(v.active) > 1 {
+			if n, ok := v.pick(v.active, from, m.Node); ok {
+				m.TTL -= 1
+				out = append(out, envelope{n, m})
+				break
+			}
+		}
+		if m.Node != v.self {
+			reply := v.sample(v.passive, len(m.Nodes))
+			out = append(out, envelope{m.Node, Message{Kind: ShuffleReply, Nodes: reply}})
+			v.integrate(m.Nodes, reply)
+		}
+	case ShuffleReply:
+		v.integrate(m.Nodes, nil)
+	}
+	v.mu.Unlock()
+	v.dispatch(out)
+}
+
+// Failed forgets an unreachable node, and replaces it from the passive view if it was active
+// (or the active view is bellow size)
+func (v *View) Failed(node uint16) {
+	v.mu.Lock()
+	v.active = remove(v.active, node)
+	v.passive = remove(v.passive, node)
+	out := make([]envelope, 0)
+	if len(v.active) < v.cfg.ActiveSize {
+		out = v.replace(node)
+	}
+	v.mu.Unlock()
+	v.dispatch(out)
+}
+
+// Shuffle exchanges a sample of the views through a random walk, and refills the active view if
+// it is bellow size
+func (v *View) Shuffle() {
+	v.mu.Lock()
+	v.tried = v.tried[:0]
+	out := make([]envelope, 0)
+	if n, ok := v.pick(v.active); ok {
+		nodes := append([]uint16{v.self}, v.sample(v.active, v.cfg.ShuffleActive)...)
+		nodes = append(nodes, v.sample(v.passive, v.cfg.ShufflePassive)...)
+		out = append(out, envelope{n, Message{Kind: Shuffle, Node: v.self, TTL: v.cfg.ARWL, Nodes: nodes}})
+	}
+	if len(v.active) < v.cfg.ActiveSize {
+		out = append(out, v.replace(0)...)
+	}
+	v.mu.Unlock()
+	v.dispatch(out)
+}
+
+// Start shuffles every ShufflePeriod until stop is called
+func (v *View) Start() (stop func()) {
+	return v.Sched.Every(v.cfg.ShufflePeriod, v.Shuffle)
+}
+
+// Active view (gossip targets)
+func (v *View) Active() []uint16 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]uint16{}, v.active...)
+}
+
+// Passive view (backup nodes)
+func (v *View) Passive() []uint16 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]uint16{}, v.passive...)
+}
+
+func (v *View) String() string {
+	return fmt.Sprintf("active=%v passive=%v", v.Active(), v.Passive())
+}
+
+func (v *View) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Active  []uint16 `json:"active"`
+		Passive []uint16 `json:"passive"`
+	}{v.Active(), v.Passive()})
+}
+
+// sends messages (without holding v.mu, handlers of other nodes may call back), unreachable
+// active neighbours are replaced
+func (v *View) dispatch(out []envelope) {
+	for _, e := range out {
+		if err := v.send(e.to, e.m); err != nil {
+			v.Failed(e.to)
+		}
+	}
+}
+
+// adds node to the active view, dropping a random neighbour if full, notify asks node to add us
+// as well (v.mu must be held)
+func (v *View) addActive(node uint16, notify bool) []envelope {
+	out := make([]envelope, 0)
+	if node == v.self || contains(v.active, node) {
+		return out
+	}
+	if len(v.active) >= v.cfg.ActiveSize {
+		dropped, _ := v.pick(v.active)
+		v.active = remove(v.active, dropped)
+		v.addPassive(dropped)
+		out = append(out, envelope{dropped, Message{Kind: Disconnect}})
+	}
+	v.passive = remove(v.passive, node)
+	v.active = append(v.active, node)
+	if notify {
+		out = append(out, envelope{node, Message{Kind: Neighbor, Priority: true}})
+	}
+	return out
+}
+
+// adds node to the passive view, dropping a random node if full (v.mu must be held)
+func (v *View) addPassive(node uint16) {
+	if node == v.self || contains(v.active, node) || contains(v.passive, node) {
+		return
+	}
+	if len(v.passive) >= v.cfg.PassiveSize {
+		dropped, _ := v.pick(v.passive)
+		v.passive = remove(v.passive, dropped)
+	}
+	v.passive = append(v.passive, node)
+}
+
+// asks a random passive node (other than except and the ones already tried) to become a
+// neighbour (v.mu must be held)
+func (v *View) replace(except uint16) []envelope {
+	if n, ok := v.pick(v.passive, append(v.tried, except)...); ok {
+		v.tried = append(v.tried, n)
+		return []envelope{{n, Message{Kind: Neighbor, Priority: len(v.active) == 0}}}
+	}
+	return nil
+}
+
+// adds shuffled nodes to the passive view, dropping the ones sent first (v.mu must be held)
+func (v *View) integrate(nodes []uint16, sent []uint16) {
+	for _, n := range nodes {
+		if n == v.self || contains(v.active, n) || contains(v.passive, n) {
+			continue
+		}
+		if len(v.passive) >= v.cfg.PassiveSize && len(sent) > 0 {
+			v.passive = remove(v.passive, sent[0])
+			sent = sent[1:]
+		}
+		v.addPassive(n)
+	}
+}
+
+// aux
+
+// random node of nodes not in except
+func (v *View) pick(nodes []uint16, except ...uint16) (uint16, bool) {
+	candidates := make([]uint16, 0, len(nodes))
+	for _, n := range nodes {
+		if !contains(except, n) {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	return candidates[v.Rand.Intn(len(candidates))], true
+}
+
+// up to k random nodes
+func (v *View) sample(nodes []uint16, k int) []uint16 {
+	res := append([]uint16{}, nodes...)
+	v.Rand.Shuffle(len(res), func(i, j int) { res[i], res[j] = res[j], res[i] })
+	if len(res) > k {
+		res = res[:k]
+	}
+	return res
+}
+
+func contains(nodes []uint16, node uint16) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(nodes []uint16, node uint16) []uint16 {
+	res := make([]uint16, 0, len(nodes))
+	for _, n := range nodes {
+		if n != node {
+			res = append(res, n)
+		}
+	}
+	return res
+}
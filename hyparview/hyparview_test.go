@@ -0,0 +1,124 @@
+package hyparview
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"testing"
+)
+
+// in-memory network, messages are queued and delivered by run
+type network struct {
+	nodes map[uint16]*View
+	down  map[uint16]bool
+	queue []delivery
+}
+
+type delivery struct {
+	from uint16
+	to   uint16
+	m    Message
+}
+
+func newNetwork(n int, cfg Config) *network {
+	net := &network{nodes: make(map[uint16]*View), down: make(map[uint16]bool)}
+	for i := 0; i < n; i++ {
+		port := uint16(i + 1)
+		net.nodes[port] = New(port, cfg, func(to uint16, m Message) error {
+			if _, ok := net.nodes[to]; !ok || net.down[to] {
+				return fmt.Errorf("%d unreachable", to)
+			}
+			net.queue = append(net.queue, delivery{port, to, m})
+			return nil
+		})
+	}
+	return net
+}
+
+func (net *network) run(t *testing.T) {
+	for i := 0; len(net.queue) > 0; i++ {
+		if i > 1000000 {
+			t.Fatal("messages never settle")
+		}
+		d := net.queue[0]
+		net.queue = net.queue[1:]
+		if !net.down[d.to] {
+			net.nodes[d.to].Handle(d.from, d.m)
+		}
+	}
+}
+
+// nodes reachable from the first live node through active views
+func (net *network) connected() bool {
+	live := make([]uint16, 0)
+	for port := range net.nodes {
+		if !net.down[port] {
+			live = append(live, port)
+		}
+	}
+	seen := map[uint16]bool{live[0]: true}
+	stack := []uint16{live[0]}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, a := range net.nodes[n].Active() {
+			if !seen[a] && !net.down[a] {
+				seen[a] = true
+				stack = append(stack, a)
+			}
+		}
+	}
+	return len(seen) == len(live)
+}
+
+func TestHyParView(t *testing.T) {
+	mrand.Seed(1)
+	cfg := DefaultConfig
+	net := newNetwork(100, cfg)
+	for port := uint16(2); port <= 100; port++ {
+		net.nodes[port].Join(1)
+		net.run(t)
+	}
+	for i := 0; i < 5; i++ {
+		for _, v := range net.nodes {
+			v.Shuffle()
+		}
+		net.run(t)
+	}
+
+	for port, v := range net.nodes {
+		active := v.Active()
+		if len(active) == 0 || len(active) > cfg.ActiveSize || len(v.Passive()) > cfg.PassiveSize {
+			t.Fatalf("node %d: unexpected view sizes %s", port, v)
+		}
+		for _, a := range active {
+			if !contains(net.nodes[a].Active(), port) {
+				t.Fatalf("asymmetric active views: %d has %d", port, a)
+			}
+		}
+	}
+	if !net.connected() {
+		t.Fatal("overlay is not connected")
+	}
+
+	// churn: 30% of the nodes fail, the rest repair their views
+	for port := uint16(1); port <= 100; port += 3 {
+		net.down[port] = true
+	}
+	for i := 0; i < 5; i++ {
+		for port, v := range net.nodes {
+			if net.down[port] {
+				continue
+			}
+			for _, a := range v.Active() {
+				if net.down[a] {
+					v.Failed(a)
+				}
+			}
+			v.Shuffle()
+		}
+		net.run(t)
+	}
+	if !net.connected() {
+		t.Fatal("overlay is not connected after churn")
+	}
+}
@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Leveled key/value logger, writes either text or JSON lines:
+//
+//	2022-11-10T15:04:05.000Z INFO received word=hello from=4641 port=4640
+//	{"time":"2022-11-10T15:04:05.000Z","level":"info","msg":"received","word":"hello","from":4641,"port":4640}
+//
+// Loggers derived with With share their root output and level, so a module can
+// silence (or enable debug output for) every peer at once.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+	Off
+)
+
+var levels = []string{"debug", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+	if l < Debug || l > Off {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levels[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, v := range levels {
+		if strings.EqualFold(s, v) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// shared by a root logger and every logger derived from it
+type core struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level Level
+	json  bool
+}
+
+type Logger struct {
+	c      *core
+	fields []interface{}
+}
+
+// used by peers that were not given a logger
+var Default = New(os.Stdout, Info, false)
+
+func New(out io.Writer, level Level, json bool) *Logger {
+	return &Logger{c: &core{out: out, level: level, json: json}}
+}
+
+// With returns a logger that adds kv (key, value, key, value...) to every entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{c: l.c, fields: fields}
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	l.c.level = level
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	return level >= l.c.level && level < Off
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(Debug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(Info, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(Warn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(Error, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	// call fields first, context fields (port...) last
+	fields := make([]interface{}, 0, len(kv)+len(l.fields))
+	fields = append(fields, kv...)
+	fields = append(fields, l.fields...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "!MISSING")
+	}
+	ts := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+
+	var sb strings.Builder
+	if l.c.json {
+		sb.WriteString(`{"time":`)
+		sb.WriteString(strconv.Quote(ts))
+		sb.WriteString(`,"level":`)
+		sb.WriteString(strconv.Quote(level.String()))
+		sb.WriteString(`,"msg":`)
+		sb.WriteString(jsonValue(msg))
+		for i := 0; i < len(fields); i += 2 {
+			sb.WriteString(",")
+			sb.WriteString(strconv.Quote(fmt.Sprint(fields[i])))
+			sb.WriteString(":")
+			sb.WriteString(jsonValue(fields[i+1]))
+		}
+		sb.WriteString("}\n")
+	} else {
+		sb.WriteString(ts)
+		sb.WriteString(" ")
+		sb.WriteString(strings.ToUpper(level.String()))
+		sb.WriteString(" ")
+		sb.WriteString(msg)
+		for i := 0; i < len(fields); i += 2 {
+			sb.WriteString(" ")
+			sb.WriteString(fmt.Sprint(fields[i]))
+			sb.WriteString("=")
+			sb.WriteString(textValue(fields[i+1]))
+		}
+		sb.WriteString("\n")
+	}
+
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	io.WriteString(l.c.out, sb.String())
+}
+
+// aux
+
+func jsonValue(v interface{}) string {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return strconv.Quote(fmt.Sprint(v))
+	}
+	return string(b)
+}
+
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTextLogger(t *testing.T) {
+	var sb strings.Builder
+	l := New(&sb, Info, false).With("port", 4640)
+	l.Debug("hidden")
+	l.Info("received", "word", "hello world", "from", 4641)
+
+	out := sb.String()
+	if strings.Contains(out, "hidden") {
+		t.Fatalf("debug entry written at info level: %s", out)
+	}
+	if !strings.Contains(out, ` INFO received word="hello world" from=4641 port=4640`+"\n") {
+		t.Fatalf("unexpected entry: %s", out)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var sb strings.Builder
+	root := New(&sb, Debug, true)
+	l := root.With("port", 4640)
+	l.Debug("multicast", "body", "ping-ab12", "clock", 3)
+	root.SetLevel(Off)
+	l.Error("silenced")
+
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected a single entry, got %d: %s", len(lines), sb.String())
+	}
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "debug" || entry["msg"] != "multicast" || entry["body"] != "ping-ab12" || entry["port"] != float64(4640) || entry["clock"] != float64(3) {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+}
@@ -0,0 +1,264 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Counters, gauges and histograms exposed in the Prometheus text format (version 0.0.4).
+// Metrics are created as package variables (registered in Default) and updated with label values
+// in the same order as the label names given on creation, ex:
+//
+//	var sent = metrics.NewCounter("peergossip_sent_total", "Gossip messages sent", "peer")
+//	sent.Inc("4640")
+
+// default histogram buckets (seconds)
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var Default = NewRegistry()
+
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string // counter, gauge, histogram
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+// a single label set of a family
+type series struct {
+	values  []string
+	value   float64  // counter/gauge value, histogram sum
+	count   uint64   // histogram
+	buckets []uint64 // histogram, non cumulative
+}
+
+type Counter struct {
+	r *Registry
+	f *family
+}
+
+type Gauge struct {
+	r *Registry
+	f *family
+}
+
+type Histogram struct {
+	r *Registry
+	f *family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+func (r *Registry) register(name string, help string, kind string, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; ok {
+		log.Fatalf("metric %s registered twice\n", name)
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{r: r, f: r.register(name, help, "counter", nil, labels)}
+}
+
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{r: r, f: r.register(name, help, "gauge", nil, labels)}
+}
+
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	return &Histogram{r: r, f: r.register(name, help, "histogram", b, labels)}
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// returns the series for values, creating it if needed (r.mu must be held)
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		log.Fatalf("metric %s expects %d label values, got %d\n", f.name, len(f.labels), len(values))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string{}, values...)}
+		if f.kind == "histogram" {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// v must be >= 0
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.f.with(values).value += v
+}
+
+func (g *Gauge) Set(v float64, values ...string) {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	g.f.with(values).value = v
+}
+
+func (g *Gauge) Add(v float64, values ...string) {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	g.f.with(values).value += v
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+	s := h.f.with(values)
+	s.value += v
+	s.count += 1
+	for i, b := range h.f.buckets {
+		if v <= b {
+			s.buckets[i] += 1
+			break
+		}
+	}
+}
+
+// Writes every family in the text exposition format, sorted by name and label values
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sb strings.Builder
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&sb, "# HELP %s %s\n", f.name, escape(f.help, false))
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			if f.kind != "histogram" {
+				fmt.Fprintf(&sb, "%s%s %s\n", f.name, labels(f.labels, s.values, "", 0), format(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, b := range f.buckets {
+				cumulative += s.buckets[i]
+				fmt.Fprintf(&sb, "%s_bucket%s %d\n", f.name, labels(f.labels, s.values, "le", b), cumulative)
+			}
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", f.name, labels(f.labels, s.values, "le", math.Inf(1)), s.count)
+			fmt.Fprintf(&sb, "%s_sum%s %s\n", f.name, labels(f.labels, s.values, "", 0), format(s.value))
+			fmt.Fprintf(&sb, "%s_count%s %d\n", f.name, labels(f.labels, s.values, "", 0), s.count)
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := r.WriteTo(w); err != nil {
+		log.Println(err)
+	}
+}
+
+// Serves Default on addr (ex: ":9090") under /metrics
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+}
+
+// aux
+
+// {peer="4440",le="0.5"}, le is only added for histogram buckets
+func labels(names []string, values []string, le string, bound float64) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", n, escape(values[i], true)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", le, format(bound)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func format(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
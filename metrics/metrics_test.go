@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_sent_total", "Messages sent", "peer")
+	g := r.NewGauge("test_queue_length", "Queue length", "peer")
+	h := r.NewHistogram("test_latency_seconds", "Latency", []float64{1, 0.1}, "peer")
+
+	c.Inc("4440")
+	c.Add(2, "4440")
+	c.Inc("4441")
+	g.Set(3, "4440")
+	h.Observe(0.05, "4440")
+	h.Observe(0.5, "4440")
+	h.Observe(2, "4440")
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+	expected := []string{
+		"# TYPE test_sent_total counter",
+		`test_sent_total{peer="4440"} 3`,
+		`test_sent_total{peer="4441"} 1`,
+		`test_queue_length{peer="4440"} 3`,
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{peer="4440",le="0.1"} 1`,
+		`test_latency_seconds_bucket{peer="4440",le="1"} 2`,
+		`test_latency_seconds_bucket{peer="4440",le="+Inf"} 3`,
+		`test_latency_seconds_sum{peer="4440"} 2.55`,
+		`test_latency_seconds_count{peer="4440"} 3`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e+"\n") {
+			t.Errorf("missing %q in:\n%s", e, out)
+		}
+	}
+}
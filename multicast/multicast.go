@@ -10,29 +10,61 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"token-ring/auth"
 	"token-ring/common"
 	grpcapi "token-ring/grpcapi"
-
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"token-ring/logging"
+	"token-ring/metrics"
+	"token-ring/rpc"
 )
 
 const SAMPLES = 100
 
-var VERBOSE = false
-var STOP = false
+// events of BootEvents, 1 per second on average (set before BootEvents)
+var DefaultEvents = common.EventConfig{Dist: common.Poisson, Rate: 1}
+
+var queueLength = metrics.NewGauge("multicast_queue_length", "Messages waiting in the multicast queue", "peer")
+var acks = metrics.NewCounter("multicast_acks_total", "ACKs received", "peer")
+var deliveryLatency = metrics.NewHistogram("multicast_delivery_seconds", "Time from queueing a ping to its removal from the queue", metrics.DefBuckets, "peer")
+var acksPerMessage = metrics.NewHistogram("multicast_acks_per_message", "ACKs received for a ping until it leaves the queue", []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20}, "peer")
 
 type Peer struct {
+	// guards Registry, Queue, Clock and the ping bookkeeping: Ping runs concurrently (once per
+	// grpc call), RPCs are made without it (peers ping themselves)
+	mu       sync.Mutex
 	Port     uint16   `json:"port"`
 	Registry []uint16 `json:"registry"`
 	Queue    []string `json:"queue"`
 	Clock    uint16   `json:"clock"`
 	Addr     net.IP   `json:"addr"`
 	Gold     bool     `json:"gold"`
+	// ping (addr-clock) -> queue time, acks received
+	queued map[string]time.Time
+	acked  map[string]int
+	// structured logger, carries the peer port (replace to inject another).
+	// Acks and per peer sends are logged at debug level (verbose).
+	Log *logging.Logger `json:"-"`
+	// keypair, every message is sealed (signed) by its sender
+	id *auth.Node
+	// times events and delivery latencies (a virtual scheduler runs the peer in virtual time, see sim)
+	Sched *common.Scheduler `json:"-"`
+	// called with every ping delivered (removed from the queue), nil - none
+	OnDeliver func(body string) `json:"-"`
 	grpcapi.UnimplementedShellServer
 }
 
+// Status snapshot of a peer
+type Status struct {
+	Port     uint16   `json:"port"`
+	Registry []uint16 `json:"registry"`
+	Queue    []string `json:"queue"`
+	Clock    uint16   `json:"clock"`
+	Addr     net.IP   `json:"addr"`
+	Gold     bool     `json:"gold"`
+}
+
 func NewPeer(port uint16, gold bool) *Peer {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
@@ -46,53 +78,42 @@ func NewPeer(port uint16, gold bool) *Peer {
 		Registry: make([]uint16, 0),
 		Addr:     conn.LocalAddr().(*net.UDPAddr).IP,
 		Gold:     gold,
+		queued:   make(map[string]time.Time),
+		acked:    make(map[string]int),
+		Log:      logging.Default.With("module", "multicast", "port", port),
+		id:       auth.NewNode(port, auth.Default),
+		Sched:    common.DefaultScheduler(),
 	}
 	go Listen(p)
 	return p
 }
 
-// We are assuming 2 events per second, thus we multiply each event time by two
-// 2 evs per 2 secs <=> 1 ev per sec (goal)
-func (p *Peer) BootEvents() {
-	var ut float64
-	timestamps := make([]float64, 0)
-	i := 1
+// pings every peer on each of SAMPLES events of DefaultEvents, seeded by the port, until stop
+func (p *Peer) BootEvents() (stop func()) {
+	cfg := DefaultEvents
+	cfg.Count = SAMPLES
+	cfg.Seed += int64(p.Port)
+	return p.PingEvents(cfg)
+}
+
+// PingEvents pings every peer on each event of cfg, timed by Sched, until stop
+func (p *Peer) PingEvents(cfg common.EventConfig) (stop func()) {
 	md := md5.New()
-	// gen event timestamps
-	for i < SAMPLES {
-		ut += common.PoissonProcessTimeToNextEvent()
-		timestamps = append(timestamps, ut*2)
-		i += 1
-	}
-	// orchestrate events
-	i = 0
-	start := time.Now()
-	if VERBOSE {
-		fmt.Printf("\tEvents relative to [%d] @ %s: %f\n", p.Port, start, timestamps)
-	}
-	go func(p *Peer) {
-		for i < len(timestamps) {
-			v := timestamps[i]
-			if time.Since(start).Seconds() >= v {
-				io.WriteString(md, fmt.Sprintf("%f", v))
-				fresh := fmt.Sprintf("%x", md.Sum(nil))[0:4]
-				p.PingAll(fmt.Sprintf("ping-%s", fresh))
-				i += 1
-			} else {
-				evtime := start.Add(time.Duration(v))
-				time.Sleep(time.Since(evtime))
-			}
-		}
-	}(p)
+	p.Log.Debug("events", "dist", cfg.Dist, "rate", cfg.Rate, "samples", cfg.Count)
+	return p.Sched.Each(cfg, func(e common.Event) {
+		io.WriteString(md, fmt.Sprintf("%f", e.At.Seconds()))
+		fresh := fmt.Sprintf("%x", md.Sum(nil))[0:4]
+		p.Sched.Go(func() { p.PingAll(fmt.Sprintf("ping-%s", fresh)) })
+	})
 }
 
 // Serves grpc
 func Listen(p *Peer) {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", p.Port))
+	l, err := rpc.Listen(p.Port)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	grpcs := grpc.NewServer()
+	grpcs := rpc.NewServer(p.Port)
 	grpcapi.RegisterShellServer(grpcs, p)
 	if err := grpcs.Serve(l); err != nil {
 		log.Fatalln(err)
@@ -101,77 +122,113 @@ func Listen(p *Peer) {
 
 // ping peer: update clock and registry accordingly
 func (p *Peer) PingPeer(addr int, msg string) string {
+	return p.pingPeer(context.Background(), addr, msg)
+}
+
+// ctx carries the trace of the ping being acked (see PingAll)
+func (p *Peer) pingPeer(ctx context.Context, addr int, msg string) string {
+	p.mu.Lock()
 	p.Clock += 1
-	var conn *grpc.ClientConn
-	conn, err := grpc.Dial(fmt.Sprintf(":%d", addr), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	clock := p.Clock
+	p.mu.Unlock()
+	conn, err := rpc.Dial(addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer conn.Close()
 
 	g := grpcapi.NewShellClient(conn)
-	res, err := g.Ping(context.Background(), &grpcapi.Message{Body: fmt.Sprintf("%s:%d:%d", msg, p.Port, p.Clock)})
+	res, err := g.Ping(ctx, &grpcapi.Message{Body: p.id.Seal(uint16(addr), fmt.Sprintf("%s:%d:%d", msg, p.Port, clock))})
+	if auth.Rejected(err) {
+		p.Log.Warn("rejected", "peer", addr, "err", err)
+		return ""
+	}
 	if err != nil {
 		log.Fatalf("error calling grpc call: %s\n", err)
 	}
 
-	out := strings.Split(res.Body, ":")
-	appOut, _ := b64.StdEncoding.DecodeString(out[0])
-	addr, err = strconv.Atoi(out[1])
+	body, sender, err := auth.Default.Open(p.Port, res.Body)
 	if err != nil {
-		log.Fatalln(err)
+		p.Log.Warn("rejected reply", "peer", addr, "err", err)
+		return ""
 	}
-	clock, err := strconv.Atoi(out[2])
+	out, raddr, rclock, err := parse(body)
+	appOut, _ := b64.StdEncoding.DecodeString(out)
 	if err != nil {
-		log.Fatalln(err)
+		p.Log.Warn("rejected reply", "peer", addr, "sender", sender, "err", err)
+		return ""
 	}
-
-	if !common.Contains(p.Registry, uint16(addr)) {
-		p.Registry = append(p.Registry, uint16(addr))
-	}
-	if p.Clock <= uint16(clock) {
-		p.Clock = uint16(clock) + 1
+	if sender != uint16(raddr) {
+		p.Log.Warn("rejected reply", "peer", raddr, "sender", sender, "err", auth.ErrForged)
+		return ""
 	}
+	p.observe(raddr, rclock)
 
 	return string(appOut)
 }
 
-// grpc implementation of ping
+// grpc implementation of ping (bodies are sealed, the sending port must be the sender's, see auth)
 func (p *Peer) Ping(ctx context.Context, in *grpcapi.Message) (*grpcapi.Message, error) {
 	resOut := ""
-	msg := strings.Split(in.Body, ":")
-	addr, err := strconv.Atoi(msg[1])
+	body, sender, err := auth.Default.Open(p.Port, in.Body)
 	if err != nil {
-		log.Fatalln(err)
+		p.Log.Warn("rejected", "sender", sender, "err", err)
+		return nil, auth.Reject(err)
 	}
-	clock, err := strconv.Atoi(msg[2])
-	if err != nil {
-		log.Fatalln(err)
+	kind, addr, clock, err := parse(body)
+	ackout := strings.Split(kind, "-")
+	if err == nil && strings.Contains(kind, "ack") && len(ackout) != 3 {
+		err = auth.ErrMalformed
 	}
-
-	if !common.Contains(p.Registry, uint16(addr)) {
-		p.Registry = append(p.Registry, uint16(addr))
+	if err != nil {
+		p.Log.Warn("rejected", "sender", sender, "err", err)
+		return nil, auth.Reject(err)
 	}
-	if p.Clock <= uint16(clock) {
-		p.Clock = uint16(clock) + 1
+	if sender != uint16(addr) {
+		p.Log.Warn("rejected", "sender", sender, "claimed", addr, "err", auth.ErrForged)
+		return nil, auth.Reject(auth.ErrForged)
 	}
 
+	p.observe(addr, clock)
+
 	// add to queue
-	if strings.Contains(msg[0], "ping") {
-		p.Queue = p.OrderedInsert(in.Body, clock)
-		p.PingAll(fmt.Sprintf("ack-%d-%d", addr, clock))
-	} else if strings.Contains(msg[0], "ack") {
-		ackout := strings.Split(msg[0], "-")
+	label := strconv.Itoa(int(p.Port))
+	if strings.Contains(kind, "ping") {
+		p.mu.Lock()
+		p.Queue = p.OrderedInsert(body, clock)
+		p.queued[fmt.Sprintf("%d-%d", addr, clock)] = p.Sched.Now()
+		queueLength.Set(float64(len(p.Queue)), label)
+		p.mu.Unlock()
+		p.pingAll(ctx, fmt.Sprintf("ack-%d-%d", addr, clock))
+	} else if strings.Contains(kind, "ack") {
+		p.mu.Lock()
+		key := fmt.Sprintf("%s-%s", ackout[1], ackout[2])
+		acks.Inc(label)
+		p.acked[key] += 1
 		pingIdx := p.AckCheck(ackout[1], ackout[2])
+		delivered := ""
 		if pingIdx != -1 {
 			pingMsg := p.Queue[pingIdx]
+			delivered = pingMsg
 			p.Queue = common.RemoveByIndex(p.Queue, pingIdx)
+			queueLength.Set(float64(len(p.Queue)), label)
+			if t, ok := p.queued[key]; ok {
+				deliveryLatency.Observe(p.Sched.Now().Sub(t).Seconds(), label)
+				delete(p.queued, key)
+			}
+			acksPerMessage.Observe(float64(p.acked[key]), label)
+			delete(p.acked, key)
 			if p.Gold {
-				// fmt.Printf("\t[%d;%d] ACK: {%s} ; Queue: %s\n", p.Port, p.Clock, pingMsg, p.Queue)
+				p.Log.Info("deliver", "body", pingMsg, "queue", p.Queue, "clock", p.Clock)
 				restr := fmt.Sprintf("\t[%d;%d] ACK {%s} ; Queue %s\n", p.Port, p.Clock, pingMsg, p.Queue)
 				resOut = b64.StdEncoding.EncodeToString([]byte(restr))
 			}
 		}
+		onDeliver := p.OnDeliver
+		p.mu.Unlock()
+		if onDeliver != nil && delivered != "" {
+			onDeliver(delivered)
+		}
 		// else if VERBOSE {
 		// 	p.Queue = p.OrderedInsert(in.Body, clock)
 		// }
@@ -188,34 +245,78 @@ func (p *Peer) Ping(ctx context.Context, in *grpcapi.Message) (*grpcapi.Message,
 		*/
 	}
 
-	return &grpcapi.Message{Body: fmt.Sprintf("%s:%d:%d", resOut, p.Port, p.Clock)}, nil
+	p.mu.Lock()
+	clock = int(p.Clock)
+	p.mu.Unlock()
+	return &grpcapi.Message{Body: p.id.Seal(sender, fmt.Sprintf("%s:%d:%d", resOut, p.Port, clock))}, nil
 }
 
-// multicast
+// multicast, gold peers log their own deliveries (PingPeer output is not printed)
 func (p *Peer) PingAll(msg string) {
-	logstr := ""
-	if strings.Contains(msg, "ping") || VERBOSE {
-		logstr = fmt.Sprintf("\t[%d] Multicast {%s} \n", p.Port, msg)
-	}
+	p.pingAll(context.Background(), msg)
+}
 
+func (p *Peer) pingAll(ctx context.Context, msg string) {
+	st := p.Status()
 	if strings.Contains(msg, "ping") {
-		logstr += "\n\t------------------------------------\n\n"
+		p.Log.Info("multicast", "body", msg, "clock", st.Clock)
+	} else {
+		p.Log.Debug("multicast", "body", msg, "clock", st.Clock)
 	}
-	for _, addr := range p.Registry {
-		if VERBOSE {
-			logstr += fmt.Sprintf("\t\t[%d;%d] ----> %d\n", p.Port, p.Clock, addr)
-		}
-		appOut := p.PingPeer(int(addr), msg)
-		if appOut != "" {
-			logstr += appOut
-		}
+	for _, addr := range st.Registry {
+		p.Log.Debug("send", "to", addr)
+		p.pingPeer(ctx, int(addr), msg)
+	}
+}
+
+// Status snapshot, taken under the peer lock
+func (p *Peer) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Status{
+		Port:     p.Port,
+		Registry: append([]uint16{}, p.Registry...),
+		Queue:    append([]string{}, p.Queue...),
+		Clock:    p.Clock,
+		Addr:     p.Addr,
+		Gold:     p.Gold,
+	}
+}
+
+// SetRegistry replaces the peers multicast to
+func (p *Peer) SetRegistry(registry []uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Registry = registry
+}
+
+// registers addr and updates the clock on a message (or reply) stamped clock
+func (p *Peer) observe(addr int, clock int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !common.Contains(p.Registry, uint16(addr)) {
+		p.Registry = append(p.Registry, uint16(addr))
+	}
+	if p.Clock <= uint16(clock) {
+		p.Clock = uint16(clock) + 1
+	}
+}
+
+// "<msg>:<port>:<clock>" message (and reply) bodies
+func parse(body string) (string, int, int, error) {
+	split := strings.Split(body, ":")
+	if len(split) != 3 {
+		return "", 0, 0, auth.ErrMalformed
 	}
-	if !STOP {
-		fmt.Print(logstr)
+	addr, aerr := strconv.Atoi(split[1])
+	clock, cerr := strconv.Atoi(split[2])
+	if aerr != nil || cerr != nil {
+		return "", 0, 0, auth.ErrMalformed
 	}
+	return split[0], addr, clock, nil
 }
 
-// Searches for index to insert msg (based on clock)
+// Searches for index to insert msg (based on clock), callers hold the peer lock
 func (p *Peer) OrderedInsert(msg string, clock int) []string {
 	hit := false
 	for i, v := range p.Queue {
@@ -235,7 +336,7 @@ func (p *Peer) OrderedInsert(msg string, clock int) []string {
 	return p.Queue
 }
 
-// Searches for a "ping" msg that was issued by the ack addr and at the ack time (clock)
+// Searches for a "ping" msg that was issued by the ack addr and at the ack time (clock), callers hold the peer lock
 func (p *Peer) AckCheck(ackaddr string, ackclock string) int {
 	for i, v := range p.Queue {
 		split := strings.Split(v, ":")
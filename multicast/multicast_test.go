@@ -2,9 +2,21 @@ package multicast
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"sync"
 	"testing"
+	"time"
+	"token-ring/logging"
+	"token-ring/rpc"
 )
 
+// peers talk over the in-memory transport, the test ports don't collide with other packages
+func TestMain(m *testing.M) {
+	rpc.SetTransport(rpc.NewMemTransport())
+	os.Exit(m.Run())
+}
+
 func TestV2MULTI(t *testing.T) {
 	p1 := NewPeer(4441, false)
 	p2 := NewPeer(4442, false)
@@ -12,6 +24,7 @@ func TestV2MULTI(t *testing.T) {
 	p4 := NewPeer(4444, false)
 	p5 := NewPeer(4445, true)
 	p6 := NewPeer(4446, true)
+	time.Sleep(100 * time.Millisecond)
 
 	p1.PingPeer(int(p1.Port), "hello")
 	p1.PingPeer(int(p2.Port), "hello")
@@ -39,13 +52,18 @@ func TestV2MULTI(t *testing.T) {
 	p5.PingPeer(int(p6.Port), "hello")
 
 	p6.PingPeer(int(p6.Port), "hello")
-	for {
+	// every pair pinged once: a full mesh
+	for _, p := range []*Peer{p1, p2, p3, p4, p5, p6} {
+		if st := p.Status(); len(st.Registry) != 6 {
+			t.Fatalf("[%d] registry %v", p.Port, st.Registry)
+		}
 	}
 }
 
 func TestPartialMulticastWithGold(t *testing.T) {
-	p1 := NewPeer(4444, false)
-	p2 := NewPeer(4445, false)
+	p1 := NewPeer(4447, false)
+	p2 := NewPeer(4448, false)
+	time.Sleep(100 * time.Millisecond)
 
 	p1.PingPeer(int(p1.Port), "hello")
 	p1.PingPeer(int(p2.Port), "hello")
@@ -55,11 +73,48 @@ func TestPartialMulticastWithGold(t *testing.T) {
 
 	p1.PingAll("ping")
 	// fmt.Println("____________________________________________")
-	fmt.Printf("\nP1 QUEUE: %+v\n", p1.Queue)
+	fmt.Printf("\nP1 QUEUE: %+v\n", p1.Status().Queue)
 	p2.PingAll("ping")
-	for {
-		// time.Sleep(2 * time.Second)
-		// fmt.Printf("\n%+v\n", p1)
-		// fmt.Printf("\n%+v\n", p2)
+	for _, p := range []*Peer{p1, p2} {
+		if st := p.Status(); len(st.Queue) != 0 {
+			t.Fatalf("[%d] undelivered %v", p.Port, st.Queue)
+		}
+	}
+
+	// a rejected ping ends the call, not the process
+	if out := p1.PingPeer(int(p2.Port), "ack-malformed"); out != "" {
+		t.Fatalf("rejected ping answered %q", out)
+	}
+}
+
+// pings and acks land on every peer at once (run with -race)
+func TestConcurrentAcks(t *testing.T) {
+	peers := make([]*Peer, 4)
+	for i := range peers {
+		peers[i] = NewPeer(uint16(4450+i), false)
+		peers[i].Log = logging.New(io.Discard, logging.Off, false)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, p := range peers {
+		for _, q := range peers {
+			p.PingPeer(int(q.Port), "hello")
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(p *Peer, i int) {
+				defer wg.Done()
+				p.PingAll(fmt.Sprintf("ping-%d", i))
+			}(p, i)
+		}
+	}
+	wg.Wait()
+	for _, p := range peers {
+		if st := p.Status(); len(st.Queue) != 0 || len(st.Registry) != len(peers) {
+			t.Fatalf("[%d] queue %v, registry %v", p.Port, st.Queue, st.Registry)
+		}
 	}
 }
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"token-ring/multicast"
+	"token-ring/peer"
+	"token-ring/peergossip"
+
+	"github.com/fatih/color"
+)
+
+// time a batch multicast run is left going before it is stopped (0 - wait for an interrupt)
+var batchDuration time.Duration
+
+// failed shell steps (bad peer idx, rejected commands), a batch run with any exits 1
+var stepErrs []error
+
+// Summary of a module run, printed once a batch run exits
+type Summary struct {
+	Module string
+	Lines  []string
+	Err    error
+}
+
+// Batch run built from flags, translated into the same commands typed in the module shells
+type Batch struct {
+	Size     int
+	Duration time.Duration
+	Fw       int
+	Lock     []int
+	Unlock   []int
+	Inject   []Injection
+}
+
+// Gossip injection: word sent by peer Idx
+type Injection struct {
+	Idx  int
+	Word string
+}
+
+// Script generates the shell commands for the selected modules (peer, peer-gossip, multicast).
+// "sleep <duration>" lines are not shell commands, they pause the script (see scriptReader).
+func (b Batch) Script(modules []bool) string {
+	var sb strings.Builder
+	if modules[0] {
+		fmt.Fprintf(&sb, "%d\n", b.Size)
+		for _, i := range b.Lock {
+			fmt.Fprintf(&sb, "shell\n%d\nlock\nexit\n", i)
+		}
+		if b.Fw >= 0 {
+			fmt.Fprintf(&sb, "shell\n%d\nfw\n", b.Fw)
+		}
+		fmt.Fprintf(&sb, "sleep %s\n", b.Duration)
+		for _, i := range b.Unlock {
+			fmt.Fprintf(&sb, "shell\n%d\nunlock\nexit\n", i)
+		}
+		sb.WriteString("exit\n")
+	}
+	if modules[1] {
+		sb.WriteString("start\n")
+		for _, in := range b.Inject {
+			fmt.Fprintf(&sb, "gossip\n%d\n%s\n", in.Idx, in.Word)
+		}
+		fmt.Fprintf(&sb, "sleep %s\n", b.Duration)
+		sb.WriteString("exit\n")
+	}
+	if modules[2] {
+		sb.WriteString("start\nn\nexit\n")
+	}
+	return sb.String()
+}
+
+// RunBatch drives the selected modules with script and returns the process exit status:
+// 0 if every module shell reached its exit command and no step failed, 1 otherwise.
+func RunBatch(script io.Reader, modules []bool) int {
+	input := bufio.NewScanner(&scriptReader{lines: bufio.NewScanner(script)})
+	summaries := make([]Summary, 0)
+	if modules[0] {
+		summaries = append(summaries, PoolPeer(input))
+	}
+	if modules[1] {
+		summaries = append(summaries, PoolPeerGossip(input))
+	}
+	if modules[2] {
+		summaries = append(summaries, PoolPeerMulticast(input))
+	}
+	if len(stepErrs) > 0 {
+		s := Summary{Module: "script", Err: fmt.Errorf("%d failed steps", len(stepErrs))}
+		for _, err := range stepErrs {
+			s.Lines = append(s.Lines, err.Error())
+		}
+		summaries = append(summaries, s)
+	}
+
+	return printSummaries(summaries)
+}
+
+// prints summaries, returns 1 if any of them has an error, 0 otherwise
+func printSummaries(summaries []Summary) int {
+	status := 0
+	fmt.Printf("\n------------------------------------\n\n")
+	for _, s := range summaries {
+		fmt.Printf("%v %s\n", color.CyanString("Summary:"), s.Module)
+		for _, l := range s.Lines {
+			fmt.Printf("\t%s\n", l)
+		}
+		if s.Err != nil {
+			fmt.Printf("\t%v %s\n", color.RedString("Error:"), s.Err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// Feeds a script to the module shells one line per Read, so "sleep" lines
+// only pause once the shell asks for its next command. Lines starting with # are skipped.
+type scriptReader struct {
+	lines *bufio.Scanner
+	buf   []byte
+}
+
+func (r *scriptReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if !r.lines.Scan() {
+			if err := r.lines.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		line := strings.TrimSpace(r.lines.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "sleep ") {
+			d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(line, "sleep ")))
+			if err != nil {
+				return 0, err
+			}
+			time.Sleep(d)
+			continue
+		}
+		r.buf = []byte(line + "\n")
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// "1,2,3" -> [1 2 3]
+func parseIdxs(s string) ([]int, error) {
+	idxs := make([]int, 0)
+	if s == "" {
+		return idxs, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		idxs = append(idxs, i)
+	}
+	return idxs, nil
+}
+
+// "0:hello,3:world" -> [{0 hello} {3 world}]
+func parseInjections(s string) ([]Injection, error) {
+	injections := make([]Injection, 0)
+	if s == "" {
+		return injections, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		split := strings.SplitN(v, ":", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("expected idx:word, got %q", v)
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(split[0]))
+		if err != nil {
+			return nil, err
+		}
+		injections = append(injections, Injection{Idx: i, Word: split[1]})
+	}
+	return injections, nil
+}
+
+// prints a failed shell step and records it (see stepErrs)
+func stepFailed(err error) {
+	fmt.Printf("%v %s\n", color.RedString("Error:"), err)
+	stepErrs = append(stepErrs, err)
+}
+
+func noPeer(idx int, pool Pool) error {
+	return fmt.Errorf("no peer %d (peers: 0...%d)", idx, len(pool)-1)
+}
+
+// peer index typed at a shell prompt, a malformed or unknown one is a failed step
+func peerIdx(text string, pool Pool) (int, bool) {
+	idx, err := strconv.Atoi(text)
+	if err != nil {
+		stepFailed(fmt.Errorf("malformed peer idx %q", text))
+		return idx, false
+	}
+	if idx < 0 || idx >= len(pool) {
+		stepFailed(noPeer(idx, pool))
+		return idx, false
+	}
+	return idx, true
+}
+
+// shell input ended before the module exit command
+func incomplete(s Summary) Summary {
+	s.Err = io.ErrUnexpectedEOF
+	return s
+}
+
+func peerSummary(pool Pool) Summary {
+	s := Summary{Module: "peer"}
+	token := 0
+	for i, p := range pool {
+		st := p.(*peer.Peer).Status()
+		s.Lines = append(s.Lines, fmt.Sprintf("[%d] port=%d next=%d token=%d ttl=%d lock=%d", i, st.Port, st.Next, st.Token, st.TTL, st.Lock))
+		if st.Token > token {
+			token = st.Token
+		}
+	}
+	s.Lines = append(s.Lines, fmt.Sprintf("highest token: %d", token))
+	return s
+}
+
+func gossipSummary(pool Pool) Summary {
+	s := Summary{Module: "peer-gossip"}
+	known := make(map[string]int)
+	for i, p := range pool {
+		pr := p.(*peergossip.Peer)
+		st := pr.Status()
+		for id := range st.Words {
+			known[id] += 1
+		}
+		line := fmt.Sprintf("[%d] port=%d registry=%v words=%d", i, st.Port, st.Registry, len(st.Words))
+		if crdts := pr.CRDTs(); len(crdts) > 0 {
+			line += fmt.Sprintf(" crdts=%v", crdts)
+		}
+		if ts := pr.Tombstones(); len(ts) > 0 {
+			line += fmt.Sprintf(" tombstones=%d", len(ts))
+		}
+		if topics := pr.Topics(); len(topics) > 0 {
+			line += fmt.Sprintf(" topics=%v", topics)
+		}
+		s.Lines = append(s.Lines, line)
+	}
+	full := 0
+	for _, n := range known {
+		if n == len(pool) {
+			full += 1
+		}
+	}
+	s.Lines = append(s.Lines, fmt.Sprintf("distinct words: %d, known by every peer: %d", len(known), full))
+	if gossipConvergence != nil {
+		for _, r := range gossipConvergence.Report(poolPorts(pool)) {
+			s.Lines = append(s.Lines, r.String())
+		}
+	}
+	return s
+}
+
+// gossip pool ports
+func poolPorts(pool Pool) []uint16 {
+	ports := make([]uint16, 0, len(pool))
+	for _, p := range pool {
+		ports = append(ports, p.(*peergossip.Peer).Port)
+	}
+	return ports
+}
+
+// writes reports to file, JSON if it ends in .json, CSV otherwise
+func writeGossipReport(file string, reports []peergossip.RumorReport) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.HasSuffix(file, ".json") {
+		return peergossip.WriteJSON(f, reports)
+	}
+	return peergossip.WriteCSV(f, reports)
+}
+
+func multicastStats(pool Pool) []string {
+	stats := make([]string, 0)
+	for i, p := range pool {
+		st := p.(*multicast.Peer).Status()
+		stats = append(stats, fmt.Sprintf("[%d] port=%d clock=%d queue=%d gold=%t", i, st.Port, st.Clock, len(st.Queue), st.Gold))
+	}
+	return stats
+}
+
+func multicastSummary(stats []string) Summary {
+	return Summary{Module: "multicast", Lines: stats}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"token-ring/rpc"
+)
+
+// pools run over the in-memory transport
+func TestMain(m *testing.M) {
+	rpc.SetTransport(rpc.NewMemTransport())
+	os.Exit(m.Run())
+}
+
+func TestParseIdxs(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want []int
+		err  bool
+	}{
+		{"", []int{}, false},
+		{"3", []int{3}, false},
+		{"1,2,3", []int{1, 2, 3}, false},
+		{" 1, 2 ", []int{1, 2}, false},
+		{"1,,2", nil, true},
+		{"1,a", nil, true},
+		{"1;2", nil, true},
+	} {
+		got, err := parseIdxs(c.s)
+		if (err != nil) != c.err || fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("parseIdxs(%q) = %v, %v", c.s, got, err)
+		}
+	}
+}
+
+func TestGossipPorts(t *testing.T) {
+	if base, err := gossipPorts(464, 6); err != nil || base != 4640 {
+		t.Fatalf("%d %v", base, err)
+	}
+	// 100 peers used to wrap around uint16 (peer 100 on port "464100")
+	if base, err := gossipPorts(464, 100); err != nil || base+99 != 4739 {
+		t.Fatalf("%d %v", base, err)
+	}
+	if _, err := gossipPorts(464, 101); err == nil {
+		t.Fatal("expected 101 peers to reach the multicast ports")
+	}
+}
+
+func TestParseInjections(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want []Injection
+		err  bool
+	}{
+		{"", []Injection{}, false},
+		{"0:hello", []Injection{{0, "hello"}}, false},
+		{"0:hello,3:world", []Injection{{0, "hello"}, {3, "world"}}, false},
+		{" 2:a:b", []Injection{{2, "a:b"}}, false}, // words may hold colons
+		{"1:", []Injection{{1, ""}}, false},
+		{"hello", nil, true},
+		{"x:hello", nil, true},
+		{"0:hello,world", nil, true},
+	} {
+		got, err := parseInjections(c.s)
+		if (err != nil) != c.err || fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("parseInjections(%q) = %v, %v", c.s, got, err)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	b := Batch{Size: 5, Duration: 2 * time.Second, Fw: 1, Lock: []int{2}, Unlock: []int{2}, Inject: []Injection{{0, "hi"}}}
+	for _, c := range []struct {
+		modules []bool
+		want    string
+	}{
+		{[]bool{true, false, false}, "5\nshell\n2\nlock\nexit\nshell\n1\nfw\nsleep 2s\nshell\n2\nunlock\nexit\nexit\n"},
+		{[]bool{false, true, false}, "start\ngossip\n0\nhi\nsleep 2s\nexit\n"},
+		{[]bool{false, false, true}, "start\nn\nexit\n"},
+	} {
+		if got := b.Script(c.modules); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.modules, got, c.want)
+		}
+	}
+	b.Fw = -1
+	if got := b.Script([]bool{true, false, false}); strings.Contains(got, "fw") || !strings.Contains(got, "sleep 2s") {
+		t.Errorf("no forward: %q", got)
+	}
+}
+
+func TestScriptReader(t *testing.T) {
+	script := "# comment\n  start \nsleep 10ms\n\ngossip\n"
+	input := bufio.NewScanner(&scriptReader{lines: bufio.NewScanner(strings.NewReader(script))})
+	got := make([]string, 0)
+	start := time.Now()
+	for input.Scan() {
+		got = append(got, input.Text())
+	}
+	if fmt.Sprintf("%q", got) != `["start" "" "gossip"]` || time.Since(start) < 10*time.Millisecond {
+		t.Fatalf("%q in %s", got, time.Since(start))
+	}
+	bad := bufio.NewScanner(&scriptReader{lines: bufio.NewScanner(strings.NewReader("sleep x\n"))})
+	if bad.Scan() || bad.Err() == nil {
+		t.Fatal("bad sleep accepted")
+	}
+}
+
+func TestMalformedIdx(t *testing.T) {
+	stepErrs = nil
+	defer func() { stepErrs = nil }()
+	// malformed pool size and idxs are failed steps, the run goes on to its summary
+	script := "four\nshell\nx\nshell\n9\nshell\n1\nstatus\nexit\nexit\n"
+	if status := RunBatch(strings.NewReader(script), []bool{true, false, false}); status != 1 {
+		t.Fatalf("status %d", status)
+	}
+	if fmt.Sprint(stepErrs) != `[malformed pool size "four" malformed peer idx "x" no peer 9 (peers: 0...3)]` {
+		t.Fatalf("%v", stepErrs)
+	}
+}
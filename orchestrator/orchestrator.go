@@ -4,16 +4,29 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
+	"token-ring/admin"
+	"token-ring/auth"
+	"token-ring/common"
+	"token-ring/hyparview"
+	"token-ring/logging"
+	"token-ring/metrics"
 	"token-ring/multicast"
+	"token-ring/overlay"
 	"token-ring/peer"
 	"token-ring/peergossip"
+	"token-ring/rpc"
+	"token-ring/sim"
+	"token-ring/topology"
 
 	"github.com/fatih/color"
 )
@@ -24,6 +37,62 @@ var peerPrefix = 444
 var peerGossipPrefix = 464
 var peerMulticastPrefix = 474
 
+// admin API (-admin), exposes every pool created by initPeerPool
+var adminSrv *admin.Server
+var poolModules = []string{"peer", "peergossip", "multicast"}
+
+// -log-level, -log-json
+var logLevel = logging.Info
+var logJSON = false
+
+// -gossip-size, -gossip-topology, -multicast-topology, -topology-seed: overlays wired with one
+// Register (gossip) or ping (multicast) per edge, gossip defaults to the assignment tree
+var gossipPoolSize = 6
+var gossipTopology = assignmentTopology()
+var multicastTopology = topology.Full(6)
+
+// -gossip-fanout, -gossip-max-hops, -gossip-stop, -gossip-feedback, -gossip-max-rounds
+var gossipStrategy = peergossip.DefaultStrategy
+
+// -gossip-broadcast
+var gossipBroadcast = peergossip.Flood
+
+// -gossip-swim: peers join through the first one and find each other with SWIM (no hardcoded topology)
+var gossipSWIM = false
+
+// -gossip-hyparview: gossip targets are HyParView active views, peers join through the first one
+var gossipHyParView = false
+
+// -gossip-sync, -gossip-sync-interval: anti-entropy rounds started with the gossip pool ("" - off)
+var gossipSync = ""
+var gossipSyncInterval = 5 * time.Second
+var gossipSyncDigest = peergossip.FlatDigest
+
+// -gossip-source: words gossiped by the Poisson process (see peergossip.ParseSource), parsed again
+// for every pool so traces replay from the start
+var gossipSource = "en"
+
+// -gossip-tombstone-retention, -gossip-tombstone-interval: deleted rumor tombstones, collected once
+// every pool peer has seen them
+var gossipTombstones = peergossip.DefaultTombstones
+
+// convergence of the current gossip pool, -gossip-report: exported on exit (.json, else CSV)
+var gossipConvergence *peergossip.Convergence
+var gossipReport = ""
+
+// multicast pool logger: own level so verbose/stop only affect multicast peers
+var multicastLog *logging.Logger
+
+// first port of a gossip pool of size with prefix: ports prefix*10...prefix*10+size-1, below the
+// multicast ones
+func gossipPorts(prefix int, size int) (int, error) {
+	base, limit := prefix*10, peerMulticastPrefix*10
+	if base+size > limit {
+		return 0, fmt.Errorf("%d gossip peers don't fit ports %d...%d", size, base, limit-1)
+	}
+	return base, nil
+}
+
 func initPeerPool(poolType int, size int) Pool {
 	pool := Pool{}
 	if poolType == 0 { // Peer Module
@@ -47,22 +116,40 @@ func initPeerPool(poolType int, size int) Pool {
 			}
 			pool = append(pool, peer.NewPeer(uint16(addr), uint16(next), 0))
 		}
+		ring := make([]*peer.Peer, 0, len(pool))
+		for _, p := range pool {
+			ring = append(ring, p.(*peer.Peer))
+		}
+		peer.Ring(ring...)
 	} else if poolType == 1 { // Peergossip module: assumed network topology
+		gossipConvergence = peergossip.NewConvergence()
+		source, err := peergossip.ParseSource(gossipSource)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		base, err := gossipPorts(peerGossipPrefix, size)
+		if err != nil {
+			log.Fatalln(err)
+		}
 		for i := 0; i < size; i++ {
-			addr, err := strconv.Atoi(fmt.Sprintf("%d%d", peerGossipPrefix, i))
-			if err != nil {
-				log.Fatalln(err)
-			}
-			pool = append(pool, peergossip.NewPeer(uint16(addr)))
+			pool = append(pool, peergossip.NewPeerWith(uint16(base+i), peergossip.Options{
+				Strategy:    gossipStrategy,
+				Broadcast:   gossipBroadcast,
+				Convergence: gossipConvergence,
+				Source:      source,
+			}))
 		}
 	} else if poolType == 2 { // Multicast module: assumed network topology
+		multicastLog = logging.New(os.Stdout, logLevel, logJSON).With("module", "multicast")
 		i := 0
 		for ; i < size; i++ {
 			addr, err := strconv.Atoi(fmt.Sprintf("%d%d", peerMulticastPrefix, i))
 			if err != nil {
 				log.Fatalln(err)
 			}
-			pool = append(pool, multicast.NewPeer(uint16(addr), false))
+			p := multicast.NewPeer(uint16(addr), false)
+			p.Log = multicastLog.With("port", p.Port)
+			pool = append(pool, p)
 		}
 		j := i
 		for ; j < (i + size/2); j++ {
@@ -70,9 +157,14 @@ func initPeerPool(poolType int, size int) Pool {
 			if err != nil {
 				log.Fatalln(err)
 			}
-			pool = append(pool, multicast.NewPeer(uint16(addr), true))
+			p := multicast.NewPeer(uint16(addr), true)
+			p.Log = multicastLog.With("port", p.Port)
+			pool = append(pool, p)
 		}
 	}
+	if adminSrv != nil {
+		adminSrv.SetPool(poolModules[poolType], pool)
+	}
 	return pool
 }
 
@@ -80,34 +172,244 @@ func main() {
 	peerFlg := flag.Bool("peer", false, "run peer module")
 	gossipFlg := flag.Bool("peer-gossip", false, "run peer-gossip module")
 	multicastFlg := flag.Bool("multicast", false, "run multicast module")
+	batchFlg := flag.Bool("batch", false, "run headless: drive the module shells from flags (or -script) and exit with a summary")
+	scriptFlg := flag.String("script", "", "command script fed to the module shells (implies -batch)")
+	sizeFlg := flag.Int("size", 4, "batch: token ring pool size")
+	durationFlg := flag.Duration("duration", 30*time.Second, "batch: time each run is left going (token ring: after forwarding, before unlocking)")
+	fwFlg := flag.Int("fw", 0, "batch: token ring peer idx that forwards the token (-1 to skip)")
+	lockFlg := flag.String("lock", "", "batch: comma separated token ring peer idxs to lock before forwarding")
+	unlockFlg := flag.String("unlock", "", "batch: comma separated token ring peer idxs to unlock after forwarding")
+	injectFlg := flag.String("inject", "", "batch: comma separated idx:word gossip injections (after start)")
+	adminFlg := flag.String("admin", "", "serve the HTTP/JSON admin API on addr (ex: :8080, loopback only unless a host is given, unauthenticated)")
+	metricsFlg := flag.String("metrics", "", "serve Prometheus metrics on addr/metrics (ex: :9090)")
+	logLevelFlg := flag.String("log-level", "info", "peer log level: debug, info, warn, error, off")
+	logJSONFlg := flag.Bool("log-json", false, "peer logs as JSON lines")
+	traceFlg := flag.String("trace", "", "write RPC spans (JSON lines) to file")
+	tlsCAFlg := flag.String("tls-ca", "", "mutual TLS: CA certificate (see certgen)")
+	tlsCertFlg := flag.String("tls-cert", "", "mutual TLS: node certificate")
+	tlsKeyFlg := flag.String("tls-key", "", "mutual TLS: node key")
+	transportFlg := flag.String("transport", "tcp", "peer connections: tcp (local ports) or mem (in-process, no ports bound)")
+	keysFlg := flag.String("keys", "", "directory with peer signing keys, shared by orchestrators on the same host")
+	gossipFanoutFlg := flag.Int("gossip-fanout", 0, "gossip: neighbours a rumor is forwarded to, a random subset (0 - all)")
+	gossipMaxHopsFlg := flag.Int("gossip-max-hops", 0, "gossip: hops a rumor travels (0 - unlimited)")
+	gossipStopFlg := flag.String("gossip-stop", "coin:5", "gossip: stop rule on duplicates, coin:K (probability 1/K) or counter:K (after K)")
+	gossipFeedbackFlg := flag.Bool("gossip-feedback", false, "gossip: senders stop on replies from peers that knew the rumor (default blind, receivers stop)")
+	gossipMaxRoundsFlg := flag.Int("gossip-max-rounds", 0, "gossip feedback: forwarding rounds a sender makes at most (0 - unlimited)")
+	gossipBroadcastFlg := flag.String("gossip-broadcast", "flood", "gossip: flood (every neighbour) or plumtree (spanning tree, lazy IHAVE on the other links)")
+	gossipSWIMFlg := flag.Bool("gossip-swim", false, "gossip: SWIM membership, peers join through peer 0 instead of the assignment topology")
+	gossipHyParViewFlg := flag.Bool("gossip-hyparview", false, "gossip: HyParView peer sampling, peers join through peer 0 and gossip to their active view")
+	gossipSyncFlg := flag.String("gossip-sync", "", "gossip anti-entropy mode: push, pull, push-pull (off by default)")
+	gossipSyncIntervalFlg := flag.Duration("gossip-sync-interval", 5*time.Second, "gossip anti-entropy round interval")
+	gossipSyncDigestFlg := flag.String("gossip-sync-digest", "flat", "gossip anti-entropy reconciliation: flat (every hash) or merkle (differences only)")
+	gossipReportFlg := flag.String("gossip-report", "", "gossip: write the convergence report (receive delays, duplicates, coverage per rumor) to file on exit, .json or CSV")
+	gossipSizeFlg := flag.Int("gossip-size", 6, "gossip: pool size, up to 100 (the assignment topology needs 6)")
+	gossipTopologyFlg := flag.String("gossip-topology", "assignment", "gossip: overlay, assignment or "+strings.Join(topology.Kinds, ", ")+" (see /topology for parameters)")
+	multicastTopologyFlg := flag.String("multicast-topology", "full", "multicast: overlay of the 6 peers, "+strings.Join(topology.Kinds, ", ")+" (total order needs full)")
+	gossipSourceFlg := flag.String("gossip-source", "en", "gossip: Poisson process words, en, da, file:<path>, random[:n] or trace:<path> (replayed in order)")
+	gossipTombstoneRetentionFlg := flag.Duration("gossip-tombstone-retention", peergossip.DefaultTombstones.Retention, "gossip: minimum time a deleted rumor tombstone is kept")
+	gossipTombstoneIntervalFlg := flag.Duration("gossip-tombstone-interval", peergossip.DefaultTombstones.Interval, "gossip: tombstone sync (and collection) round interval")
+	gossipEventsFlg := flag.String("gossip-events", "poisson:1/30s", "gossip: word events, "+strings.Join(common.Distributions, ", ")+" with :rate (per second or per unit, ex: 2/min), bursty:rate:factor")
+	multicastEventsFlg := flag.String("multicast-events", "poisson:1", "multicast: ping events, same format as -gossip-events")
+	eventSeedFlg := flag.Int64("event-seed", 0, "seed of the event generators (added to each peer port)")
+	eventDurationFlg := flag.Duration("event-duration", 0, "no events past this time from a peer start (0 - unlimited)")
+	simFlg := flag.String("sim", "", "simulate tokenring, gossip, multicast (comma separated) or all in virtual time and exit (uses -size, -fw, -lock and the gossip/multicast flags)")
+	simSeedFlg := flag.Int64("sim-seed", 1, "sim: seed of every random choice, the same seed gives the same run")
+	simLatencyFlg := flag.String("sim-latency", "const:1ms", "sim: message delays, const:<d>, uniform:<min>:<max>, exp:<min>:<mean> or normal:<mean>:<stddev>")
+	simLossFlg := flag.Float64("sim-loss", 0, "sim: probability a gossip call is lost")
+	simUntilFlg := flag.Duration("sim-until", 0, "sim: virtual time simulated (0 - until every event ran)")
+	simMaxStepsFlg := flag.Int("sim-max-steps", 10000000, "sim: scheduler events simulated at most (0 - unlimited)")
+	simMulticastSizeFlg := flag.Int("sim-multicast-size", 6, "sim: multicast peers")
+	topologySeedFlg := flag.Int64("topology-seed", 1, "seed of the random topologies (er, ws, ba)")
 	flag.Parse()
 
+	level, err := logging.ParseLevel(*logLevelFlg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -log-level: %s\n", err)
+		os.Exit(2)
+	}
+	logLevel, logJSON = level, *logJSONFlg
+	logging.Default = logging.New(os.Stdout, logLevel, logJSON)
+
+	if *adminFlg != "" {
+		adminSrv = admin.Serve(*adminFlg)
+	}
+	if *metricsFlg != "" {
+		metrics.Serve(*metricsFlg)
+	}
+	auth.KeyDir = *keysFlg
+	switch *transportFlg {
+	case "tcp":
+	case "mem":
+		rpc.SetTransport(rpc.NewMemTransport())
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -transport: %q (tcp, mem)\n", *transportFlg)
+		os.Exit(2)
+	}
+	if *gossipSyncFlg != "" {
+		if _, err := peergossip.ParseSyncMode(*gossipSyncFlg); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -gossip-sync: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if gossipSyncDigest, err = peergossip.ParseReconciliation(*gossipSyncDigestFlg); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -gossip-sync-digest: %s\n", err)
+		os.Exit(2)
+	}
+	gossipSync, gossipSyncInterval = *gossipSyncFlg, *gossipSyncIntervalFlg
+	gossipSWIM = *gossipSWIMFlg
+	if gossipBroadcast, err = peergossip.ParseBroadcastMode(*gossipBroadcastFlg); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -gossip-broadcast: %s\n", err)
+		os.Exit(2)
+	}
+	gossipHyParView = *gossipHyParViewFlg
+	gossipReport = *gossipReportFlg
+	if _, err := peergossip.ParseSource(*gossipSourceFlg); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -gossip-source: %s\n", err)
+		os.Exit(2)
+	}
+	gossipSource = *gossipSourceFlg
+	if peergossip.DefaultEvents, err = common.ParseEvents(*gossipEventsFlg, peergossip.DefaultEvents); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -gossip-events: %s\n", err)
+		os.Exit(2)
+	}
+	if multicast.DefaultEvents, err = common.ParseEvents(*multicastEventsFlg, multicast.DefaultEvents); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -multicast-events: %s\n", err)
+		os.Exit(2)
+	}
+	peergossip.DefaultEvents.Seed, multicast.DefaultEvents.Seed = *eventSeedFlg, *eventSeedFlg
+	peergossip.DefaultEvents.Duration, multicast.DefaultEvents.Duration = *eventDurationFlg, *eventDurationFlg
+	gossipTombstones.Retention, gossipTombstones.Interval = *gossipTombstoneRetentionFlg, *gossipTombstoneIntervalFlg
+	gossipPoolSize = *gossipSizeFlg
+	if *gossipTopologyFlg != "assignment" {
+		if gossipTopology, err = topology.Parse(*gossipTopologyFlg, gossipPoolSize, *topologySeedFlg); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -gossip-topology: %s\n", err)
+			os.Exit(2)
+		}
+	} else if gossipPoolSize != gossipTopology.N {
+		fmt.Fprintf(os.Stderr, "invalid -gossip-size: the assignment topology has %d peers\n", gossipTopology.N)
+		os.Exit(2)
+	}
+	// simulated peers take ports from 1
+	if _, err := gossipPorts(peerGossipPrefix, gossipPoolSize); err != nil && *simFlg == "" {
+		fmt.Fprintf(os.Stderr, "invalid -gossip-size: %s\n", err)
+		os.Exit(2)
+	}
+	if multicastTopology, err = topology.Parse(*multicastTopologyFlg, multicastTopology.N, *topologySeedFlg); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -multicast-topology: %s\n", err)
+		os.Exit(2)
+	}
+	stop, err := peergossip.ParseStop(*gossipStopFlg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -gossip-stop: %s\n", err)
+		os.Exit(2)
+	}
+	gossipStrategy = peergossip.Strategy{Fanout: *gossipFanoutFlg, MaxHops: *gossipMaxHopsFlg, Stop: stop, Feedback: *gossipFeedbackFlg, MaxRounds: *gossipMaxRoundsFlg}
+	if *tlsCAFlg != "" || *tlsCertFlg != "" || *tlsKeyFlg != "" {
+		if err := rpc.LoadTLS(*tlsCAFlg, *tlsCertFlg, *tlsKeyFlg); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *traceFlg != "" {
+		e, err := rpc.NewFileExporter(*traceFlg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer e.Close()
+		rpc.SetExporter(e)
+	}
+
+	if *simFlg != "" {
+		c := Simulation{Seed: *simSeedFlg, Loss: *simLossFlg, Until: *simUntilFlg, MaxSteps: *simMaxStepsFlg, Size: *sizeFlg, Fw: *fwFlg, MulticastSize: *simMulticastSizeFlg}
+		if c.Modules, err = parseSimModules(*simFlg); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -sim: %s\n", err)
+			os.Exit(2)
+		}
+		if c.Latency, err = sim.ParseLatency(*simLatencyFlg); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -sim-latency: %s\n", err)
+			os.Exit(2)
+		}
+		if c.Lock, err = parseIdxs(*lockFlg); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -lock: %s\n", err)
+			os.Exit(2)
+		}
+		for _, i := range c.Lock {
+			if i >= c.Size {
+				fmt.Fprintf(os.Stderr, "invalid -lock: no peer %d in a ring of %d\n", i, c.Size)
+				os.Exit(2)
+			}
+		}
+		if c.Size < 2 || c.Fw < 0 || c.Fw >= c.Size || c.MulticastSize < 1 || c.Loss < 0 || c.Loss > 1 {
+			fmt.Fprintf(os.Stderr, "invalid -sim run: -size %d, -fw %d, -sim-multicast-size %d, -sim-loss %g\n", c.Size, c.Fw, c.MulticastSize, c.Loss)
+			os.Exit(2)
+		}
+		os.Exit(printSummaries(c.Run()))
+	}
+
+	modules := []bool{*peerFlg, *gossipFlg, *multicastFlg}
 	if !*peerFlg && !*gossipFlg && !*multicastFlg {
-		PoolPeer()
-		Clear()
-		PoolPeerGossip()
-		Clear()
-		PoolPeerMulticast()
-	} else if *peerFlg {
-		PoolPeer()
-		Clear()
-	} else if *gossipFlg {
-		PoolPeerGossip()
-		Clear()
-	} else if *multicastFlg {
-		PoolPeerMulticast()
-		Clear()
+		modules = []bool{true, true, true}
+	}
+
+	if !*batchFlg && *scriptFlg == "" {
+		input := bufio.NewScanner(os.Stdin)
+		if modules[0] {
+			PoolPeer(input)
+			Clear()
+		}
+		if modules[1] {
+			PoolPeerGossip(input)
+			Clear()
+		}
+		if modules[2] {
+			PoolPeerMulticast(input)
+			Clear()
+		}
+		return
+	}
+
+	var script io.Reader
+	if *scriptFlg != "" {
+		f, err := os.Open(*scriptFlg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		script = f
+	} else {
+		b := Batch{
+			Size:     *sizeFlg,
+			Duration: *durationFlg,
+			Fw:       *fwFlg,
+		}
+		var err error
+		if b.Lock, err = parseIdxs(*lockFlg); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -lock: %s\n", err)
+			os.Exit(2)
+		}
+		if b.Unlock, err = parseIdxs(*unlockFlg); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -unlock: %s\n", err)
+			os.Exit(2)
+		}
+		if b.Inject, err = parseInjections(*injectFlg); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -inject: %s\n", err)
+			os.Exit(2)
+		}
+		script = strings.NewReader(b.Script(modules))
 	}
+	batchDuration = *durationFlg
+	os.Exit(RunBatch(script, modules))
 }
 
-func PoolPeer() {
+func PoolPeer(input *bufio.Scanner) Summary {
 	fmt.Printf("%v %v\n", color.GreenString("Info: "), "Starting Peer Token Ring Module")
 	fmt.Printf("%v %v", color.YellowString("Prompt: "), "Pool size (min: 4) > ")
-	input := bufio.NewScanner(os.Stdin)
-	input.Scan()
+	if !input.Scan() {
+		return Summary{Module: "peer", Err: io.ErrUnexpectedEOF}
+	}
 	size, err := strconv.Atoi(input.Text())
 	if err != nil {
-		log.Fatalln(err)
+		// initPeerPool falls back to the minimum size
+		stepFailed(fmt.Errorf("malformed pool size %q", input.Text()))
 	}
 	pool := initPeerPool(0, size)
 	fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Created %d peers with TTL = %d", len(pool), peer.TTL))
@@ -115,153 +417,237 @@ func PoolPeer() {
 	fmt.Printf("\n------------------------------------\n\n")
 
 	for {
-		fmt.Printf("%v commands: shell, reset, exit\n> ", color.CyanString("[Peer Token Ring Module Shell]"))
-		input.Scan()
+		fmt.Printf("%v commands: shell, overlay, reset, exit\n> ", color.CyanString("[Peer Token Ring Module Shell]"))
+		if !input.Scan() {
+			return incomplete(peerSummary(pool))
+		}
 		switch input.Text() {
 		case "shell":
 			fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Peers: 0...%d", len(pool)-1))
 			fmt.Printf("idx > ")
 			input.Scan()
-			p, err := strconv.Atoi(input.Text())
-			if err != nil {
-				log.Fatalln(err)
-			}
-			if p >= 0 && p < len(pool) {
-				pr, ok := pool[p].(peer.Peer)
-				if ok {
-					pr.PeerShell()
+			if p, ok := peerIdx(input.Text(), pool); ok {
+				if pr, ok := pool[p].(*peer.Peer); ok {
+					pr.PeerShell(input)
 				}
 			}
+		case "overlay":
+			overlayCommand(input, pool)
 		case "reset":
 			pool = make([]interface{}, 0)
 			peerPrefix += 1
 			pool = initPeerPool(0, size)
 		case "exit":
-			return
+			return peerSummary(pool)
 		}
 	}
 }
 
-func PoolPeerGossip() {
+func PoolPeerGossip(input *bufio.Scanner) Summary {
 	fmt.Printf("%v %v\n", color.GreenString("Info: "), "Starting Peer Gossip Module")
-	pool := initPeerPool(1, peergossip.K+1)
-	input := bufio.NewScanner(os.Stdin)
-	fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Created %d peers each with %d samples", peergossip.K+1, peergossip.SAMPLES))
-	fmt.Printf("%v Poisson Process: λ = 2 - 2evs per 60s - 1ev per 30s\n", color.GreenString("Info: "))
+	pool := initPeerPool(1, gossipPoolSize)
+	fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Created %d peers each with %d samples", gossipPoolSize, peergossip.SAMPLES))
+	fmt.Printf("%v Strategy: %s, broadcast: %s, topology: %s\n", color.GreenString("Info: "), gossipStrategy, gossipBroadcast, gossipTopology)
+	fmt.Printf("%v Events: %s - %.3g evs per second\n", color.GreenString("Info: "), peergossip.DefaultEvents.Dist, peergossip.DefaultEvents.Rate)
 	fmt.Printf("%v %v\n", color.GreenString("Info: "), "start - start gossiping ; gossip - send custom gossip (after start)")
 	fmt.Printf("\n------------------------------------\n\n")
 
-	// topology from assignment - hardcoded
-	p1, _ := pool[0].(*peergossip.Peer)
-	p2, _ := pool[1].(*peergossip.Peer)
-	p3, _ := pool[2].(*peergossip.Peer)
-	p4, _ := pool[3].(*peergossip.Peer)
-	p5, _ := pool[4].(*peergossip.Peer)
-	p6, _ := pool[5].(*peergossip.Peer)
-	// p2.Register(int(p1.Port))
-	// p2.Register(int(p3.Port))
-	// p2.Register(int(p4.Port))
-	// p4.Register(int(p5.Port))
-	// p4.Register(int(p6.Port))
-	// ----
+	stops := make([]func(), 0)
+	stopAll := func() {
+		for _, stop := range stops {
+			stop()
+		}
+		stops = stops[:0]
+	}
 
 	for {
-		fmt.Printf("%v commands: start, gossip, status, exit\n> ", color.CyanString("[Peer Gossip Module Shell]"))
-		input.Scan()
+		fmt.Printf("%v commands: start, gossip, publish, subscribe, unsubscribe, delete, crdt, status, report, overlay, exit\n> ", color.CyanString("[Peer Gossip Module Shell]"))
+		if !input.Scan() {
+			return incomplete(gossipSummary(pool))
+		}
 		switch input.Text() {
 		case "start":
 			fmt.Printf("%v %v\n", color.GreenString("Info: "), "Gossip timestamps will be printed, exit will stop pool.")
-			p2.Register(int(p1.Port))
-			p2.Register(int(p3.Port))
-			p2.Register(int(p4.Port))
-			p4.Register(int(p5.Port))
-			p4.Register(int(p6.Port))
+			p1, _ := pool[0].(*peergossip.Peer)
+			if gossipHyParView {
+				fmt.Printf("%v %v\n", color.GreenString("Info: "), "HyParView peer sampling, peers join through peer 0")
+				stops = append(stops, p1.StartHyParView(hyparview.DefaultConfig, 0))
+				for _, p := range pool[1:] {
+					stops = append(stops, p.(*peergossip.Peer).StartHyParView(hyparview.DefaultConfig, p1.Port))
+				}
+			}
+			if gossipSWIM {
+				fmt.Printf("%v %v\n", color.GreenString("Info: "), "SWIM membership, peers join through peer 0")
+				for _, p := range pool[1:] {
+					p.(*peergossip.Peer).Register(int(p1.Port))
+				}
+				for _, p := range pool {
+					stops = append(stops, p.(*peergossip.Peer).StartSWIM(peergossip.DefaultSWIM))
+				}
+			} else if !gossipHyParView {
+				for _, e := range gossipTopology.Edges() {
+					pool[e[0]].(*peergossip.Peer).Register(int(pool[e[1]].(*peergossip.Peer).Port))
+				}
+			}
+			// every pool peer must see a tombstone, SWIM tracks members itself
+			tcfg := gossipTombstones
+			if !gossipSWIM {
+				tcfg.Members = poolPorts(pool)
+			}
+			for _, p := range pool {
+				stops = append(stops, p.(*peergossip.Peer).StartTombstoneGC(tcfg))
+			}
+			if mode, err := peergossip.ParseSyncMode(gossipSync); gossipSync != "" && err == nil {
+				fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Anti-entropy: %s (%s digests) every %s", mode, gossipSyncDigest, gossipSyncInterval))
+				for _, p := range pool {
+					p.(*peergossip.Peer).Reconcile = gossipSyncDigest
+					stops = append(stops, p.(*peergossip.Peer).StartAntiEntropy(mode, gossipSyncInterval))
+				}
+			}
 		case "gossip":
 			fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Peers: 0...%d", len(pool)-1))
 			fmt.Printf("Sender idx > ")
 			input.Scan()
-			p, err := strconv.Atoi(input.Text())
-			if err != nil {
-				log.Fatalln(err)
-			}
-
-			if p >= 0 && p < len(pool) {
+			if p, ok := peerIdx(input.Text(), pool); ok {
 				sd, _ := pool[p].(*peergossip.Peer)
 				fmt.Printf("%v", color.YellowString("Prompt: "))
 				input.Scan()
 				msg := input.Text()
 				sd.Gossip(msg, sd.Port)
 			}
+		case "publish", "subscribe", "unsubscribe":
+			cmd := input.Text()
+			fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Peers: 0...%d", len(pool)-1))
+			fmt.Printf("Peer idx > ")
+			input.Scan()
+			p, ok := peerIdx(input.Text(), pool)
+			fmt.Printf("%v Topic > ", color.YellowString("Prompt:"))
+			input.Scan()
+			topic := input.Text()
+			payload := ""
+			if cmd == "publish" {
+				fmt.Printf("%v Payload > ", color.YellowString("Prompt:"))
+				input.Scan()
+				payload = input.Text()
+			}
+			if ok {
+				pubSubCommand(pool[p].(*peergossip.Peer), cmd, topic, payload)
+			}
+		case "delete":
+			fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Peers: 0...%d", len(pool)-1))
+			fmt.Printf("Peer idx > ")
+			input.Scan()
+			p, ok := peerIdx(input.Text(), pool)
+			fmt.Printf("%v Word or rumor id > ", color.YellowString("Prompt:"))
+			input.Scan()
+			if ok {
+				pr := pool[p].(*peergossip.Peer)
+				ids := pr.Rumors(input.Text())
+				if len(ids) == 0 {
+					ids = []string{input.Text()}
+				}
+				for _, id := range ids {
+					if err := pr.Delete(id); err != nil {
+						stepFailed(err)
+					}
+				}
+			}
+		case "crdt":
+			fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Peers: 0...%d", len(pool)-1))
+			fmt.Printf("Sender idx > ")
+			input.Scan()
+			p, ok := peerIdx(input.Text(), pool)
+			fmt.Printf("%v gset-add|orset-add|orset-remove|lww-set|counter-add <name> <arg> > ", color.YellowString("Prompt:"))
+			input.Scan()
+			if ok {
+				if err := crdtCommand(pool[p].(*peergossip.Peer), input.Text()); err != nil {
+					stepFailed(err)
+				}
+			}
 		case "status":
 			for i, p := range pool {
-				fmt.Printf("[%d] %+v\n", i, p.(*peergossip.Peer))
+				fmt.Printf("[%d] %+v\n", i, p.(*peergossip.Peer).Status())
+				if members := p.(*peergossip.Peer).Members(); members != nil {
+					fmt.Printf("    members: %+v\n", members)
+				}
+				if hv := p.(*peergossip.Peer).HyParView; hv != nil {
+					fmt.Printf("    hyparview: %s\n", hv)
+				}
+				if crdts := p.(*peergossip.Peer).CRDTs(); len(crdts) > 0 {
+					fmt.Printf("    crdts: %v\n", crdts)
+				}
+				if ts := p.(*peergossip.Peer).Tombstones(); len(ts) > 0 {
+					fmt.Printf("    tombstones: %v\n", ts)
+				}
+				if topics := p.(*peergossip.Peer).Topics(); len(topics) > 0 {
+					fmt.Printf("    topics: %v\n", topics)
+				}
+			}
+		case "overlay":
+			overlayCommand(input, pool)
+		case "report":
+			for _, r := range gossipConvergence.Report(poolPorts(pool)) {
+				fmt.Println(r)
 			}
 		case "reset":
+			// the old peers keep their ports, the new pool takes the next free ones
+			prefix := peerGossipPrefix + (gossipPoolSize+9)/10
+			if _, err := gossipPorts(prefix, gossipPoolSize); err != nil {
+				stepFailed(fmt.Errorf("reset: %w", err))
+				continue
+			}
+			stopAll()
 			for _, p := range pool {
-				p.(*peergossip.Peer).Registry = make([]uint16, 0)
+				p.(*peergossip.Peer).StopWords()
+				p.(*peergossip.Peer).SetRegistry(make([]uint16, 0))
 			}
 			pool = make([]interface{}, 0)
-			peerGossipPrefix += 1
-			pool = initPeerPool(1, peergossip.K+1)
+			peerGossipPrefix = prefix
+			pool = initPeerPool(1, gossipPoolSize)
 		case "exit":
+			stopAll()
+			summary := gossipSummary(pool)
+			if gossipReport != "" {
+				if err := writeGossipReport(gossipReport, gossipConvergence.Report(poolPorts(pool))); err != nil {
+					summary.Err = err
+				} else {
+					summary.Lines = append(summary.Lines, fmt.Sprintf("convergence report written to %s", gossipReport))
+				}
+			}
 			for _, p := range pool {
-				p.(*peergossip.Peer).Registry = make([]uint16, 0)
+				p.(*peergossip.Peer).StopWords()
+				p.(*peergossip.Peer).SetRegistry(make([]uint16, 0))
 			}
-			return
+			return summary
 		}
 	}
 }
 
-func PoolPeerMulticast() {
+func PoolPeerMulticast(input *bufio.Scanner) Summary {
 	fmt.Printf("%v %v\n", color.GreenString("Info: "), "Starting Peer Multicast Module")
 	pool := initPeerPool(2, 4)
-	input := bufio.NewScanner(os.Stdin)
 	fmt.Printf("%v %v\n", color.GreenString("Info: "), fmt.Sprintf("Created %d peers each with %d samples", 6, multicast.SAMPLES))
-	fmt.Printf("%v Poisson Process: λ = 2 - 2evs per 2s - 1ev per second\n", color.GreenString("Info: "))
+	fmt.Printf("%v Events: %s - %.3g evs per second\n", color.GreenString("Info: "), multicast.DefaultEvents.Dist, multicast.DefaultEvents.Rate)
 	fmt.Printf("%v %v\n", color.GreenString("Info: "), "start - start multicast (with optional verbose mode)")
 
 	fmt.Printf("\n%v %v\n", color.GreenString("Info: "), "To stop pool send an interrupt, shell module will be displayed again.")
 	fmt.Printf("------------------------------------\n\n")
 
-	// topology from assignment - hardcoded
-	p1, _ := pool[0].(*multicast.Peer)
-	p2, _ := pool[1].(*multicast.Peer)
-	p3, _ := pool[2].(*multicast.Peer)
-	p4, _ := pool[3].(*multicast.Peer)
-	p5, _ := pool[4].(*multicast.Peer)
-	p6, _ := pool[5].(*multicast.Peer)
-
-	p1.PingPeer(int(p1.Port), "hello")
-	p1.PingPeer(int(p2.Port), "hello")
-	p1.PingPeer(int(p3.Port), "hello")
-	p1.PingPeer(int(p4.Port), "hello")
-	p1.PingPeer(int(p5.Port), "hello")
-	p1.PingPeer(int(p6.Port), "hello")
-
-	p2.PingPeer(int(p2.Port), "hello")
-	p2.PingPeer(int(p3.Port), "hello")
-	p2.PingPeer(int(p4.Port), "hello")
-	p2.PingPeer(int(p5.Port), "hello")
-	p2.PingPeer(int(p6.Port), "hello")
-
-	p3.PingPeer(int(p3.Port), "hello")
-	p3.PingPeer(int(p4.Port), "hello")
-	p3.PingPeer(int(p5.Port), "hello")
-	p3.PingPeer(int(p6.Port), "hello")
-
-	p4.PingPeer(int(p4.Port), "hello")
-	p4.PingPeer(int(p5.Port), "hello")
-	p4.PingPeer(int(p6.Port), "hello")
-
-	p5.PingPeer(int(p5.Port), "hello")
-	p5.PingPeer(int(p6.Port), "hello")
-
-	p6.PingPeer(int(p6.Port), "hello")
-	// ----
+	// every peer is in its own registry (it acks its own pings), then one ping per edge
+	for _, p := range pool {
+		p.(*multicast.Peer).PingPeer(int(p.(*multicast.Peer).Port), "hello")
+	}
+	for _, e := range multicastTopology.Edges() {
+		pool[e[0]].(*multicast.Peer).PingPeer(int(pool[e[1]].(*multicast.Peer).Port), "hello")
+	}
 
+	// snapshot taken when a run is stopped, since the pool is dropped afterwards
+	stats := multicastStats(pool)
 	for {
-		fmt.Printf("%v commands: start, reset, exit\n> ", color.CyanString("[Peer Multicast Module Shell]"))
-		input.Scan()
+		fmt.Printf("%v commands: start, overlay, reset, exit\n> ", color.CyanString("[Peer Multicast Module Shell]"))
+		if !input.Scan() {
+			return incomplete(multicastSummary(stats))
+		}
 		switch input.Text() {
 		case "start":
 			sigc := make(chan os.Signal, 1)
@@ -274,37 +660,133 @@ func PoolPeerMulticast() {
 			input.Scan()
 			opt := input.Text()
 			if opt == "y" {
-				multicast.VERBOSE = true
+				multicastLog.SetLevel(logging.Debug)
 			}
+			stops := make([]func(), 0, len(pool))
 			for _, p := range pool {
-				p.(*multicast.Peer).BootEvents()
+				stops = append(stops, p.(*multicast.Peer).BootEvents())
 			}
+			done := make(chan struct{})
 			go func() {
-				<-sigc
-				multicast.STOP = true
+				// batch runs stop themselves once the configured duration elapses
+				var timeout <-chan time.Time
+				if batchDuration > 0 {
+					timeout = time.After(batchDuration)
+				}
+				select {
+				case <-sigc:
+				case <-timeout:
+				}
+				signal.Stop(sigc)
+				for _, stop := range stops {
+					stop()
+				}
+				multicastLog.SetLevel(logging.Off)
+				stats = multicastStats(pool)
 				for _, p := range pool {
-					p.(*multicast.Peer).Registry = make([]uint16, 0)
+					p.(*multicast.Peer).SetRegistry(make([]uint16, 0))
 				}
-				pool = make([]interface{}, 0)
+				close(done)
 			}()
-			for {
-				if len(pool) == 0 {
-					break
-				}
-			}
+			<-done
+			pool = make([]interface{}, 0)
 			fmt.Printf("%v %v\n", color.RedString("Warn: "), "Peer Multicast Module must be reset (unstable - old prints might appear)")
+		case "overlay":
+			overlayCommand(input, pool)
 		case "reset":
-			multicast.STOP = false
 			pool = make([]interface{}, 0)
 			peerMulticastPrefix += 1
 			pool = initPeerPool(2, 4)
 		case "exit":
-			return
+			return multicastSummary(stats)
 		}
 	}
 }
 
 // -- aux
+
+// gossip topology from the assignment: 1 links 0, 2 and 3, 3 links 4 and 5
+func assignmentTopology() *topology.Graph {
+	g := topology.New("assignment", 6)
+	g.Connect(1, 0)
+	g.Connect(1, 2)
+	g.Connect(1, 3)
+	g.Connect(3, 4)
+	g.Connect(3, 5)
+	return g
+}
+
+// publish, subscribe (deliveries are printed) and unsubscribe shell commands
+func pubSubCommand(p *peergossip.Peer, cmd string, topic string, payload string) {
+	switch cmd {
+	case "publish":
+		if err := p.Publish(topic, payload); err != nil {
+			stepFailed(err)
+		}
+	case "subscribe":
+		msgs := p.Subscribe(topic)
+		go func() {
+			for m := range msgs {
+				fmt.Printf("%v [%d] %s: %s (from %d)\n", color.MagentaString("Deliver:"), p.Port, m.Topic, m.Payload, m.Origin)
+			}
+		}()
+	case "unsubscribe":
+		p.Unsubscribe(topic)
+	}
+}
+
+// crdt shell command: "<op> <name> <arg>" update of a replicated data type on p
+func crdtCommand(p *peergossip.Peer, line string) error {
+	f := strings.Fields(line)
+	if len(f) != 3 {
+		return fmt.Errorf("expected <op> <name> <arg>, got %q", line)
+	}
+	op, name, arg := f[0], f[1], f[2]
+	switch op {
+	case "gset-add":
+		return p.GSetAdd(name, arg)
+	case "orset-add":
+		return p.ORSetAdd(name, arg)
+	case "orset-remove":
+		return p.ORSetRemove(name, arg)
+	case "lww-set":
+		return p.LWWSet(name, arg)
+	case "counter-add":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return err
+		}
+		return p.CounterAdd(name, n)
+	}
+	return fmt.Errorf("unknown crdt op %q", op)
+}
+
+// overlay shell command: dumps the pool graph as DOT or JSON, to stdout or a file
+func overlayCommand(input *bufio.Scanner, pool Pool) {
+	fmt.Printf("%v Format (dot, json) > ", color.YellowString("Prompt:"))
+	input.Scan()
+	format := input.Text()
+	fmt.Printf("%v File (empty - stdout) > ", color.YellowString("Prompt:"))
+	input.Scan()
+	file := input.Text()
+
+	var w io.Writer = os.Stdout
+	if file == "" {
+		fmt.Println()
+	} else {
+		f, err := os.Create(file)
+		if err != nil {
+			stepFailed(err)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := overlay.Snapshot(pool).Write(w, format); err != nil {
+		stepFailed(err)
+	}
+}
+
 // Ref: https://stackoverflow.com/a/22896706
 var clear map[string]func()
 
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"token-ring/multicast"
+	"token-ring/peergossip"
+	"token-ring/sim"
+)
+
+// Simulation run (-sim), the module peers run over the sim transport instead of pools, in virtual time
+type Simulation struct {
+	Modules  []bool // token ring, gossip, multicast
+	Seed     int64
+	Latency  sim.Latency
+	Loss     float64       // gossip only, token ring and multicast peers exit on a lost call
+	Until    time.Duration // virtual time bound (0 - until every event ran)
+	MaxSteps int
+	// token ring: Size peers, Fw forwards first, Lock locked
+	Size int
+	Fw   int
+	Lock []int
+	// multicast peers
+	MulticastSize int
+}
+
+var simModules = []string{"tokenring", "gossip", "multicast"}
+
+// parseSimModules: comma separated tokenring, gossip, multicast or all
+func parseSimModules(s string) ([]bool, error) {
+	modules := make([]bool, len(simModules))
+	for _, m := range strings.Split(s, ",") {
+		found := false
+		for i, name := range simModules {
+			if m == name || m == "all" {
+				modules[i], found = true, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown module %q (%s or all)", m, strings.Join(simModules, ", "))
+		}
+	}
+	return modules, nil
+}
+
+// Run simulates the selected modules, the gossip and multicast ones with the same topology,
+// strategy and events as the peer pools (SAMPLES events per peer)
+func (c Simulation) Run() []Summary {
+	summaries := make([]Summary, 0)
+	if c.Modules[0] {
+		s := c.sim(0)
+		r := sim.NewTokenRing(s, sim.TokenRingConfig{N: c.Size, Locked: c.Lock, Start: c.Fw})
+		r.Start()
+		summaries = append(summaries, c.summary("sim tokenring", s, r.Lines))
+	}
+	if c.Modules[1] {
+		s := c.sim(c.Loss)
+		events := peergossip.DefaultEvents
+		events.Count = peergossip.SAMPLES
+		g := sim.NewGossip(s, sim.GossipConfig{Graph: gossipTopology, Strategy: gossipStrategy, Broadcast: gossipBroadcast, Events: events})
+		g.Start()
+		summaries = append(summaries, c.summary("sim gossip", s, g.Lines))
+	}
+	if c.Modules[2] {
+		s := c.sim(0)
+		events := multicast.DefaultEvents
+		events.Count = multicast.SAMPLES
+		m := sim.NewMulticast(s, sim.MulticastConfig{N: c.MulticastSize, Events: events})
+		m.Start()
+		summaries = append(summaries, c.summary("sim multicast", s, m.Lines))
+	}
+	return summaries
+}
+
+func (c Simulation) sim(loss float64) *sim.Sim {
+	s := sim.New(c.Seed)
+	s.Latency, s.Loss, s.MaxSteps = c.Latency, loss, c.MaxSteps
+	return s
+}
+
+// runs s and summarizes it, lines are taken once it ran
+func (c Simulation) summary(module string, s *sim.Sim, lines func() []string) Summary {
+	start := time.Now()
+	s.Run(c.Until)
+	sum := Summary{Module: module, Lines: lines()}
+	sum.Lines = append(sum.Lines, fmt.Sprintf("seed %d, latency %s, loss %g: %d calls (%d dropped), %d events, virtual time %s (wall %s)",
+		c.Seed, c.Latency, s.Loss, s.Sent, s.Dropped, s.Steps, s.Now(), time.Since(start).Round(time.Millisecond)))
+	if s.Limited() {
+		sum.Err = fmt.Errorf("stopped after %d events (-sim-max-steps), %d pending", s.Steps, s.Pending())
+	}
+	return sum
+}
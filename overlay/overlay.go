@@ -0,0 +1,173 @@
+package overlay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"token-ring/multicast"
+	"token-ring/peer"
+	"token-ring/peergossip"
+)
+
+// Snapshots of the live overlays, rendered as Graphviz DOT or JSON:
+//
+//	peer:       token ring Next links, the token holder (highest token) and lock status
+//	peergossip: Registry links (HyParView active views when running) and known words
+//	multicast:  membership (Registry) links, clock, queue length and gold peers
+//
+// Links listed by both ends are a single mutual edge.
+//
+//	overlay.Snapshot(pool).WriteDOT(os.Stdout)  // | dot -Tsvg > overlay.svg
+
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+type Node struct {
+	Port   uint16            `json:"port"`
+	Module string            `json:"module"`
+	State  map[string]string `json:"state"`
+	// drawn filled: token holder, gold multicast peer
+	Marked bool `json:"marked"`
+}
+
+type Edge struct {
+	From   uint16 `json:"from"`
+	To     uint16 `json:"to"`
+	Kind   string `json:"kind"` // next, registry, active, member
+	Mutual bool   `json:"mutual"`
+}
+
+// Snapshot of pool (elements are *peer.Peer, *peergossip.Peer or *multicast.Peer, like admin pools)
+func Snapshot(pool []interface{}) *Graph {
+	g := &Graph{Nodes: make([]Node, 0), Edges: make([]Edge, 0)}
+	holder, token := uint16(0), 0
+	links := make(map[[2]uint16]string)
+	for _, p := range pool {
+		switch p := p.(type) {
+		case *peer.Peer:
+			st := p.Status()
+			g.Nodes = append(g.Nodes, Node{Port: p.Port, Module: "peer", State: map[string]string{
+				"token": strconv.Itoa(st.Token), "ttl": strconv.Itoa(st.TTL), "locked": strconv.FormatBool(st.Lock == 1),
+			}})
+			g.Edges = append(g.Edges, Edge{From: p.Port, To: st.Next, Kind: "next"})
+			if st.Token > token {
+				holder, token = p.Port, st.Token
+			}
+		case *peergossip.Peer:
+			g.Nodes = append(g.Nodes, Node{Port: p.Port, Module: "peergossip", State: map[string]string{
+				"words": strconv.Itoa(p.Known()),
+			}})
+			kind := "registry"
+			if p.HyParView != nil {
+				kind = "active"
+			}
+			for _, n := range p.Neighbours() {
+				links[[2]uint16{p.Port, n}] = kind
+			}
+		case *multicast.Peer:
+			st := p.Status()
+			g.Nodes = append(g.Nodes, Node{Port: p.Port, Module: "multicast", Marked: p.Gold, State: map[string]string{
+				"clock": strconv.Itoa(int(st.Clock)), "queue": strconv.Itoa(len(st.Queue)), "gold": strconv.FormatBool(p.Gold),
+			}})
+			for _, n := range st.Registry {
+				links[[2]uint16{p.Port, n}] = "member"
+			}
+		}
+	}
+	for i := range g.Nodes {
+		if g.Nodes[i].Module == "peer" && g.Nodes[i].Port == holder {
+			g.Nodes[i].Marked = true
+			g.Nodes[i].State["holder"] = "true"
+		}
+	}
+	for l, kind := range links {
+		from, to := l[0], l[1]
+		if from == to {
+			continue
+		}
+		_, back := links[[2]uint16{to, from}]
+		if back && from > to {
+			continue
+		}
+		g.Edges = append(g.Edges, Edge{From: from, To: to, Kind: kind, Mutual: back})
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Port < g.Nodes[j].Port })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	return g
+}
+
+// Label: port and state, one "key=value" per line
+func (n Node) Label() string {
+	keys := make([]string, 0, len(n.State))
+	for k := range n.State {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := []string{strconv.Itoa(int(n.Port))}
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s=%s", k, n.State[k]))
+	}
+	return strings.Join(lines, "\\n")
+}
+
+// WriteDOT writes a digraph, a cluster per module
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("digraph overlay {\n\tnode [shape=box];\n")
+	modules := make([]string, 0)
+	byModule := make(map[string][]Node)
+	for _, n := range g.Nodes {
+		if _, ok := byModule[n.Module]; !ok {
+			modules = append(modules, n.Module)
+		}
+		byModule[n.Module] = append(byModule[n.Module], n)
+	}
+	for _, m := range modules {
+		fmt.Fprintf(&sb, "\tsubgraph \"cluster_%s\" {\n\t\tlabel=%q;\n", m, m)
+		for _, n := range byModule[m] {
+			style := ""
+			if n.Marked {
+				style = ", style=filled"
+			}
+			fmt.Fprintf(&sb, "\t\t\"%d\" [label=\"%s\"%s];\n", n.Port, n.Label(), style)
+		}
+		sb.WriteString("\t}\n")
+	}
+	for _, e := range g.Edges {
+		attrs := fmt.Sprintf("label=%q", e.Kind)
+		if e.Mutual {
+			attrs += ", dir=none"
+		}
+		fmt.Fprintf(&sb, "\t\"%d\" -> \"%d\" [%s];\n", e.From, e.To, attrs)
+	}
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// Write in format: dot or json
+func (g *Graph) Write(w io.Writer, format string) error {
+	switch format {
+	case "dot":
+		return g.WriteDOT(w)
+	case "json":
+		return g.WriteJSON(w)
+	}
+	return fmt.Errorf("unknown overlay format %q (dot, json)", format)
+}
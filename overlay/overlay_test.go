@@ -0,0 +1,73 @@
+package overlay
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"token-ring/multicast"
+	"token-ring/peer"
+	"token-ring/peergossip"
+)
+
+func TestSnapshot(t *testing.T) {
+	ring := []interface{}{
+		&peer.Peer{Port: 4440, Next: 4441, Token: 1, TTL: 3},
+		&peer.Peer{Port: 4441, Next: 4442, Token: 2, TTL: 3, Lock: 0},
+		&peer.Peer{Port: 4442, Next: 4440, Lock: 1},
+	}
+	g := Snapshot(ring)
+	if len(g.Nodes) != 3 || len(g.Edges) != 3 || g.Edges[2] != (Edge{From: 4442, To: 4440, Kind: "next"}) {
+		t.Fatalf("unexpected ring %+v", g)
+	}
+	if !g.Nodes[1].Marked || g.Nodes[0].Marked || g.Nodes[2].State["locked"] != "true" {
+		t.Fatalf("expected 4441 to hold the token and 4442 locked: %+v", g.Nodes)
+	}
+
+	// 4640-4641 mutual, 4642 -> 4640 one way, multicast self links dropped
+	pool := []interface{}{
+		&peergossip.Peer{Port: 4640, Registry: []uint16{4641}},
+		&peergossip.Peer{Port: 4641, Registry: []uint16{4640}, Words: map[string]string{"4641-1": "hello"}},
+		&peergossip.Peer{Port: 4642, Registry: []uint16{4640}},
+		&multicast.Peer{Port: 4740, Registry: []uint16{4740, 4741}, Clock: 7},
+		&multicast.Peer{Port: 4741, Registry: []uint16{4741, 4740}, Gold: true},
+	}
+	g = Snapshot(pool)
+	want := []Edge{
+		{From: 4640, To: 4641, Kind: "registry", Mutual: true},
+		{From: 4642, To: 4640, Kind: "registry"},
+		{From: 4740, To: 4741, Kind: "member", Mutual: true},
+	}
+	if len(g.Edges) != len(want) {
+		t.Fatalf("expected edges %+v, got %+v", want, g.Edges)
+	}
+	for i, e := range want {
+		if g.Edges[i] != e {
+			t.Fatalf("expected edges %+v, got %+v", want, g.Edges)
+		}
+	}
+	if g.Nodes[1].Label() != `4641\nwords=1` || !g.Nodes[4].Marked {
+		t.Fatalf("unexpected nodes %+v", g.Nodes)
+	}
+
+	var sb strings.Builder
+	if err := g.Write(&sb, "dot"); err != nil {
+		t.Fatal(err)
+	}
+	dot := sb.String()
+	for _, s := range []string{"digraph overlay {", `subgraph "cluster_peergossip"`, `"4640" -> "4641" [label="registry", dir=none];`, `"4642" -> "4640" [label="registry"];`, `label="4741\nclock=0\ngold=true\nqueue=0", style=filled`} {
+		if !strings.Contains(dot, s) {
+			t.Fatalf("expected %q in\n%s", s, dot)
+		}
+	}
+	sb.Reset()
+	if err := g.Write(&sb, "json"); err != nil {
+		t.Fatal(err)
+	}
+	decoded := Graph{}
+	if err := json.Unmarshal([]byte(sb.String()), &decoded); err != nil || len(decoded.Nodes) != 5 || len(decoded.Edges) != 3 {
+		t.Fatalf("unexpected JSON %s (%v)", sb.String(), err)
+	}
+	if err := g.Write(&sb, "svg"); err == nil {
+		t.Fatal("expected an unknown format error")
+	}
+}
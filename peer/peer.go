@@ -6,96 +6,169 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"token-ring/auth"
+	"token-ring/common"
 	grpcapi "token-ring/grpcapi"
-
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"token-ring/logging"
+	"token-ring/metrics"
+	"token-ring/rpc"
 )
 
 // Peer TTL
 // 	decremented for each token action (Bind)
 const TTL = 4
 
+var tokensPassed = metrics.NewCounter("peer_tokens_passed_total", "Tokens forwarded to the next peer in the ring", "peer")
+var tokenHold = metrics.NewHistogram("peer_token_hold_seconds", "Time a peer holds the token before forwarding it", metrics.DefBuckets, "peer")
+
 type Peer struct {
+	// guards Next, Prev, Token, TTL, Lock and recv (Ping runs once per grpc call, the admin API and
+	// shells act concurrently), RPCs are made without it (the token comes back around the ring)
+	mu   sync.Mutex
+	Port uint16 `json:"port"`
+	Next uint16 `json:"next"`
+	// the only peer the token is taken from (see Ring)
+	Prev  uint16 `json:"prev"`
+	Token int    `json:"token"`
+	Addr  net.IP `json:"addr"`
+	TTL   int    `json:"ttl"`
+	Lock  uint8  `json:"lock"`
+	// last token receipt (token hold time)
+	recv time.Time
+	// structured logger, carries the peer port (replace to inject another)
+	Log *logging.Logger `json:"-"`
+	// keypair, every message is sealed (signed) by its sender
+	id *auth.Node
+	// clock of the token hold times (a virtual scheduler runs the peer in virtual time, see sim)
+	Sched *common.Scheduler `json:"-"`
+	grpcapi.UnimplementedShellServer
+}
+
+// Status snapshot of a peer
+type Status struct {
 	Port  uint16 `json:"port"`
 	Next  uint16 `json:"next"`
+	Prev  uint16 `json:"prev"`
 	Token int    `json:"token"`
 	Addr  net.IP `json:"addr"`
 	TTL   int    `json:"ttl"`
 	Lock  uint8  `json:"lock"`
-	grpcapi.UnimplementedShellServer
 }
 
-func NewPeer(port uint16, next uint16, lock uint8) Peer {
+func NewPeer(port uint16, next uint16, lock uint8) *Peer {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer conn.Close()
 
-	p := Peer{
+	p := &Peer{
 		Port:  port,
 		Next:  next,
 		Token: 0,
 		TTL:   TTL,
 		Lock:  lock,
 		Addr:  conn.LocalAddr().(*net.UDPAddr).IP,
+		Log:   logging.Default.With("module", "peer", "port", port),
+		id:    auth.NewNode(port, auth.Default),
+		Sched: common.DefaultScheduler(),
 	}
 	go Listen(p)
 	return p
 }
 
-func Listen(p Peer) {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", p.Port))
+// Ring links peers in order (the last one back to the first): Next and Prev of each
+func Ring(peers ...*Peer) {
+	for i, p := range peers {
+		next := peers[(i+1)%len(peers)]
+		p.SetNext(next.Port)
+		next.SetPrev(p.Port)
+	}
+}
+
+func Listen(p *Peer) {
+	l, err := rpc.Listen(p.Port)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	grpcs := grpc.NewServer()
-	grpcapi.RegisterShellServer(grpcs, &p)
+	grpcs := rpc.NewServer(p.Port)
+	grpcapi.RegisterShellServer(grpcs, p)
 	if err := grpcs.Serve(l); err != nil {
 		log.Fatalln(err)
 	}
 }
 
 func (p *Peer) Bind() {
-	var conn *grpc.ClientConn
-	conn, err := grpc.Dial(fmt.Sprintf(":%d", p.Next), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	p.bind(context.Background())
+}
+
+// ctx carries the trace of the token pass that triggered the forward
+func (p *Peer) bind(ctx context.Context) {
+	label := strconv.Itoa(int(p.Port))
+	p.mu.Lock()
+	next, token := p.Next, p.Token
+	if !p.recv.IsZero() {
+		tokenHold.Observe(p.Sched.Now().Sub(p.recv).Seconds(), label)
+		p.recv = time.Time{}
+	}
+	p.mu.Unlock()
+
+	conn, err := rpc.Dial(int(next))
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer conn.Close()
 
-	// log.Printf("%s\n", fmt.Sprintf("[%d] -> [%d] Token: %d", p.Port, p.Next, p.Token))
+	// log.Printf("%s\n", fmt.Sprintf("[%d] -> [%d] Token: %d", p.Port, next, token))
 	g := grpcapi.NewShellClient(conn)
-	res, err := g.Ping(context.Background(), &grpcapi.Message{Body: fmt.Sprintf("t:%d", p.Token)})
+	res, err := g.Ping(ctx, &grpcapi.Message{Body: p.id.Seal(next, fmt.Sprintf("t:%d", token))})
+	if auth.Rejected(err) {
+		// ex: next was relinked to another Prev (leave) while the token was in flight
+		p.Log.Warn("token rejected", "next", next, "err", err)
+		return
+	}
 	if err != nil {
 		log.Fatalf("error calling grpc call: %s\n", err)
 	}
-
-	rstr := strings.Split(res.Body, ":")
-	rval, err := strconv.Atoi(rstr[0])
+	body, sender, err := auth.Default.Open(p.Port, res.Body)
+	if err == nil && sender != next {
+		err = auth.ErrForged
+	}
+	var rval int
+	if err == nil {
+		rstr, _, _ := strings.Cut(body, ":")
+		if rval, err = strconv.Atoi(rstr); err != nil {
+			err = auth.ErrMalformed
+		}
+	}
 	if err != nil {
-		log.Fatalln(err)
+		p.Log.Warn("rejected reply", "next", next, "err", err)
+		return
 	}
-	if rval == 1 {
-		log.Printf("\tPeer %d TTL expired\n", p.Next)
+	if rval == 0 {
+		tokensPassed.Inc(label)
+	} else if rval == 1 {
+		p.Log.Warn("ttl expired", "next", next)
 	} else if rval == 2 {
-		log.Printf("\tPeer %d locked\n", p.Next)
+		p.Log.Warn("next locked", "next", next)
 	}
 }
 
-func (p *Peer) PeerShell() {
+// input is shared with the caller so scripted (non-interactive) runs can drive the shell
+func (p *Peer) PeerShell(input *bufio.Scanner) {
 	for {
 		fmt.Printf("commands: status, lock, unlock, fw, exit\n> ")
-		input := bufio.NewScanner(os.Stdin)
-		input.Scan()
+		if !input.Scan() {
+			return
+		}
 		switch input.Text() {
 		case "status":
-			fmt.Printf("\n%+v\n", p)
+			fmt.Printf("\n%+v\n", p.Status())
 		case "lock":
 			LockPeer(int(p.Port), true)
 		case "unlock":
@@ -110,11 +183,10 @@ func (p *Peer) PeerShell() {
 	}
 }
 
-// grpc request to lock peer by addr
+// grpc request to lock peer by addr (sent as auth.Operator)
 func LockPeer(addr int, actionType bool) {
 	var res *grpcapi.Message
-	var conn *grpc.ClientConn
-	conn, err := grpc.Dial(fmt.Sprintf(":%d", addr), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := rpc.Dial(addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -122,51 +194,120 @@ func LockPeer(addr int, actionType bool) {
 
 	g := grpcapi.NewShellClient(conn)
 	if actionType {
-		res, err = g.Ping(context.Background(), &grpcapi.Message{Body: "l:1"}) // lock
-		if err != nil {
+		res, err = g.Ping(context.Background(), &grpcapi.Message{Body: auth.Operator.Seal(uint16(addr), "l:1")}) // lock
+		if err != nil && !auth.Rejected(err) {
 			log.Fatalf("error calling grpc call: %s\n", err)
 		}
 	} else {
-		res, err = g.Ping(context.Background(), &grpcapi.Message{Body: "l:0"}) // unlock
-		if err != nil {
+		res, err = g.Ping(context.Background(), &grpcapi.Message{Body: auth.Operator.Seal(uint16(addr), "l:0")}) // unlock
+		if err != nil && !auth.Rejected(err) {
 			log.Fatalf("error calling grpc call: %s\n", err)
 		}
 	}
-	log.Printf("\tPeer %d status: %s", addr, res)
+	if err != nil {
+		logging.Default.Warn("lock rejected", "port", addr, "err", err)
+		return
+	}
+	body, sender, err := auth.Default.Open(auth.Operator.Port, res.Body)
+	if err == nil && sender != uint16(addr) {
+		err = auth.ErrForged
+	}
+	if err != nil {
+		logging.Default.Warn("rejected reply", "port", addr, "err", err)
+		return
+	}
+	logging.Default.Info("lock", "status", body, "port", addr)
 }
 
-// grpcapi implementation of ping
+// grpcapi implementation of ping, bodies are sealed (see auth): tokens ("t:<token>") are only
+// taken from Prev, locks ("l:<0|1>") only from auth.Operator
 func (p *Peer) Ping(ctx context.Context, in *grpcapi.Message) (*grpcapi.Message, error) {
-	msg := in.Body
+	msg, sender, err := auth.Default.Open(p.Port, in.Body)
+	if err != nil {
+		p.Log.Warn("rejected", "sender", sender, "err", err)
+		return nil, auth.Reject(err)
+	}
+	kind, arg, _ := strings.Cut(msg, ":")
+	if err := p.check(kind, arg, sender); err != nil {
+		p.Log.Warn("rejected", "sender", sender, "body", msg, "err", err)
+		return nil, auth.Reject(err)
+	}
 	res := ""
-	if strings.Contains(in.Body, "t") { // expect token
-		msg = strings.Split(msg, ":")[1]
-		token, err := strconv.Atoi(msg)
-		if err != nil {
-			log.Fatalln(err)
-		}
-
+	if kind == "t" { // expect token
+		token, _ := strconv.Atoi(arg)
+		p.mu.Lock()
 		if p.TTL <= 0 {
-			return &grpcapi.Message{Body: "1:1"}, nil
+			p.mu.Unlock()
+			return &grpcapi.Message{Body: p.id.Seal(sender, "1:1")}, nil
 		}
-
-		if p.Lock == 0 {
-			fmt.Printf("\n%s\n", fmt.Sprintf("Token: %d\tPeer: %d", token, p.Port))
-			p.Token = token + 1
-			p.TTL -= 1
-			p.Bind()
-		} else if p.Lock == 1 {
-			return &grpcapi.Message{Body: "2:2"}, nil
+		if p.Lock == 1 {
+			p.mu.Unlock()
+			return &grpcapi.Message{Body: p.id.Seal(sender, "2:2")}, nil
 		}
+		p.Log.Info("token", "token", token, "ttl", p.TTL)
+		p.recv = p.Sched.Now()
+		p.Token = token + 1
+		p.TTL -= 1
+		p.mu.Unlock()
+		p.bind(ctx)
 		res = fmt.Sprintf("0:%d", token)
-	} else if strings.Contains(in.Body, "l") { // expect action (lock/unlock)
-		lock := strings.Split(msg, ":")[1]
-		if lock == "1" {
-			p.Lock = 1
-		} else if lock == "0" {
-			p.Lock = 0
+	} else if kind == "l" { // expect action (lock/unlock)
+		p.SetLock(arg == "1")
+		res = fmt.Sprintf("%+v", p.Status())
+	}
+	return &grpcapi.Message{Body: p.id.Seal(sender, res)}, nil
+}
+
+// whether sender may send a kind:arg message
+func (p *Peer) check(kind string, arg string, sender uint16) error {
+	switch kind {
+	case "t":
+		if _, err := strconv.Atoi(arg); err != nil {
+			return auth.ErrMalformed
+		}
+		if prev := p.Status().Prev; sender != prev {
+			return fmt.Errorf("%w: token from %d, previous peer is %d", auth.ErrForged, sender, prev)
+		}
+	case "l":
+		if arg != "0" && arg != "1" {
+			return auth.ErrMalformed
+		}
+		if sender != auth.Operator.Port {
+			return fmt.Errorf("%w: lock from %d", auth.ErrForged, sender)
 		}
-		res = fmt.Sprintf("%+v", p)
+	default:
+		return auth.ErrMalformed
 	}
-	return &grpcapi.Message{Body: res}, nil
+	return nil
+}
+
+// Status snapshot, taken under the peer lock
+func (p *Peer) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Status{Port: p.Port, Next: p.Next, Prev: p.Prev, Token: p.Token, Addr: p.Addr, TTL: p.TTL, Lock: p.Lock}
+}
+
+// SetLock locks (the token isn't taken) or unlocks the peer
+func (p *Peer) SetLock(locked bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Lock = 0
+	if locked {
+		p.Lock = 1
+	}
+}
+
+// SetNext peer in the ring
+func (p *Peer) SetNext(next uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Next = next
+}
+
+// SetPrev peer in the ring, the one the token comes from
+func (p *Peer) SetPrev(prev uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Prev = prev
 }
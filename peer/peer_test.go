@@ -1,18 +1,88 @@
 package peer
 
 import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
 	"testing"
+	"time"
+	"token-ring/auth"
+	grpcapi "token-ring/grpcapi"
+	"token-ring/rpc"
 )
 
+// peers talk over the in-memory transport, the test ports don't collide with other packages
+func TestMain(m *testing.M) {
+	rpc.SetTransport(rpc.NewMemTransport())
+	os.Exit(m.Run())
+}
+
 func TestSelfPeerPing(t *testing.T) {
 	p := NewPeer(4443, 4443, 1)
-	p.PeerShell()
+	time.Sleep(100 * time.Millisecond)
+	// the shell commands typed by a user, scripted
+	p.PeerShell(bufio.NewScanner(strings.NewReader("status\nunlock\nstatus\nexit\n")))
+	if p.Status().Lock != 0 {
+		t.Fatal("expected the peer to be unlocked")
+	}
 }
 
 func TestPeerPing(t *testing.T) {
 	p1 := NewPeer(4444, 4445, 0)
-	NewPeer(4445, 4446, 0)
-	NewPeer(4446, 4447, 0)
-	NewPeer(4447, 4444, 0)
+	p2 := NewPeer(4445, 4446, 0)
+	p3 := NewPeer(4446, 4447, 0)
+	p4 := NewPeer(4447, 4444, 0)
+	Ring(p1, p2, p3, p4)
+	p1.Bind()
+}
+
+// pings port with a sealed body
+func ping(port uint16, body string) error {
+	conn, err := rpc.Dial(int(port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = grpcapi.NewShellClient(conn).Ping(context.Background(), &grpcapi.Message{Body: body})
+	return err
+}
+
+func TestRingChecks(t *testing.T) {
+	p1 := NewPeer(4450, 4451, 0)
+	p2 := NewPeer(4451, 4452, 0)
+	p3 := NewPeer(4452, 4450, 0)
+	Ring(p1, p2, p3)
+	time.Sleep(100 * time.Millisecond)
+	rogue := auth.NewNode(4459, auth.Default)
+
+	for name, err := range map[string]error{
+		"token from a peer outside the ring": ping(p2.Port, rogue.Seal(p2.Port, "t:7")),
+		"token from the next peer":           ping(p2.Port, p3.id.Seal(p2.Port, "t:7")),
+		"lock from a peer":                   ping(p2.Port, p1.id.Seal(p2.Port, "l:1")),
+		"malformed token":                    ping(p2.Port, p1.id.Seal(p2.Port, "t:x")),
+		"malformed lock":                     ping(p2.Port, auth.Operator.Seal(p2.Port, "l:2")),
+		"unknown message":                    ping(p2.Port, p1.id.Seal(p2.Port, "x")),
+		"token sealed for another peer":      ping(p2.Port, p1.id.Seal(p3.Port, "t:7")),
+	} {
+		if err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if st := p2.Status(); st.Token != 0 || st.Lock != 0 || st.Prev != p1.Port {
+		t.Fatalf("%+v", st)
+	}
+
+	LockPeer(int(p3.Port), true)
+	p1.Bind()
+	if p2.Status().Token != 1 || p3.Status().Lock != 1 || p3.Status().Token != 0 {
+		t.Fatalf("%+v %+v", p2.Status(), p3.Status())
+	}
+
+	// a token in flight from a peer that left is rejected, the pass ends (the process goes on)
+	p2.SetPrev(p3.Port)
 	p1.Bind()
+	if p2.Status().Token != 1 {
+		t.Fatalf("%+v", p2.Status())
+	}
 }
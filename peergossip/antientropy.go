@@ -0,0 +1,239 @@
+package peergossip
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"token-ring/metrics"
+)
+
+// Anti-entropy: rumor mongering stops on a coin flip or counter (see Strategy), so a peer may never hear of a word.
+// Periodically each peer picks a random neighbour and reconciles rumor sets through digests
+// (rumor id hashes), which guarantees eventual convergence on a connected registry:
+//
+//	push      - fetch the neighbour digest, send the rumors it is missing
+//	pull      - send our digest, merge the rumors we are missing
+//	push-pull - pull, the reply also lists the hashes the neighbour is missing, which are pushed
+//
+// Control messages (see Peer.control):
+//
+//	ae-digest:                -> ["hash", ...]
+//	ae-pull:["hash", ...]     -> {"rumors": {"id": "word", ...}, "missing": ["hash", ...]}
+//	ae-push:{"id": "word"...} -> ""
+//
+// Digests above are flat (every hash is sent), set Peer.Reconcile to MerkleDigest to exchange
+// only differences (see merkle.go).
+
+type SyncMode int
+
+const (
+	Push SyncMode = iota
+	Pull
+	PushPull
+)
+
+var syncModes = []string{"push", "pull", "push-pull"}
+
+var synced = metrics.NewCounter("peergossip_synced_total", "Words learned through anti-entropy", "peer")
+var syncRounds = metrics.NewCounter("peergossip_sync_rounds_total", "Anti-entropy rounds started", "peer", "mode")
+
+type syncReply struct {
+	Rumors  map[string]string `json:"rumors"`
+	Missing []string          `json:"missing"`
+}
+
+func (m SyncMode) String() string {
+	if m < Push || m > PushPull {
+		return fmt.Sprintf("syncmode(%d)", int(m))
+	}
+	return syncModes[m]
+}
+
+func ParseSyncMode(s string) (SyncMode, error) {
+	for i, v := range syncModes {
+		if strings.EqualFold(s, v) {
+			return SyncMode(i), nil
+		}
+	}
+	return Push, fmt.Errorf("unknown sync mode %q (push, pull, push-pull)", s)
+}
+
+// StartAntiEntropy runs a round with a random neighbour every interval, until stop is called
+func (p *Peer) StartAntiEntropy(mode SyncMode, interval time.Duration) (stop func()) {
+	return p.Sched.Every(interval, func() {
+		registry := p.neighbours()
+		if len(registry) == 0 {
+			return
+		}
+		addr := registry[p.Rand.Intn(len(registry))]
+		if err := p.SyncWith(context.Background(), addr, mode); err != nil {
+			p.Log.Warn("anti-entropy failed", "peer", addr, "mode", mode.String(), "err", err)
+		}
+	})
+}
+
+// SyncWith runs a single anti-entropy round with addr
+func (p *Peer) SyncWith(ctx context.Context, addr uint16, mode SyncMode) error {
+	syncRounds.Inc(strconv.Itoa(int(p.Port)), mode.String())
+	if p.Reconcile == MerkleDigest {
+		return p.syncMerkle(ctx, addr, mode)
+	}
+	if mode == Push {
+		res, err := p.call(ctx, addr, "ae-digest", "")
+		if err != nil {
+			return err
+		}
+		hashes := make([]string, 0)
+		if err := json.Unmarshal([]byte(res), &hashes); err != nil {
+			return err
+		}
+		return p.push(ctx, addr, p.missing(hashes))
+	}
+
+	p.mu.Lock()
+	digest, err := json.Marshal(keys(p.digests()))
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	res, err := p.call(ctx, addr, "ae-pull", string(digest))
+	if err != nil {
+		return err
+	}
+	reply := syncReply{}
+	if err := json.Unmarshal([]byte(res), &reply); err != nil {
+		return err
+	}
+	p.merge(reply.Rumors, addr)
+	if mode == PushPull {
+		return p.push(ctx, addr, p.lookup(reply.Missing))
+	}
+	return nil
+}
+
+// handles ae-* control messages
+func (p *Peer) antiEntropy(kind string, payload string, sender uint16) (string, error) {
+	switch kind {
+	case "ae-digest":
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		b, err := json.Marshal(keys(p.digests()))
+		return string(b), err
+	case "ae-pull":
+		hashes := make([]string, 0)
+		if err := json.Unmarshal([]byte(payload), &hashes); err != nil {
+			return "", err
+		}
+		reply := syncReply{Rumors: p.missing(hashes), Missing: make([]string, 0)}
+		theirs := make(map[string]bool)
+		for _, h := range hashes {
+			theirs[h] = true
+		}
+		p.mu.Lock()
+		for h := range p.digests() {
+			delete(theirs, h)
+		}
+		p.mu.Unlock()
+		for h := range theirs {
+			reply.Missing = append(reply.Missing, h)
+		}
+		b, err := json.Marshal(reply)
+		return string(b), err
+	case "ae-push":
+		rumors := make(map[string]string)
+		if err := json.Unmarshal([]byte(payload), &rumors); err != nil {
+			return "", err
+		}
+		p.merge(rumors, sender)
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown anti-entropy message %q", kind)
+}
+
+func (p *Peer) push(ctx context.Context, addr uint16, rumors map[string]string) error {
+	if len(rumors) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(rumors)
+	if err != nil {
+		return err
+	}
+	_, err = p.call(ctx, addr, "ae-push", string(b))
+	return err
+}
+
+// rumors we know that are not in hashes
+func (p *Peer) missing(hashes []string) map[string]string {
+	theirs := make(map[string]bool)
+	for _, h := range hashes {
+		theirs[h] = true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make(map[string]string)
+	for h, id := range p.digests() {
+		if !theirs[h] {
+			res[id] = p.Words[id]
+		}
+	}
+	return res
+}
+
+// rumors we know in hashes
+func (p *Peer) lookup(hashes []string) map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	digests := p.digests()
+	res := make(map[string]string)
+	for _, h := range hashes {
+		if id, ok := digests[h]; ok {
+			res[id] = p.Words[id]
+		}
+	}
+	return res
+}
+
+// adds unknown rumors to Words (anti-entropy does not gossip them further)
+func (p *Peer) merge(rumors map[string]string, from uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, w := range rumors {
+		if _, ok := p.Words[id]; ok || p.deleted(id) || p.forgotten(id) {
+			continue
+		}
+		p.store(id, w)
+		p.Convergence.received(id, w, p.Port, false, p.Sched.Now())
+		synced.Inc(strconv.Itoa(int(p.Port)))
+		p.Log.Info("synced", "word", w, "id", id, "from", from)
+	}
+}
+
+// hash -> rumor id, for every rumor in Words that hasn't expired (p.mu must be held)
+func (p *Peer) digests() map[string]string {
+	p.seen.expire(p.Sched.Now())
+	res := make(map[string]string)
+	for id := range p.Words {
+		res[rumorDigest(id)] = id
+	}
+	return res
+}
+
+// aux
+
+func rumorDigest(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func keys(m map[string]string) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	return res
+}
@@ -0,0 +1,156 @@
+package peergossip
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Convergence records, for every rumor, when each peer first received it and how many duplicates
+// it saw. Peers sharing a Convergence (Peer.Convergence) report to it, Report summarizes coverage
+// over a set of peers, and the reports can be exported (CSV, a row per rumor and peer, or JSON)
+// for epidemic model analysis.
+type Convergence struct {
+	mu     sync.Mutex
+	rumors map[string]*rumorStats
+}
+
+type rumorStats struct {
+	word       string
+	origin     uint16
+	start      time.Time
+	first      map[uint16]time.Time
+	duplicates map[uint16]int
+}
+
+type RumorReport struct {
+	ID         string        `json:"id"`
+	Word       string        `json:"word"`
+	Origin     uint16        `json:"origin"`
+	Reached    int           `json:"reached"`
+	Peers      int           `json:"peers"`
+	Coverage   float64       `json:"coverage"`
+	Converged  time.Duration `json:"converged_ns"` // until the last reached peer first received it
+	Duplicates int           `json:"duplicates"`
+	PerPeer    []PeerReport  `json:"per_peer"`
+}
+
+type PeerReport struct {
+	Port       uint16        `json:"port"`
+	Received   bool          `json:"received"`
+	Delay      time.Duration `json:"delay_ns"` // since the rumor started
+	Duplicates int           `json:"duplicates"`
+}
+
+func NewConvergence() *Convergence {
+	return &Convergence{rumors: make(map[string]*rumorStats)}
+}
+
+// a peer started rumor id at now, on its clock (nil safe, like every recording method)
+func (c *Convergence) started(id string, word string, origin uint16, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.rumor(id, word, origin, now)
+	r.start = now
+	r.first[origin] = now
+}
+
+// peer received rumor id at now, new or duplicate
+func (c *Convergence) received(id string, word string, peer uint16, duplicate bool, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.rumor(id, word, 0, now)
+	if duplicate {
+		r.duplicates[peer] += 1
+		return
+	}
+	if _, ok := r.first[peer]; !ok {
+		r.first[peer] = now
+	}
+}
+
+// (c.mu must be held)
+func (c *Convergence) rumor(id string, word string, origin uint16, now time.Time) *rumorStats {
+	r, ok := c.rumors[id]
+	if !ok {
+		r = &rumorStats{word: word, origin: origin, start: now, first: make(map[uint16]time.Time), duplicates: make(map[uint16]int)}
+		c.rumors[id] = r
+	}
+	if origin != 0 {
+		r.origin = origin
+	}
+	return r
+}
+
+// Report summarizes every rumor over peers, in start order
+func (c *Convergence) Report(peers []uint16) []RumorReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make([]RumorReport, 0, len(c.rumors))
+	for id, r := range c.rumors {
+		rep := RumorReport{ID: id, Word: r.word, Origin: r.origin, Peers: len(peers), PerPeer: make([]PeerReport, 0, len(peers))}
+		for _, port := range peers {
+			pr := PeerReport{Port: port, Duplicates: r.duplicates[port]}
+			if t, ok := r.first[port]; ok {
+				pr.Received, pr.Delay = true, t.Sub(r.start)
+				rep.Reached += 1
+				if pr.Delay > rep.Converged {
+					rep.Converged = pr.Delay
+				}
+			}
+			rep.Duplicates += pr.Duplicates
+			rep.PerPeer = append(rep.PerPeer, pr)
+		}
+		if len(peers) > 0 {
+			rep.Coverage = float64(rep.Reached) / float64(len(peers))
+		}
+		res = append(res, rep)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		si, sj := c.rumors[res[i].ID].start, c.rumors[res[j].ID].start
+		return si.Before(sj) || (si.Equal(sj) && res[i].ID < res[j].ID)
+	})
+	return res
+}
+
+func (r RumorReport) String() string {
+	return fmt.Sprintf("rumor %s %q from %d: coverage %d/%d (%.0f%%), converged in %s, %d duplicates",
+		r.ID, r.Word, r.Origin, r.Reached, r.Peers, r.Coverage*100, r.Converged.Round(time.Millisecond), r.Duplicates)
+}
+
+// WriteCSV writes a row per rumor and peer (delays in milliseconds)
+func WriteCSV(w io.Writer, reports []RumorReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "word", "origin", "peer", "received", "delay_ms", "duplicates", "coverage", "converged_ms"})
+	for _, r := range reports {
+		for _, p := range r.PerPeer {
+			cw.Write([]string{
+				r.ID, r.Word, strconv.Itoa(int(r.Origin)), strconv.Itoa(int(p.Port)), strconv.FormatBool(p.Received),
+				ms(p.Delay), strconv.Itoa(p.Duplicates), strconv.FormatFloat(r.Coverage, 'f', 4, 64), ms(r.Converged),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func WriteJSON(w io.Writer, reports []RumorReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(reports)
+}
+
+func ms(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,331 @@
+package peergossip
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CRDTs replicated through gossip (delta-state): an update is applied to the local replica and its
+// delta, itself a state of the same type, is gossiped as a rumor
+//
+//	crdt:<name>:<type>:<json delta>
+//
+// Every peer that stores the rumor (gossip, plumtree or anti-entropy) merges the delta into its
+// replica of name. Merges are idempotent, commutative and associative, so duplicates, reordering
+// and late anti-entropy deliveries all converge to the same value.
+//
+//	gset       grow-only set
+//	orset      observed-remove set, add wins over concurrent removes (removes tag tombstones)
+//	lww        last-writer-wins register (timestamp, then port on ties)
+//	pncounter  increments and decrements per peer
+
+const crdtPrefix = "crdt:"
+
+type CRDT interface {
+	Type() string
+	// joins other (same type) into the state
+	Merge(other CRDT)
+	Value() interface{}
+}
+
+type GSet struct {
+	Elems map[string]bool `json:"elems"`
+}
+
+type ORSet struct {
+	Adds    map[string]map[string]bool `json:"adds"`    // element -> add tags
+	Removed map[string]bool            `json:"removed"` // tombstones: tags observed by a remove
+}
+
+type LWWRegister struct {
+	Val  string `json:"value"`
+	Time int64  `json:"time"` // unix nano
+	Port uint16 `json:"port"`
+}
+
+type PNCounter struct {
+	P map[uint16]int64 `json:"p"`
+	N map[uint16]int64 `json:"n"`
+}
+
+func NewGSet() *GSet {
+	return &GSet{Elems: make(map[string]bool)}
+}
+
+func NewORSet() *ORSet {
+	return &ORSet{Adds: make(map[string]map[string]bool), Removed: make(map[string]bool)}
+}
+
+func NewPNCounter() *PNCounter {
+	return &PNCounter{P: make(map[uint16]int64), N: make(map[uint16]int64)}
+}
+
+// empty state of typ
+func newCRDT(typ string) (CRDT, error) {
+	switch typ {
+	case "gset":
+		return NewGSet(), nil
+	case "orset":
+		return NewORSet(), nil
+	case "lww":
+		return &LWWRegister{}, nil
+	case "pncounter":
+		return NewPNCounter(), nil
+	}
+	return nil, fmt.Errorf("unknown crdt type %q", typ)
+}
+
+// G-Set
+
+func (s *GSet) Type() string { return "gset" }
+
+// Add returns the delta adding e
+func (s *GSet) Add(e string) *GSet {
+	return &GSet{Elems: map[string]bool{e: true}}
+}
+
+func (s *GSet) Merge(other CRDT) {
+	for e := range other.(*GSet).Elems {
+		s.Elems[e] = true
+	}
+}
+
+func (s *GSet) Value() interface{} {
+	return sortedKeys(s.Elems)
+}
+
+// OR-Set
+
+func (s *ORSet) Type() string { return "orset" }
+
+// Add returns the delta adding e with a unique tag
+func (s *ORSet) Add(e string, tag string) *ORSet {
+	d := NewORSet()
+	d.Adds[e] = map[string]bool{tag: true}
+	return d
+}
+
+// Remove returns the delta removing e as observed (adds not seen yet survive)
+func (s *ORSet) Remove(e string) *ORSet {
+	d := NewORSet()
+	for tag := range s.Adds[e] {
+		d.Removed[tag] = true
+	}
+	return d
+}
+
+func (s *ORSet) Merge(other CRDT) {
+	o := other.(*ORSet)
+	for e, tags := range o.Adds {
+		if s.Adds[e] == nil {
+			s.Adds[e] = make(map[string]bool)
+		}
+		for tag := range tags {
+			s.Adds[e][tag] = true
+		}
+	}
+	for tag := range o.Removed {
+		s.Removed[tag] = true
+	}
+}
+
+func (s *ORSet) Contains(e string) bool {
+	for tag := range s.Adds[e] {
+		if !s.Removed[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ORSet) Value() interface{} {
+	res := make([]string, 0)
+	for e := range s.Adds {
+		if s.Contains(e) {
+			res = append(res, e)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// LWW-register
+
+func (r *LWWRegister) Type() string { return "lww" }
+
+// Set returns the delta writing v at t by port
+func (r *LWWRegister) Set(v string, t time.Time, port uint16) *LWWRegister {
+	return &LWWRegister{Val: v, Time: t.UnixNano(), Port: port}
+}
+
+func (r *LWWRegister) Merge(other CRDT) {
+	o := other.(*LWWRegister)
+	if o.Time > r.Time || (o.Time == r.Time && o.Port > r.Port) {
+		*r = *o
+	}
+}
+
+func (r *LWWRegister) Value() interface{} {
+	return r.Val
+}
+
+// PN-counter
+
+func (c *PNCounter) Type() string { return "pncounter" }
+
+// Add returns the delta adding n (negative to decrement) by port
+func (c *PNCounter) Add(n int64, port uint16) *PNCounter {
+	d := NewPNCounter()
+	if n >= 0 {
+		d.P[port] = c.P[port] + n
+	} else {
+		d.N[port] = c.N[port] - n
+	}
+	return d
+}
+
+func (c *PNCounter) Merge(other CRDT) {
+	o := other.(*PNCounter)
+	for port, v := range o.P {
+		if v > c.P[port] {
+			c.P[port] = v
+		}
+	}
+	for port, v := range o.N {
+		if v > c.N[port] {
+			c.N[port] = v
+		}
+	}
+}
+
+func (c *PNCounter) Value() interface{} {
+	var v int64
+	for _, n := range c.P {
+		v += n
+	}
+	for _, n := range c.N {
+		v -= n
+	}
+	return v
+}
+
+// peer API: updates apply locally and gossip the delta
+
+func (p *Peer) GSetAdd(name string, e string) error {
+	return p.update(name, "gset", func(c CRDT) CRDT { return c.(*GSet).Add(e) })
+}
+
+func (p *Peer) ORSetAdd(name string, e string) error {
+	return p.update(name, "orset", func(c CRDT) CRDT {
+		p.seq += 1
+		return c.(*ORSet).Add(e, fmt.Sprintf("%d-%d", p.Port, p.seq))
+	})
+}
+
+func (p *Peer) ORSetRemove(name string, e string) error {
+	return p.update(name, "orset", func(c CRDT) CRDT { return c.(*ORSet).Remove(e) })
+}
+
+func (p *Peer) LWWSet(name string, v string) error {
+	return p.update(name, "lww", func(c CRDT) CRDT { return c.(*LWWRegister).Set(v, p.Sched.Now(), p.Port) })
+}
+
+func (p *Peer) CounterAdd(name string, n int64) error {
+	return p.update(name, "pncounter", func(c CRDT) CRDT { return c.(*PNCounter).Add(n, p.Port) })
+}
+
+// Value of the local replica of name (nil if unknown)
+func (p *Peer) Value(name string) interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.crdts[name]; ok {
+		return c.Value()
+	}
+	return nil
+}
+
+// CRDTs values by name
+func (p *Peer) CRDTs() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make(map[string]interface{})
+	for name, c := range p.crdts {
+		res[name] = c.Value()
+	}
+	return res
+}
+
+// applies the delta made by op to the replica of name (created empty) and gossips it
+func (p *Peer) update(name string, typ string, op func(CRDT) CRDT) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("invalid crdt name %q", name)
+	}
+	p.mu.Lock()
+	c, err := p.replica(name, typ)
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	delta := op(c)
+	c.Merge(delta)
+	p.mu.Unlock()
+
+	b, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	p.Gossip(fmt.Sprintf("%s%s:%s:%s", crdtPrefix, name, typ, b), p.Port)
+	return nil
+}
+
+// replica of name, created if unknown (p.mu must be held)
+func (p *Peer) replica(name string, typ string) (CRDT, error) {
+	if c, ok := p.crdts[name]; ok {
+		if c.Type() != typ {
+			return nil, fmt.Errorf("crdt %q is a %s, not a %s", name, c.Type(), typ)
+		}
+		return c, nil
+	}
+	c, err := newCRDT(typ)
+	if err != nil {
+		return nil, err
+	}
+	p.crdts[name] = c
+	return c, nil
+}
+
+// merges a crdt rumor into its replica (p.mu must be held)
+func (p *Peer) applyCRDT(word string) error {
+	split := strings.SplitN(strings.TrimPrefix(word, crdtPrefix), ":", 3)
+	if len(split) != 3 {
+		return fmt.Errorf("malformed crdt rumor %q", word)
+	}
+	name, typ := split[0], split[1]
+	delta, err := newCRDT(typ)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(split[2]), delta); err != nil {
+		return err
+	}
+	c, err := p.replica(name, typ)
+	if err != nil {
+		return err
+	}
+	c.Merge(delta)
+	return nil
+}
+
+// aux
+
+func sortedKeys(m map[string]bool) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
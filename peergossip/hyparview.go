@@ -0,0 +1,65 @@
+package peergossip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+	"token-ring/common"
+	"token-ring/hyparview"
+)
+
+// HyParView transport: view messages are "hv:<json message>" control messages, handled
+// asynchronously (a view message may trigger others, ex: random walks).
+
+// timeout of a view message, an unreachable node is replaced
+const hyParViewTimeout = time.Second
+
+// StartHyParView makes the active view of a HyParView overlay the gossip targets (instead of
+// Registry), joining through contact (0 - first node). Shuffles every cfg.ShufflePeriod until stop is called.
+func (p *Peer) StartHyParView(cfg hyparview.Config, contact uint16) (stop func()) {
+	hv := hyparview.New(p.Port, cfg, func(to uint16, m hyparview.Message) error {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), hyParViewTimeout)
+		defer cancel()
+		_, err = p.call(ctx, to, "hv", string(b))
+		return err
+	})
+	hv.Sched, hv.Rand = p.Sched, common.NewRand(p.Rand.Int63())
+	p.mu.Lock()
+	p.HyParView = hv
+	p.mu.Unlock()
+	if contact != 0 {
+		hv.Join(contact)
+	}
+	stopShuffle := hv.Start()
+	return func() {
+		stopShuffle()
+		p.mu.Lock()
+		p.HyParView = nil
+		p.mu.Unlock()
+	}
+}
+
+func (p *Peer) view() *hyparview.View {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.HyParView
+}
+
+// handles hv control messages
+func (p *Peer) hyParViewControl(payload string, sender uint16) (string, error) {
+	hv := p.view()
+	if hv == nil {
+		return "", fmt.Errorf("hyparview is not running")
+	}
+	m := hyparview.Message{}
+	if err := json.Unmarshal([]byte(payload), &m); err != nil {
+		return "", err
+	}
+	p.Sched.Go(func() { hv.Handle(sender, m) })
+	return "", nil
+}
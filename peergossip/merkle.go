@@ -0,0 +1,224 @@
+package peergossip
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Merkle reconciliation: flat digests cost O(set size) bytes per round even when the sets only
+// differ by a few rumors. Rumor digests (hex) are arranged in a 16-ary prefix tree, a node hashes the
+// digests under its prefix. Peers compare a level per call and only descend into the subtrees
+// whose hashes differ, so a round costs O(differences * depth) instead:
+//
+//	mk-diff:[{"prefix": "", "hash": "..."}, ...]  -> [{"prefix": "", "children": {"0": "...", ...}} or {"prefix": "", "leaf": ["hash", ...]}, ...]
+//	mk-get:["hash", ...]                           -> {"id": "word", ...}
+//
+// Subtrees with at most leafSize digests are sent as a list instead of being split further.
+
+// how anti-entropy finds the differences between two rumor sets
+type Reconciliation int
+
+const (
+	FlatDigest Reconciliation = iota
+	MerkleDigest
+)
+
+var reconciliations = []string{"flat", "merkle"}
+
+const leafSize = 16
+
+type Merkle struct {
+	digests []string // sorted
+}
+
+type merkleQuery struct {
+	Prefix string `json:"prefix"`
+	Hash   string `json:"hash"`
+}
+
+type merkleReply struct {
+	Prefix   string            `json:"prefix"`
+	Children map[string]string `json:"children,omitempty"`
+	Leaf     []string          `json:"leaf,omitempty"`
+}
+
+func (r Reconciliation) String() string {
+	if r < FlatDigest || r > MerkleDigest {
+		return fmt.Sprintf("reconciliation(%d)", int(r))
+	}
+	return reconciliations[r]
+}
+
+func ParseReconciliation(s string) (Reconciliation, error) {
+	for i, v := range reconciliations {
+		if strings.EqualFold(s, v) {
+			return Reconciliation(i), nil
+		}
+	}
+	return FlatDigest, fmt.Errorf("unknown reconciliation %q (flat, merkle)", s)
+}
+
+func NewMerkle(digests []string) *Merkle {
+	m := &Merkle{digests: append([]string{}, digests...)}
+	sort.Strings(m.digests)
+	return m
+}
+
+// Hash of the subtree at prefix ("" if empty)
+func (m *Merkle) Hash(prefix string) string {
+	span := m.span(prefix)
+	if len(span) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(span, "")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// answers a level of queries, subtrees with equal hashes are skipped
+func (m *Merkle) diff(queries []merkleQuery) []merkleReply {
+	res := make([]merkleReply, 0)
+	for _, q := range queries {
+		if m.Hash(q.Prefix) == q.Hash {
+			continue
+		}
+		span := m.span(q.Prefix)
+		if len(span) <= leafSize {
+			res = append(res, merkleReply{Prefix: q.Prefix, Leaf: append([]string{}, span...)})
+			continue
+		}
+		children := make(map[string]string)
+		for _, c := range "0123456789abcdef" {
+			if h := m.Hash(q.Prefix + string(c)); h != "" {
+				children[string(c)] = h
+			}
+		}
+		res = append(res, merkleReply{Prefix: q.Prefix, Children: children})
+	}
+	return res
+}
+
+// digests under prefix
+func (m *Merkle) span(prefix string) []string {
+	i := sort.SearchStrings(m.digests, prefix)
+	j := i
+	for j < len(m.digests) && strings.HasPrefix(m.digests[j], prefix) {
+		j++
+	}
+	return m.digests[i:j]
+}
+
+// reconcile walks the remote tree through ask (one call per level) and returns the digests
+// missing locally and the ones missing remotely
+func (m *Merkle) reconcile(ask func([]merkleQuery) ([]merkleReply, error)) ([]string, []string, error) {
+	missing, theirsLack := make([]string, 0), make([]string, 0)
+	queries := []merkleQuery{{Prefix: "", Hash: m.Hash("")}}
+	for len(queries) > 0 {
+		replies, err := ask(queries)
+		if err != nil {
+			return nil, nil, err
+		}
+		queries = make([]merkleQuery, 0)
+		for _, r := range replies {
+			if r.Children == nil {
+				theirs := make(map[string]bool)
+				for _, d := range r.Leaf {
+					theirs[d] = true
+				}
+				for _, d := range m.span(r.Prefix) {
+					if !theirs[d] {
+						theirsLack = append(theirsLack, d)
+					}
+					delete(theirs, d)
+				}
+				for d := range theirs {
+					missing = append(missing, d)
+				}
+				continue
+			}
+			for _, c := range "0123456789abcdef" {
+				prefix := r.Prefix + string(c)
+				ours, theirs := m.Hash(prefix), r.Children[string(c)]
+				switch {
+				case ours == theirs:
+				case theirs == "":
+					theirsLack = append(theirsLack, m.span(prefix)...)
+				default:
+					queries = append(queries, merkleQuery{Prefix: prefix, Hash: ours})
+				}
+			}
+		}
+	}
+	return missing, theirsLack, nil
+}
+
+// Merkle round of SyncWith
+func (p *Peer) syncMerkle(ctx context.Context, addr uint16, mode SyncMode) error {
+	p.mu.Lock()
+	m := NewMerkle(keys(p.digests()))
+	p.mu.Unlock()
+
+	missing, theirsLack, err := m.reconcile(func(queries []merkleQuery) ([]merkleReply, error) {
+		b, err := json.Marshal(queries)
+		if err != nil {
+			return nil, err
+		}
+		res, err := p.call(ctx, addr, "mk-diff", string(b))
+		if err != nil {
+			return nil, err
+		}
+		replies := make([]merkleReply, 0)
+		return replies, json.Unmarshal([]byte(res), &replies)
+	})
+	if err != nil {
+		return err
+	}
+
+	if mode != Push && len(missing) > 0 {
+		b, err := json.Marshal(missing)
+		if err != nil {
+			return err
+		}
+		res, err := p.call(ctx, addr, "mk-get", string(b))
+		if err != nil {
+			return err
+		}
+		got := make(map[string]string)
+		if err := json.Unmarshal([]byte(res), &got); err != nil {
+			return err
+		}
+		p.merge(got, addr)
+	}
+	if mode != Pull {
+		return p.push(ctx, addr, p.lookup(theirsLack))
+	}
+	return nil
+}
+
+// handles mk-* control messages
+func (p *Peer) merkle(kind string, payload string) (string, error) {
+	switch kind {
+	case "mk-diff":
+		p.mu.Lock()
+		m := NewMerkle(keys(p.digests()))
+		p.mu.Unlock()
+		queries := make([]merkleQuery, 0)
+		if err := json.Unmarshal([]byte(payload), &queries); err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(m.diff(queries))
+		return string(b), err
+	case "mk-get":
+		hashes := make([]string, 0)
+		if err := json.Unmarshal([]byte(payload), &hashes); err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(p.lookup(hashes))
+		return string(b), err
+	}
+	return "", fmt.Errorf("unknown merkle message %q", kind)
+}
@@ -8,177 +8,575 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"token-ring/auth"
 	"token-ring/common"
 	grpcapi "token-ring/grpcapi"
-
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"token-ring/hyparview"
+	"token-ring/logging"
+	"token-ring/metrics"
+	"token-ring/rpc"
 )
 
-const K = 5
 const SAMPLES = 25 // 100
 
+// events of the word process, 1 every 30s on average (set before NewPeer)
+var DefaultEvents = common.EventConfig{Dist: common.Poisson, Rate: 1.0 / 30}
+
+// seen-cache: rumor ids remembered for duplicate detection, their payloads (Words) are dropped
+// with them so gossip state stays bounded
+const SEEN_SIZE = 4096
+const SEEN_TTL = 10 * time.Minute
+
+var sent = metrics.NewCounter("peergossip_sent_total", "Gossip messages sent to neighbours", "peer")
+var duplicates = metrics.NewCounter("peergossip_duplicates_total", "Gossip messages received for an already known word", "peer")
+var stopped = metrics.NewCounter("peergossip_stopped_total", "Rumors a peer stopped gossiping (see Strategy.Stop)", "peer")
+var hopLimited = metrics.NewCounter("peergossip_hop_limited_total", "Rumors not forwarded because they reached Strategy.MaxHops", "peer")
+var controlBytes = metrics.NewCounter("peergossip_control_bytes_total", "Control message bytes sent and received (request and reply payloads)", "peer", "kind")
+var known = metrics.NewGauge("peergossip_known_words", "Rumors (words) known by a peer (converged once equal across peers)", "peer")
+var seenSize = metrics.NewGauge("peergossip_seen_cache_size", "Rumor ids in the duplicate detection cache", "peer")
+
 type Peer struct {
 	Port     uint16   `json:"port"`
 	Registry []uint16 `json:"registry"`
-	WordList []string `json:"wordlist"`
 	Addr     net.IP   `json:"addr"`
+	// rumors by id ("<origin port>-<seq>"), the same word gossiped twice is two rumors, kept
+	// while their id is in the seen-cache
+	Words map[string]string `json:"words"`
+	// structured logger, carries the peer port (replace to inject another)
+	Log *logging.Logger `json:"-"`
+	// keypair, every message is sealed (signed) by its sender
+	id *auth.Node
+	// guards Registry, Words and seen (grpc handlers, word events and anti-entropy run concurrently)
+	mu   sync.Mutex
+	seen *seenCache
+	// ids dropped from seen, late copies (gossip or anti-entropy) are ignored for SEEN_TTL
+	expired *seenCache
+	seq     uint64
+	// how anti-entropy rounds started by this peer find differences (see merkle.go)
+	Reconcile Reconciliation `json:"-"`
+	// fanout, hop limit and stop rule used to spread rumors (see strategy.go)
+	Strategy Strategy `json:"-"`
+	// membership protocol state, nil unless StartSWIM (see swim.go)
+	sw *swim
+	// flood (default) or plumtree (see plumtree.go)
+	Broadcast BroadcastMode `json:"-"`
+	pt        *plumtree
+	// peer sampling, gossip targets are its active view instead of Registry (see StartHyParView)
+	HyParView *hyparview.View `json:"hyparview,omitempty"`
+	// replicated data types, merged from crdt rumors (see crdt.go)
+	crdts map[string]CRDT
+	// deleted rumor ids, and the ones collected recently (see tombstone.go)
+	tombs  map[string]*tombstone
+	buried *seenCache
+	// topic subscriptions (see pubsub.go)
+	subs map[string][]chan Msg
+	// words gossiped by PoissonWordProcess (see source.go)
+	Source    Source `json:"-"`
+	stopWords func()
+	// receive times and duplicates per rumor, shared by a pool (nil - off, see convergence.go)
+	Convergence *Convergence `json:"-"`
+	// timers and clock (a virtual scheduler runs the peer in virtual time, see sim), and the
+	// random choices (gossip targets, stop coins, words), seeded by the port unless given
+	Sched *common.Scheduler `json:"-"`
+	Rand  *mrand.Rand       `json:"-"`
 	grpcapi.UnimplementedShellServer
 }
 
+// Status snapshot of a peer
+type Status struct {
+	Port      uint16            `json:"port"`
+	Registry  []uint16          `json:"registry"`
+	Addr      net.IP            `json:"addr"`
+	Words     map[string]string `json:"words"`
+	HyParView *hyparview.View   `json:"hyparview,omitempty"`
+}
+
 func NewPeer(port uint16) *Peer {
+	return NewPeerWith(port, Options{})
+}
+
+// Options of NewPeerWith, in place before the peer listens and its word events start (zero
+// fields take the NewPeer defaults)
+type Options struct {
+	// timers and clock, random choices (default scheduler, seeded by the port)
+	Sched *common.Scheduler
+	Rand  *mrand.Rand
+	Log   *logging.Logger
+	// Stop defaults to the DefaultStrategy one
+	Strategy    Strategy
+	Broadcast   BroadcastMode
+	Convergence *Convergence
+	// words of the word process (English)
+	Source Source
+	// no word process, words come from WordEvents (or Gossip)
+	NoWords bool
+}
+
+func NewPeerWith(port uint16, opts Options) *Peer {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer conn.Close()
 
+	if opts.Sched == nil {
+		opts.Sched = common.DefaultScheduler()
+	}
+	if opts.Rand == nil {
+		opts.Rand = common.NewRand(int64(port))
+	}
+	if opts.Log == nil {
+		opts.Log = logging.Default.With("module", "peergossip", "port", port)
+	}
+	if opts.Strategy.Stop == nil {
+		opts.Strategy.Stop = DefaultStrategy.Stop
+	}
+	if opts.Source == nil {
+		if opts.Source, err = Language("en"); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	p := &Peer{
-		Port:     port,
-		Registry: make([]uint16, 0),
-		WordList: make([]string, 0),
-		Addr:     conn.LocalAddr().(*net.UDPAddr).IP,
+		Port:        port,
+		Registry:    make([]uint16, 0),
+		Addr:        conn.LocalAddr().(*net.UDPAddr).IP,
+		Words:       make(map[string]string),
+		Log:         opts.Log,
+		id:          auth.NewNode(port, auth.Default),
+		seen:        newSeenCache(SEEN_SIZE, SEEN_TTL),
+		expired:     newSeenCache(SEEN_SIZE, SEEN_TTL),
+		Strategy:    opts.Strategy,
+		Broadcast:   opts.Broadcast,
+		pt:          newPlumtree(),
+		crdts:       make(map[string]CRDT),
+		tombs:       make(map[string]*tombstone),
+		subs:        make(map[string][]chan Msg),
+		Source:      opts.Source,
+		Convergence: opts.Convergence,
+		Sched:       opts.Sched,
+		Rand:        opts.Rand,
+		// starts at the current time so ids of a restarted peer aren't taken for old rumors
+		seq: uint64(opts.Sched.Now().UnixNano()),
 	}
+	p.seen.evict = p.forget
 	go Listen(p)
-	go p.PoissonWordProcess(SAMPLES)
+	if !opts.NoWords {
+		p.PoissonWordProcess(SAMPLES)
+	}
 	return p
 }
 
 func Listen(p *Peer) {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", p.Port))
+	l, err := rpc.Listen(p.Port)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	grpcs := grpc.NewServer()
+	grpcs := rpc.NewServer(p.Port)
 	grpcapi.RegisterShellServer(grpcs, p)
 	if err := grpcs.Serve(l); err != nil {
 		log.Fatalln(err)
 	}
 }
 
-// frequency of 1 event each 30 seconds
+// gossips a word (from Source) on each of samples events of DefaultEvents, seeded by the port
 func (p *Peer) PoissonWordProcess(samples uint) {
-	var ut float64
-	timestamps := make([]float64, 0)
-	i := 1
-
-	// set seed
-	mrand.Seed(int64(p.Port))
-
-	// gen event timestamps, cast abstract time to sec (60s -- 1min ; λ = 2 ; 2 evs per 60s <=> 1ev per 30s)
-	for i < int(samples) {
-		ut += common.PoissonProcessTimeToNextEvent()
-		timestamps = append(timestamps, ut*60)
-		i += 1
-	}
-
-	// orchestrate events
-	i = 0
-	start := time.Now()
-	for i < len(timestamps) {
-		v := timestamps[i]
-		if time.Since(start).Seconds() >= v {
-			lines := common.GetLines("engmix.txt")
-			wdi := mrand.Intn(len(lines))
-			wd := lines[wdi]
-
-			p.WordList = append(p.WordList, wd)
-			go p.Gossip(wd, p.Port)
-			i += 1
-		} else {
-			evtime := start.Add(time.Duration(v))
-			time.Sleep(time.Since(evtime))
+	cfg := DefaultEvents
+	cfg.Count = int(samples)
+	cfg.Seed += int64(p.Port)
+	p.WordEvents(cfg)
+}
+
+// WordEvents gossips a word (from Source) on every event of cfg, timed by Sched, until StopWords
+func (p *Peer) WordEvents(cfg common.EventConfig) {
+	stop := p.Sched.Each(cfg, func(e common.Event) {
+		if wd, ok := p.Source.Next(p.Rand); ok {
+			p.Sched.Go(func() { p.Gossip(wd, p.Port) })
 		}
+	})
+	p.mu.Lock()
+	p.stopWords = stop
+	p.mu.Unlock()
+}
+
+// StopWords cancels the pending events of PoissonWordProcess (or WordEvents)
+func (p *Peer) StopWords() {
+	p.mu.Lock()
+	stop := p.stopWords
+	p.mu.Unlock()
+	if stop != nil {
+		stop()
 	}
 }
 
 // Register peer (add addr to Registry)
 func (p *Peer) Register(regaddr int) {
-	var conn *grpc.ClientConn
-	conn, err := grpc.Dial(fmt.Sprintf(":%d", regaddr), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := rpc.Dial(regaddr)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer conn.Close()
 
 	g := grpcapi.NewShellClient(conn)
-	res, err := g.Ping(context.Background(), &grpcapi.Message{Body: fmt.Sprintf("%d", p.Port)})
+	res, err := g.Ping(context.Background(), &grpcapi.Message{Body: p.id.Seal(uint16(regaddr), fmt.Sprintf("%d", p.Port))})
 	if err != nil {
 		log.Fatalf("error calling grpc call: %s\n", err)
 	}
 
-	pport, err := strconv.Atoi(res.Body)
+	body, sender, err := auth.Default.Open(p.Port, res.Body)
 	if err != nil {
-		log.Fatalln(err)
+		p.Log.Warn("rejected reply", "peer", regaddr, "err", err)
+		return
+	}
+	pport, err := strconv.Atoi(body)
+	if err != nil {
+		p.Log.Warn("rejected reply", "peer", regaddr, "sender", sender, "err", auth.ErrMalformed)
+		return
+	}
+	if sender != uint16(pport) {
+		p.Log.Warn("rejected reply", "peer", regaddr, "sender", sender, "err", auth.ErrForged)
+		return
 	}
+	p.mu.Lock()
 	p.Registry = append(p.Registry, uint16(pport))
-	fmt.Printf("\t[%d] Ping Peer %d\n", p.Port, pport)
+	p.mu.Unlock()
+	p.Log.Info("registered", "peer", pport)
 }
 
-// gossipeer is the peer that "originaly" gossiped the word.
+// Gossip starts a new rumor with word, gossipeer is the peer that "originaly" gossiped the word
+// (not sent back to it).
 func (p *Peer) Gossip(word string, gossipeer uint16) {
-	for _, peer := range p.Registry {
-		if peer != gossipeer {
-			fmt.Printf("\t[%d] Gossiping %s to %d\n", p.Port, word, peer)
-			var conn *grpc.ClientConn
-			conn, err := grpc.Dial(fmt.Sprintf(":%d", peer), grpc.WithTransportCredentials(insecure.NewCredentials()))
-			if err != nil {
-				log.Fatalln(err)
-			}
-			defer conn.Close()
+	p.mu.Lock()
+	p.seq += 1
+	id := fmt.Sprintf("%d-%d", p.Port, p.seq)
+	now := p.Sched.Now()
+	p.seen.add(id, now)
+	p.store(id, word)
+	broadcast := p.Broadcast
+	p.mu.Unlock()
+	p.Convergence.started(id, word, p.Port, now)
+	if broadcast == Plumtree {
+		p.plumtreeBroadcast(context.Background(), id, word, 0, gossipeer)
+		return
+	}
+	p.gossip(context.Background(), id, word, 0, gossipeer)
+}
 
-			g := grpcapi.NewShellClient(conn)
-			_, err = g.Word(context.Background(), &grpcapi.Message{Body: fmt.Sprintf("%s:%d", word, p.Port)})
-			if err != nil {
-				log.Fatalf("error calling grpc call: %s\n", err)
+// forwards a rumor that travelled hops, rounds until the peer loses interest with feedback (see Strategy):
+// duplicates and failed sends (a peer that can't be told) count toward Stop, MaxRounds bounds the rounds.
+// ctx carries the trace of the Word call being forwarded (see rpc.Detach)
+func (p *Peer) gossip(ctx context.Context, id string, word string, hops int, gossipeer uint16) {
+	s := p.Strategy
+	if !s.forwards(hops) {
+		hopLimited.Inc(strconv.Itoa(int(p.Port)))
+		p.Log.Info("hop limit reached, stopping gossiping", "word", word, "id", id, "hops", hops)
+		return
+	}
+	dups := 0
+	for round := 1; ; round++ {
+		targets := s.targets(p.Rand, p.neighbours(), gossipeer)
+		if len(targets) == 0 {
+			return
+		}
+		for _, peer := range targets {
+			known, err := p.send(ctx, peer, id, word, hops+1)
+			if !s.Feedback || (err == nil && !known) {
+				continue
 			}
+			dups += 1
+			if s.Stop.Stop(dups, p.Rand) {
+				stopped.Inc(strconv.Itoa(int(p.Port)))
+				p.Log.Info("rumor known, stopping gossiping", "word", word, "id", id, "to", peer)
+				return
+			}
+		}
+		if !s.Feedback {
+			return
+		}
+		if !s.another(round) {
+			stopped.Inc(strconv.Itoa(int(p.Port)))
+			p.Log.Info("max rounds reached, stopping gossiping", "word", word, "id", id, "rounds", round)
+			return
 		}
 	}
 }
 
+// sends a rumor to peer, returns whether peer already knew it (feedback strategies)
+func (p *Peer) send(ctx context.Context, peer uint16, id string, word string, hops int) (bool, error) {
+	p.Log.Info("gossiping", "word", word, "id", id, "hops", hops, "to", peer)
+	conn, err := rpc.Dial(int(peer))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close()
+
+	g := grpcapi.NewShellClient(conn)
+	updates := ""
+	if sw := p.swim(); sw != nil {
+		updates = encodeUpdates(sw.piggyback())
+	}
+	res, err := g.Word(ctx, &grpcapi.Message{Body: p.id.Seal(peer, fmt.Sprintf("%s:%d:%d:%s:%s", id, p.Port, hops, updates, word))})
+	if err != nil {
+		// failed peers are detected (SWIM) or replaced (HyParView) by the membership layer
+		p.Log.Warn("gossip failed", "to", peer, "err", err)
+		if hv := p.view(); hv != nil {
+			hv.Failed(peer)
+		}
+		return false, err
+	}
+	sent.Inc(strconv.Itoa(int(p.Port)))
+	if !p.Strategy.Feedback {
+		return false, nil
+	}
+	body, sender, err := auth.Default.Open(p.Port, res.Body)
+	if err == nil && sender != peer {
+		err = auth.ErrForged
+	}
+	if err != nil {
+		p.Log.Warn("rejected reply", "peer", peer, "sender", sender, "err", err)
+		return false, err
+	}
+	return body == "known", nil
+}
+
 // grpc calls
 
-// Ping - discovery
+// Ping - discovery (bodies are sealed, the registered port must be the sender's, see auth)
 func (p *Peer) Ping(ctx context.Context, in *grpcapi.Message) (*grpcapi.Message, error) {
-	addr, err := strconv.Atoi(in.Body)
+	body, sender, err := auth.Default.Open(p.Port, in.Body)
 	if err != nil {
-		log.Fatalln(err)
+		p.Log.Warn("rejected", "sender", sender, "err", err)
+		return nil, auth.Reject(err)
+	}
+	if kind, payload, ok := strings.Cut(body, ":"); ok {
+		res, err := p.control(ctx, kind, payload, sender)
+		if err != nil {
+			p.Log.Warn("control failed", "kind", kind, "sender", sender, "err", err)
+			return nil, err
+		}
+		return &grpcapi.Message{Body: p.id.Seal(sender, res)}, nil
+	}
+	addr, err := strconv.Atoi(body)
+	if err != nil {
+		p.Log.Warn("rejected", "sender", sender, "err", auth.ErrMalformed)
+		return nil, auth.Reject(auth.ErrMalformed)
+	}
+	if sender != uint16(addr) {
+		p.Log.Warn("rejected", "sender", sender, "claimed", addr, "err", auth.ErrForged)
+		return nil, auth.Reject(auth.ErrForged)
 	}
 
+	p.mu.Lock()
 	p.Registry = append(p.Registry, uint16(addr))
-	fmt.Printf("\t[%d] Ping from %d\n", p.Port, addr)
-	return &grpcapi.Message{Body: fmt.Sprintf("%d", p.Port)}, nil
+	p.mu.Unlock()
+	p.Log.Info("ping", "from", addr)
+	return &grpcapi.Message{Body: p.id.Seal(sender, fmt.Sprintf("%d", p.Port))}, nil
 }
 
-// grpc implementation of Word grpc call: adds word to list and gossips word if new or if random prob >= 1/K
+// grpc implementation of Word grpc call ("<rumor id>:<forwarding port>:<hops>:<swim updates>:<word>"): adds the
+// rumor to Words and gossips it if new (id not seen before), blind strategies also gossip duplicates until
+// Strategy.Stop. Replies "known" or "new" (feedback strategies)
+// (bodies are sealed, the forwarding port must be the sender's, see auth)
 func (p *Peer) Word(ctx context.Context, in *grpcapi.Message) (*grpcapi.Message, error) {
-	split := strings.Split(in.Body, ":")
-	fmt.Printf("\t[%d] Received %s from %s\n", p.Port, split[0], split[1])
-	word := split[0]
-	pport, err := strconv.Atoi(split[1])
+	body, sender, err := auth.Default.Open(p.Port, in.Body)
 	if err != nil {
-		log.Fatalln(err)
+		p.Log.Warn("rejected", "sender", sender, "err", err)
+		return nil, auth.Reject(err)
 	}
-	new := true
-	for _, hword := range p.WordList {
-		if word == hword {
-			new = false
-		}
+	split := strings.SplitN(body, ":", 5)
+	if len(split) != 5 {
+		p.Log.Warn("rejected", "sender", sender, "err", auth.ErrMalformed)
+		return nil, auth.Reject(auth.ErrMalformed)
+	}
+	id, word := split[0], split[4]
+	pport, perr := strconv.Atoi(split[1])
+	hops, herr := strconv.Atoi(split[2])
+	updates, uerr := decodeUpdates(split[3])
+	if perr != nil || herr != nil || uerr != nil {
+		p.Log.Warn("rejected", "sender", sender, "err", auth.ErrMalformed)
+		return nil, auth.Reject(auth.ErrMalformed)
+	}
+	if sender != uint16(pport) {
+		p.Log.Warn("rejected", "sender", sender, "claimed", pport, "err", auth.ErrForged)
+		return nil, auth.Reject(auth.ErrForged)
+	}
+	p.Log.Info("received", "word", word, "id", id, "from", pport)
+	if sw := p.swim(); sw != nil {
+		p.mergeMembers(sw, sender, updates)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.Sched.Now()
+	if p.forgotten(id) {
+		// a late copy, not seen (nor forwarded) again
+		duplicates.Inc(strconv.Itoa(int(p.Port)))
+		p.Convergence.received(id, word, p.Port, true, now)
+		return &grpcapi.Message{Body: p.id.Seal(sender, "known")}, nil
+	}
+	_, stored := p.Words[id]
+	stored = stored || p.deleted(id)
+	n := p.seen.add(id, now)
+	seenSize.Set(float64(p.seen.len()), strconv.Itoa(int(p.Port)))
+	p.Convergence.received(id, word, p.Port, n > 1 || stored, now)
+	if p.Broadcast == Plumtree {
+		p.plumtreeReceive(rpc.Detach(ctx), id, word, hops, uint16(pport), n, stored)
+		return &grpcapi.Message{Body: p.id.Seal(sender, "")}, nil
+	}
+
+	if n == 1 && !stored {
+		p.store(id, word)
+		p.Sched.Go(func() { p.gossip(rpc.Detach(ctx), id, word, hops, uint16(pport)) })
+		return &grpcapi.Message{Body: p.id.Seal(sender, "new")}, nil
 	}
 
-	if new {
-		p.WordList = append(p.WordList, word)
-		go p.Gossip(word, uint16(pport))
+	duplicates.Inc(strconv.Itoa(int(p.Port)))
+	if p.Strategy.Feedback {
+		return &grpcapi.Message{Body: p.id.Seal(sender, "known")}, nil
+	}
+	if p.Strategy.Stop.Stop(n-1, p.Rand) {
+		stopped.Inc(strconv.Itoa(int(p.Port)))
+		p.Log.Info("repeated word, stopping gossiping", "word", word, "id", id, "from", pport)
 	} else {
-		prob := mrand.Float64()
-		if prob >= (1.0 / K) {
-			p.WordList = append(p.WordList, word)
-			go p.Gossip(word, uint16(pport))
-		} else {
-			fmt.Printf("\t[%d] Found repeated message '%s' from %s: Stopping gossiping\n", p.Port, split[0], split[1])
+		p.Sched.Go(func() { p.gossip(rpc.Detach(ctx), id, word, hops, uint16(pport)) })
+	}
+	return &grpcapi.Message{Body: p.id.Seal(sender, "known")}, nil
+}
+
+// control messages are "<kind>:<payload>" Ping bodies, the reply is sealed by Ping
+func (p *Peer) control(ctx context.Context, kind string, payload string, sender uint16) (string, error) {
+	switch kind {
+	case "ae-digest", "ae-pull", "ae-push":
+		return p.antiEntropy(kind, payload, sender)
+	case "mk-diff", "mk-get":
+		return p.merkle(kind, payload)
+	case "sw-ping", "sw-ping-req":
+		return p.swimControl(kind, payload, sender)
+	case "pt-ihave", "pt-graft", "pt-prune":
+		return p.plumtreeControl(kind, payload, sender)
+	case "hv":
+		return p.hyParViewControl(payload, sender)
+	case "ts-sync":
+		return p.tombstoneControl(payload)
+	}
+	return "", fmt.Errorf("unknown control message %q", kind)
+}
+
+// sends a control message to addr, returns the (verified) reply payload
+func (p *Peer) call(ctx context.Context, addr uint16, kind string, payload string) (string, error) {
+	conn, err := rpc.Dial(int(addr))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	g := grpcapi.NewShellClient(conn)
+	res, err := g.Ping(ctx, &grpcapi.Message{Body: p.id.Seal(addr, fmt.Sprintf("%s:%s", kind, payload))})
+	if err != nil {
+		return "", err
+	}
+	body, sender, err := auth.Default.Open(p.Port, res.Body)
+	if err != nil {
+		return "", err
+	}
+	if sender != addr {
+		return "", auth.ErrForged
+	}
+	controlBytes.Add(float64(len(payload)+len(body)), strconv.Itoa(int(p.Port)), kind)
+	return body, nil
+}
+
+// Neighbours gossiped to: HyParView active view if running, Registry otherwise (a copy)
+func (p *Peer) Neighbours() []uint16 {
+	return p.neighbours()
+}
+
+// Status snapshot, taken under the peer lock
+func (p *Peer) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	words := make(map[string]string, len(p.Words))
+	for id, w := range p.Words {
+		words[id] = w
+	}
+	return Status{Port: p.Port, Registry: append([]uint16{}, p.Registry...), Addr: p.Addr, Words: words, HyParView: p.HyParView}
+}
+
+// SetRegistry replaces the peers gossiped to
+func (p *Peer) SetRegistry(registry []uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Registry = registry
+}
+
+// Known rumors count
+func (p *Peer) Known() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.Words)
+}
+
+// snapshot of Registry, safe to range over while making calls
+func (p *Peer) neighbours() []uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.HyParView != nil {
+		return p.HyParView.Active()
+	}
+	return append([]uint16{}, p.Registry...)
+}
+
+// whether SWIM or HyParView is running
+func (p *Peer) membership() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sw != nil || p.HyParView != nil
+}
+
+// adds a rumor to Words, crdt rumors are merged into their replica, publications delivered to
+// subscribers, deletes bury their rumor and deleted rumors are not stored again (p.mu must be held)
+func (p *Peer) store(id string, word string) {
+	if strings.HasPrefix(word, delPrefix) {
+		p.applyDelete(word)
+		return
+	}
+	if p.deleted(id) || p.forgotten(id) {
+		return
+	}
+	// payloads live as long as their seen-cache entry (rumors synced by anti-entropy get one)
+	if now := p.Sched.Now(); !p.seen.has(id, now) {
+		p.seen.add(id, now)
+	}
+	p.Words[id] = word
+	p.updateKnown()
+	if strings.HasPrefix(word, crdtPrefix) {
+		if err := p.applyCRDT(word); err != nil {
+			p.Log.Warn("crdt rumor rejected", "id", id, "err", err)
 		}
 	}
+	if strings.HasPrefix(word, pubPrefix) {
+		p.deliver(id, word)
+	}
+}
+
+// drops the payload of a rumor evicted from the seen-cache, its id is remembered as expired
+// (p.mu must be held)
+func (p *Peer) forget(id string) {
+	p.expired.add(id, p.Sched.Now())
+	if _, ok := p.Words[id]; ok {
+		delete(p.Words, id)
+		p.updateKnown()
+	}
+}
+
+// whether id was dropped from the seen-cache (within SEEN_TTL), its rumor must not come back with
+// a fresh entry (p.mu must be held)
+func (p *Peer) forgotten(id string) bool {
+	return p.expired.has(id, p.Sched.Now())
+}
 
-	return &grpcapi.Message{Body: ""}, nil
+// sets the known words gauge (p.mu must be held)
+func (p *Peer) updateKnown() {
+	known.Set(float64(len(p.Words)), strconv.Itoa(int(p.Port)))
 }
@@ -1,22 +1,38 @@
 package peergossip
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	mrand "math/rand"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
+	"token-ring/auth"
+	"token-ring/common"
+	grpcapi "token-ring/grpcapi"
+	"token-ring/hyparview"
+	"token-ring/rpc"
 )
 
+// peers talk over the in-memory transport, the test ports don't collide with other packages
+var mem = rpc.NewMemTransport()
+
+func TestMain(m *testing.M) {
+	rpc.SetTransport(mem)
+	os.Exit(m.Run())
+}
+
 func TestPartialPeerGossip(t *testing.T) {
-	p1 := NewPeer(4444)
-	p2 := NewPeer(4445)
+	p1 := NewPeer(4442)
+	p2 := NewPeer(4443)
+	time.Sleep(100 * time.Millisecond)
 	p1.Register(int(p2.Port))
 
-	for {
-		fmt.Printf("\n%+v\n", p1)
-		fmt.Printf("\n%+v\n", p2)
-
-		time.Sleep(5 * time.Second)
-	}
+	p1.Gossip("partial", p1.Port)
+	waitWord(t, "partial", p2)
 }
 
 func TestFullPeerGossip(t *testing.T) {
@@ -26,20 +42,925 @@ func TestFullPeerGossip(t *testing.T) {
 	p4 := NewPeer(4447)
 	p5 := NewPeer(4448)
 	p6 := NewPeer(4449)
+	time.Sleep(100 * time.Millisecond)
 	p1.Register(int(p2.Port))
 	p2.Register(int(p3.Port))
 	p2.Register(int(p4.Port))
 	p4.Register(int(p5.Port))
 	p4.Register(int(p6.Port))
 
+	p1.Gossip("full", p1.Port)
+	waitWord(t, "full", p2, p3, p4, p5, p6)
+}
+
+// waits until every peer knows word
+func waitWord(t *testing.T, word string, peers ...*Peer) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, p := range peers {
+		for !knows(p, word) {
+			if time.Now().After(deadline) {
+				t.Fatalf("peer %d: %q not received", p.Port, word)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// whether p stored word
+func knows(p *Peer, word string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range p.Words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+func TestForgedWord(t *testing.T) {
+	p1 := NewPeer(4560)
+	p2 := NewPeer(4561)
+	time.Sleep(100 * time.Millisecond)
+	p1.Register(int(p2.Port))
+
+	conn, err := rpc.Dial(int(p2.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	g := grpcapi.NewShellClient(conn)
+
+	// unsigned, signed by an unknown node, and signed by a known node claiming another port
+	rogue := auth.NewNode(4562, auth.NewKeyring())
+	for _, body := range []string{"4560-1:4560:1::forged", rogue.Seal(p2.Port, "4560-1:4560:1::forged"), auth.Operator.Seal(p2.Port, "4560-1:4560:1::forged")} {
+		if _, err := g.Word(context.Background(), &grpcapi.Message{Body: body}); err == nil {
+			t.Fatalf("expected %q to be rejected", body)
+		}
+	}
+	for _, w := range p2.Words {
+		if w == "forged" {
+			t.Fatal("forged word was accepted")
+		}
+	}
+
+	// sealed by p1 for another peer, and authenticated but malformed (the peer stays up)
+	for _, body := range []string{p1.id.Seal(4562, fmt.Sprintf("4560-3:%d:1::misdirected", p1.Port)), p1.id.Seal(p2.Port, "4560-4:x:1::malformed")} {
+		if _, err := g.Word(context.Background(), &grpcapi.Message{Body: body}); err == nil {
+			t.Fatalf("expected %q to be rejected", body)
+		}
+	}
+
+	sealed := p1.id.Seal(p2.Port, fmt.Sprintf("4560-2:%d:1::genuine", p1.Port))
+	if _, err := g.Word(context.Background(), &grpcapi.Message{Body: sealed}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Word(context.Background(), &grpcapi.Message{Body: sealed}); err == nil {
+		t.Fatal("expected replayed word to be rejected")
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	p1 := NewPeer(4563)
+	p2 := NewPeer(4564)
+	p3 := NewPeer(4565)
+	time.Sleep(100 * time.Millisecond)
+	p1.Register(int(p2.Port))
+	p2.Register(int(p3.Port))
+
+	has := func(p *Peer, id string) bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		_, ok := p.Words[id]
+		return ok
+	}
+	ctx := context.Background()
+
+	// words that were never gossiped
+	p1.merge(map[string]string{"4563-1": "entropy"}, p1.Port)
+	if err := p2.SyncWith(ctx, p1.Port, Pull); err != nil {
+		t.Fatal(err)
+	}
+	if !has(p2, "4563-1") {
+		t.Fatal("pull: word not learned")
+	}
+	if err := p2.SyncWith(ctx, p3.Port, Push); err != nil {
+		t.Fatal(err)
+	}
+	if !has(p3, "4563-1") {
+		t.Fatal("push: word not learned")
+	}
+
+	p3.merge(map[string]string{"4565-1": "reverse"}, p3.Port)
+	p2.merge(map[string]string{"4564-1": "forward"}, p2.Port)
+	if err := p3.SyncWith(ctx, p2.Port, PushPull); err != nil {
+		t.Fatal(err)
+	}
+	if !has(p2, "4565-1") || !has(p3, "4564-1") {
+		t.Fatal("push-pull: word sets differ")
+	}
+}
+
+func TestMerkleReconcile(t *testing.T) {
+	a, b := digestSets(1000, 10)
+	ma, mb := NewMerkle(a), NewMerkle(b)
+	missing, theirsLack, err := ma.reconcile(func(q []merkleQuery) ([]merkleReply, error) { return mb.diff(q), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	onlyA, onlyB := append([]string{}, a[:5]...), append([]string{}, b[len(b)-5:]...)
+	for _, v := range [][]string{missing, theirsLack, onlyA, onlyB} {
+		sort.Strings(v)
+	}
+	if fmt.Sprint(missing) != fmt.Sprint(onlyB) || fmt.Sprint(theirsLack) != fmt.Sprint(onlyA) {
+		t.Fatalf("wrong differences: missing %v, theirs lack %v", missing, theirsLack)
+	}
+
+	p1 := NewPeer(4566)
+	p2 := NewPeer(4567)
+	time.Sleep(100 * time.Millisecond)
+	p1.Register(int(p2.Port))
+	p1.Reconcile = MerkleDigest
+	ids := make([]string, 0)
+	rumors := []map[string]string{make(map[string]string), make(map[string]string)}
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("4566-%d", i)
+		ids = append(ids, id)
+		if i < 60 {
+			rumors[0][id] = "word"
+		}
+		if i >= 40 {
+			rumors[1][id] = "word"
+		}
+	}
+	p1.merge(rumors[0], p1.Port)
+	p2.merge(rumors[1], p2.Port)
+	if err := p1.SyncWith(context.Background(), p2.Port, PushPull); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*Peer{p1, p2} {
+		p.mu.Lock()
+		for _, id := range ids {
+			if _, ok := p.Words[id]; !ok {
+				t.Errorf("peer %d is missing %s", p.Port, id)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// bytes exchanged by a reconciliation round against set size and difference size
+func BenchmarkReconcile(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		for _, d := range []int{2, 20, 200} {
+			if d > n {
+				continue
+			}
+			x, y := digestSets(n, d)
+			b.Run(fmt.Sprintf("flat/n=%d/d=%d", n, d), func(b *testing.B) {
+				var bytes int
+				for i := 0; i < b.N; i++ {
+					bytes = flatBytes(x, y)
+				}
+				b.ReportMetric(float64(bytes), "wire-bytes/round")
+			})
+			b.Run(fmt.Sprintf("merkle/n=%d/d=%d", n, d), func(b *testing.B) {
+				var bytes int
+				for i := 0; i < b.N; i++ {
+					bytes = 0
+					mx, my := NewMerkle(x), NewMerkle(y)
+					mx.reconcile(func(q []merkleQuery) ([]merkleReply, error) {
+						r := my.diff(q)
+						bytes += jsonLen(q) + jsonLen(r)
+						return r, nil
+					})
+				}
+				b.ReportMetric(float64(bytes), "wire-bytes/round")
+			})
+		}
+	}
+}
+
+// n digests each, the first d/2 of a and the last d/2 of b are not shared
+func digestSets(n int, d int) ([]string, []string) {
+	all := make([]string, 0, n+d/2)
+	for i := 0; i < n+d/2; i++ {
+		all = append(all, rumorDigest(fmt.Sprintf("4444-%d", i)))
+	}
+	return all[:n], all[d/2:]
+}
+
+// ae-pull round: our digest, their reply (hashes stand in for the rumors)
+func flatBytes(ours []string, theirs []string) int {
+	in := make(map[string]bool)
+	for _, h := range ours {
+		in[h] = true
+	}
+	reply := syncReply{Rumors: make(map[string]string), Missing: make([]string, 0)}
+	for _, h := range theirs {
+		if !in[h] {
+			reply.Rumors[h] = h
+		}
+		delete(in, h)
+	}
+	for h := range in {
+		reply.Missing = append(reply.Missing, h)
+	}
+	return jsonLen(ours) + jsonLen(reply)
+}
+
+func jsonLen(v interface{}) int {
+	b, _ := json.Marshal(v)
+	return len(b)
+}
+
+func TestRumorDedup(t *testing.T) {
+	c := newSeenCache(2, time.Minute)
+	now := time.Now()
+	if c.add("a", now) != 1 || c.add("a", now) != 2 {
+		t.Fatal("expected seen counts 1, 2")
+	}
+	c.add("b", now)
+	c.add("c", now)
+	if c.len() != 2 || c.add("a", now) != 1 {
+		t.Fatal("expected oldest id to be evicted")
+	}
+	if c.add("c", now.Add(2*time.Minute)) != 1 || c.len() != 1 {
+		t.Fatal("expected ids to expire")
+	}
+
+	p1 := NewPeer(4568)
+	p2 := NewPeer(4569)
+	time.Sleep(100 * time.Millisecond)
+	p1.Register(int(p2.Port))
+
+	// the same word twice is two rumors, the same rumor twice is stored once
+	p1.Gossip("twice", p1.Port)
+	p1.Gossip("twice", p1.Port)
+	conn, err := rpc.Dial(int(p2.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	g := grpcapi.NewShellClient(conn)
+	for i := 0; i < 3; i++ {
+		body := p1.id.Seal(p2.Port, fmt.Sprintf("4568-1:%d:1::again", p1.Port))
+		if _, err := g.Word(context.Background(), &grpcapi.Message{Body: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p2.mu.Lock()
+	defer p2.mu.Unlock()
+	count := make(map[string]int)
+	for _, w := range p2.Words {
+		count[w] += 1
+	}
+	if count["twice"] != 2 || count["again"] != 1 {
+		t.Fatalf("unexpected rumors %v", p2.Words)
+	}
+	if p2.seen.count["4568-1"] != 3 {
+		t.Fatalf("expected 3 sightings of 4568-1, got %d", p2.seen.count["4568-1"])
+	}
+}
+
+// payloads are dropped with their seen-cache entries
+func TestBoundedWords(t *testing.T) {
+	p := NewPeer(4598)
+	p.StopWords()
+	p.mu.Lock()
+	p.seen.size, p.seen.ttl = 5, 100*time.Millisecond
+	p.mu.Unlock()
+	for i := 0; i < 20; i++ {
+		p.Gossip(fmt.Sprintf("w%d", i), p.Port)
+	}
+	st := p.Status()
+	if len(st.Words) != 5 || st.Words[fmt.Sprintf("%d-%d", p.Port, p.seq)] != "w19" {
+		t.Fatalf("expected the last 5 words, got %v", st.Words)
+	}
+	time.Sleep(150 * time.Millisecond)
+	p.Gossip("last", p.Port)
+	if st := p.Status(); len(st.Words) != 1 || p.Known() != 1 {
+		t.Fatalf("expected expired words dropped, got %v", st.Words)
+	}
+}
+
+// expired rumors aren't advertised, and late copies don't bring them back
+func TestExpiredRumors(t *testing.T) {
+	sched := common.NewVirtualScheduler(time.Unix(0, 0))
+	p := NewPeerWith(4606, Options{Sched: sched, NoWords: true})
+	q := NewPeerWith(4607, Options{Sched: sched, NoWords: true})
+	time.Sleep(100 * time.Millisecond)
+	p.Gossip("old", p.Port)
+	id := fmt.Sprintf("%d-%d", p.Port, p.seq)
+	sched.Advance(SEEN_TTL + time.Second)
+
+	p.mu.Lock()
+	digests := p.digests()
+	p.mu.Unlock()
+	if len(digests) != 0 {
+		t.Fatalf("expired rumor advertised: %v", digests)
+	}
+	p.merge(map[string]string{id: "old"}, q.Port)
+	conn, err := rpc.Dial(int(p.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	body := q.id.Seal(p.Port, fmt.Sprintf("%s:%d:1::old", id, q.Port))
+	res, err := grpcapi.NewShellClient(conn).Word(context.Background(), &grpcapi.Message{Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, _, _ := auth.Default.Open(q.Port, res.Body); reply != "known" {
+		t.Fatalf("late copy replied %q", reply)
+	}
+	if st := p.Status(); len(st.Words) != 0 || sched.Len() != 0 {
+		t.Fatalf("expired rumor back: %v, %d pending forwards", st.Words, sched.Len())
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	s := Strategy{Fanout: 2, MaxHops: 2, Stop: Counter{K: 2}}
+	targets := s.targets(common.NewRand(1), []uint16{1, 2, 3, 4}, 1)
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %v", targets)
+	}
+	for _, v := range targets {
+		if v == 1 {
+			t.Fatal("rumor sent back to its sender")
+		}
+	}
+	if again := s.targets(common.NewRand(1), []uint16{1, 2, 3, 4}, 1); fmt.Sprint(again) != fmt.Sprint(targets) {
+		t.Fatalf("same seed, different targets: %v and %v", targets, again)
+	}
+	if !s.forwards(1) || s.forwards(2) {
+		t.Fatal("expected rumors to be forwarded for less than 2 hops")
+	}
+	if s.Stop.Stop(1, nil) || !s.Stop.Stop(2, nil) {
+		t.Fatal("expected counter:2 to stop on the 2nd duplicate")
+	}
+	for _, v := range []string{"coin", "coin:0", "dice:2"} {
+		if _, err := ParseStop(v); err == nil {
+			t.Fatalf("expected %q to be invalid", v)
+		}
+	}
+	if r, err := ParseStop("counter:3"); err != nil || r != (Counter{K: 3}) {
+		t.Fatalf("unexpected stop rule %v, %v", r, err)
+	}
+
+	// line 4570 - 4571 - 4572, a rumor limited to 1 hop only reaches 4571
+	opts := Options{Strategy: Strategy{MaxHops: 1, Stop: Counter{K: 1}, Feedback: true}}
+	p1 := NewPeerWith(4570, opts)
+	p2 := NewPeerWith(4571, opts)
+	p3 := NewPeerWith(4572, opts)
+	time.Sleep(100 * time.Millisecond)
+	p1.Register(int(p2.Port))
+	p2.Register(int(p3.Port))
+	p1.Gossip("near", p1.Port)
+	time.Sleep(200 * time.Millisecond)
+
+	for _, c := range []struct {
+		p    *Peer
+		want int
+	}{{p2, 1}, {p3, 0}} {
+		c.p.mu.Lock()
+		n := 0
+		for _, w := range c.p.Words {
+			if w == "near" {
+				n += 1
+			}
+		}
+		c.p.mu.Unlock()
+		if n != c.want {
+			t.Fatalf("peer %d: expected %d rumors, got %d", c.p.Port, c.want, n)
+		}
+	}
+}
+
+// never stops, counts the duplicates (and failed sends) it is asked about
+type countStop struct {
+	n *int
+}
+
+func (c countStop) Stop(n int, r *mrand.Rand) bool {
+	*c.n = n
+	return false
+}
+
+func (c countStop) String() string {
+	return "count"
+}
+
+// every target is down: failed sends count toward Stop, MaxRounds ends the rounds
+func TestFeedbackTargetsDown(t *testing.T) {
+	p := NewPeer(4599)
+	time.Sleep(100 * time.Millisecond)
+	// 4600 and 4601 are registered but never run
+	p.Registry = append(p.Registry, 4600, 4601)
+
+	done := make(chan struct{})
+	go func() {
+		p.Strategy = Strategy{Stop: Counter{K: 3}, Feedback: true}
+		p.Gossip("lost", p.Port)
+		n := 0
+		p.Strategy = Strategy{Stop: countStop{&n}, Feedback: true, MaxRounds: 3}
+		p.Gossip("lost", p.Port)
+		if n != 6 {
+			t.Errorf("expected 3 rounds of 2 failed sends, got %d", n)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("feedback gossip doesn't end when every target is down")
+	}
+}
+
+// membership updates ride on gossiped words, periods too long for a probe to happen
+func TestSWIMPiggyback(t *testing.T) {
+	for _, cfg := range []SWIMConfig{
+		{Period: time.Second, Timeout: time.Second, Helpers: 1, Suspicion: time.Second},
+		{Period: time.Second, Timeout: 2 * time.Second, Helpers: 1, Suspicion: time.Second},
+		{Period: time.Second, Timeout: 0, Helpers: 1, Suspicion: time.Second},
+	} {
+		if cfg.Validate() == nil {
+			t.Fatalf("expected %+v to be invalid", cfg)
+		}
+	}
+	if err := DefaultSWIM.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	updates := []Member{{Port: 1, State: Suspect, Incarnation: 2}, {Port: 3, State: Dead}}
+	if got, err := decodeUpdates(encodeUpdates(updates)); err != nil || fmt.Sprint(got) != fmt.Sprint(updates) {
+		t.Fatalf("unexpected updates %v, %v", got, err)
+	}
+	for _, v := range []string{"1/0", "1/3/0", "x/0/0", "1/0/0/0"} {
+		if _, err := decodeUpdates(v); err == nil {
+			t.Fatalf("expected %q to be invalid", v)
+		}
+	}
+
+	cfg := SWIMConfig{Period: time.Hour, Timeout: time.Minute, Helpers: 1, Suspicion: time.Hour}
+	opts := Options{Strategy: Strategy{Stop: Counter{K: 1}, Feedback: true, MaxRounds: 1}}
+	p1 := NewPeerWith(4602, opts)
+	p2 := NewPeerWith(4603, opts)
+	time.Sleep(100 * time.Millisecond)
+	p1.Register(int(p2.Port))
+	// 4604 is only known to p1
+	p1.Registry = append(p1.Registry, 4604)
+	for _, p := range []*Peer{p1, p2} {
+		defer p.StartSWIM(cfg)()
+	}
+	p1.Gossip("news", p1.Port)
+	for _, m := range p2.Members() {
+		if m.Port == 4604 {
+			return
+		}
+	}
+	t.Fatalf("member 4604 not piggybacked: %v", p2.Members())
+}
+
+func TestSWIM(t *testing.T) {
+	cfg := SWIMConfig{Period: 50 * time.Millisecond, Timeout: 20 * time.Millisecond, Helpers: 2, Suspicion: 200 * time.Millisecond}
+	p1 := NewPeer(4573)
+	p2 := NewPeer(4574)
+	p3 := NewPeer(4575)
+	time.Sleep(100 * time.Millisecond)
+	// p2 and p3 only know p1 (seed), 4576 is registered but never runs
+	p2.Register(int(p1.Port))
+	p3.Register(int(p1.Port))
+	p1.Registry = append(p1.Registry, 4576)
+	for _, p := range []*Peer{p1, p2, p3} {
+		defer p.StartSWIM(cfg)()
+	}
+
+	state := func(p *Peer, port uint16) (MemberState, bool) {
+		for _, m := range p.Members() {
+			if m.Port == port {
+				return m.State, true
+			}
+		}
+		return Alive, false
+	}
+	deadline := time.Now().Add(5 * time.Second)
 	for {
-		fmt.Printf("\n%+v\n", p1)
-		fmt.Printf("\n%+v\n", p2)
-		fmt.Printf("\n%+v\n", p3)
-		fmt.Printf("\n%+v\n", p4)
-		fmt.Printf("\n%+v\n", p5)
-		fmt.Printf("\n%+v\n", p6)
+		s2, ok2 := state(p2, p3.Port)
+		s3, ok3 := state(p3, p2.Port)
+		dead, okd := state(p1, 4576)
+		if ok2 && ok3 && s2 == Alive && s3 == Alive && okd && dead == Dead && len(p2.neighbours()) == 2 && len(p3.neighbours()) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("membership did not converge: p1 %v, p2 %v, p3 %v", p1.Members(), p2.Members(), p3.Members())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, p := range []*Peer{p1, p2, p3} {
+		for _, v := range p.neighbours() {
+			if v == 4576 {
+				t.Fatalf("peer %d: dead member still in Registry", p.Port)
+			}
+		}
+	}
+}
+
+func TestHyParView(t *testing.T) {
+	cfg := hyparview.DefaultConfig
+	cfg.ActiveSize, cfg.ShufflePeriod = 2, 50*time.Millisecond
+	p1 := NewPeer(4577)
+	p2 := NewPeer(4578)
+	p3 := NewPeer(4579)
+	p4 := NewPeer(4580)
+	time.Sleep(100 * time.Millisecond)
+	defer p1.StartHyParView(cfg, 0)()
+	for _, p := range []*Peer{p2, p3, p4} {
+		defer p.StartHyParView(cfg, p1.Port)()
+	}
+	time.Sleep(300 * time.Millisecond)
+	for _, p := range []*Peer{p1, p2, p3, p4} {
+		if n := len(p.neighbours()); n == 0 || n > 2 {
+			t.Fatalf("peer %d: unexpected active view %s", p.Port, p.HyParView)
+		}
+	}
+
+	p4.Gossip("sampled", p4.Port)
+	time.Sleep(300 * time.Millisecond)
+	for _, p := range []*Peer{p1, p2, p3} {
+		p.mu.Lock()
+		n := 0
+		for _, w := range p.Words {
+			if w == "sampled" {
+				n += 1
+			}
+		}
+		p.mu.Unlock()
+		if n != 1 {
+			t.Fatalf("peer %d: word not received through the active views", p.Port)
+		}
+	}
+}
+
+func TestPlumtree(t *testing.T) {
+	// full mesh of 4, flooding sends 3 + 3*2 words per rumor
+	opts := Options{Broadcast: Plumtree}
+	pool := []*Peer{NewPeerWith(4581, opts), NewPeerWith(4582, opts), NewPeerWith(4583, opts), NewPeerWith(4584, opts)}
+	time.Sleep(100 * time.Millisecond)
+	for i, p := range pool {
+		for _, q := range pool[i+1:] {
+			p.Register(int(q.Port))
+		}
+	}
+
+	received := func(word string) bool {
+		for _, p := range pool {
+			p.mu.Lock()
+			ok := false
+			for _, w := range p.Words {
+				ok = ok || w == word
+			}
+			p.mu.Unlock()
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 3; i++ {
+		word := fmt.Sprintf("tree%d", i)
+		pool[0].Gossip(word, pool[0].Port)
+		time.Sleep(200 * time.Millisecond)
+		if !received(word) {
+			t.Fatalf("%s not received by every peer", word)
+		}
+	}
+
+	// duplicates pruned links: each peer keeps at least one eager link, some are lazy
+	lazy := 0
+	for _, p := range pool {
+		p.mu.Lock()
+		lazy += len(p.pt.lazy)
+		if len(p.pt.lazy) == len(p.Registry) {
+			t.Errorf("peer %d has no eager links", p.Port)
+		}
+		p.mu.Unlock()
+	}
+	if lazy == 0 {
+		t.Fatal("expected pruned (lazy) links")
+	}
+
+	// a lazy link that is the only path is grafted: 4584 prunes every eager link
+	last := pool[3]
+	last.mu.Lock()
+	for _, q := range last.Registry {
+		last.pt.lazy[q] = true
+	}
+	last.mu.Unlock()
+	for _, p := range pool[:3] {
+		p.mu.Lock()
+		p.pt.lazy[last.Port] = true
+		p.mu.Unlock()
+	}
+	pool[0].Gossip("grafted", pool[0].Port)
+	time.Sleep(graftTimeout + 300*time.Millisecond)
+	if !received("grafted") {
+		t.Fatal("lazy only peer did not graft the rumor")
+	}
+}
+
+func TestConvergence(t *testing.T) {
+	// full mesh of 3, every peer forwards the rumor once so each receives a duplicate
+	c := NewConvergence()
+	opts := Options{Convergence: c}
+	pool := []*Peer{NewPeerWith(4585, opts), NewPeerWith(4586, opts), NewPeerWith(4587, opts)}
+	time.Sleep(100 * time.Millisecond)
+	ports := make([]uint16, 0)
+	for i, p := range pool {
+		ports = append(ports, p.Port)
+		for _, q := range pool[i+1:] {
+			p.Register(int(q.Port))
+		}
+	}
+	pool[0].Gossip("measured", pool[0].Port)
+	time.Sleep(200 * time.Millisecond)
+
+	var r RumorReport
+	for _, rep := range c.Report(ports) {
+		if rep.Word == "measured" {
+			r = rep
+		}
+	}
+	if r.Origin != pool[0].Port || r.Reached != 3 || r.Coverage != 1 {
+		t.Fatalf("unexpected report %s", r)
+	}
+	if r.PerPeer[0].Delay != 0 || r.Converged <= 0 || r.Duplicates < 2 {
+		t.Fatalf("unexpected delays or duplicates %+v", r)
+	}
+
+	// peers never reached lower the coverage
+	for _, rep := range c.Report(append(ports, 4588)) {
+		if rep.Word == "measured" && (rep.Coverage != 0.75 || rep.PerPeer[3].Received) {
+			t.Fatalf("expected 3/4 coverage, got %s", rep)
+		}
+	}
+
+	var sb strings.Builder
+	if err := WriteCSV(&sb, []RumorReport{r}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(sb.String(), "\n"); lines != 4 {
+		t.Fatalf("expected header and 3 rows, got %d lines", lines)
+	}
+	sb.Reset()
+	if err := WriteJSON(&sb, []RumorReport{r}); err != nil {
+		t.Fatal(err)
+	}
+	reports := make([]RumorReport, 0)
+	if err := json.Unmarshal([]byte(sb.String()), &reports); err != nil || len(reports) != 1 || reports[0].Reached != 3 {
+		t.Fatalf("unexpected JSON report %q (%v)", sb.String(), err)
+	}
+}
+
+func TestCRDT(t *testing.T) {
+	// merges commute and are idempotent, the OR-Set add wins over a concurrent remove
+	a, b := NewORSet(), NewORSet()
+	a.Merge(a.Add("x", "a-1"))
+	b.Merge(a)
+	b.Merge(b.Remove("x"))
+	a.Merge(a.Add("x", "a-2"))
+	ab, ba := NewORSet(), NewORSet()
+	ab.Merge(a)
+	ab.Merge(b)
+	ba.Merge(b)
+	ba.Merge(a)
+	ba.Merge(a)
+	if !ab.Contains("x") || fmt.Sprint(ab.Value()) != fmt.Sprint(ba.Value()) {
+		t.Fatalf("expected x in both merges, got %v and %v", ab.Value(), ba.Value())
+	}
+	r1, r2 := &LWWRegister{}, &LWWRegister{}
+	now := time.Now()
+	r1.Merge(r1.Set("old", now, 2))
+	r2.Merge(r2.Set("new", now, 3))
+	r1.Merge(r2)
+	r2.Merge(r1.Set("older", now.Add(-time.Second), 9))
+	if r1.Value() != "new" || r2.Value() != "new" {
+		t.Fatalf("expected the higher port to win a tie, got %v and %v", r1.Value(), r2.Value())
+	}
+	c := NewPNCounter()
+	c.Merge(c.Add(5, 1))
+	c.Merge(c.Add(-2, 2))
+	c.Merge(c.Add(-2, 2))
+	if c.Value() != int64(1) {
+		t.Fatalf("expected 1, got %v", c.Value())
+	}
+
+	// replicated through gossip: concurrent updates on a line of 3 converge
+	pool := []*Peer{NewPeer(4589), NewPeer(4590), NewPeer(4591)}
+	time.Sleep(100 * time.Millisecond)
+	pool[0].Register(int(pool[1].Port))
+	pool[1].Register(int(pool[2].Port))
+	updates := []func() error{
+		func() error { return pool[0].ORSetAdd("cart", "apple") },
+		func() error { return pool[2].ORSetAdd("cart", "pear") },
+		func() error { return pool[1].GSetAdd("tags", "go") },
+		func() error { return pool[0].CounterAdd("hits", 3) },
+		func() error { return pool[2].CounterAdd("hits", -1) },
+		func() error { return pool[1].LWWSet("color", "red") },
+	}
+	for _, u := range updates {
+		if err := u(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := pool[2].ORSetRemove("cart", "apple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool[0].LWWSet("cart", "x"); err == nil {
+		t.Fatal("expected a type mismatch error")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	want := "map[cart:[pear] color:red hits:2 tags:[go]]"
+	for _, p := range pool {
+		if got := fmt.Sprint(p.CRDTs()); got != want {
+			t.Fatalf("peer %d: expected %s, got %s", p.Port, want, got)
+		}
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	a, b, c := NewPeer(4592), NewPeer(4593), NewPeer(4594)
+	time.Sleep(100 * time.Millisecond)
+	a.Register(int(b.Port))
+	a.Gossip("gone", a.Port)
+	time.Sleep(100 * time.Millisecond)
+	ids := b.Rumors("gone")
+	if len(ids) != 1 {
+		t.Fatalf("expected b to know gone, got %v", b.Words)
+	}
+	id := ids[0]
+
+	// c holds a stale copy and joins after the delete, its anti-entropy push is refused
+	c.merge(map[string]string{id: "gone"}, a.Port)
+	if err := a.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	b.Register(int(c.Port))
+	if err := c.SyncWith(context.Background(), b.Port, Push); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Rumors("gone")) != 0 || len(b.Tombstones()) != 1 {
+		t.Fatalf("deleted rumor brought back: %v", b.Words)
+	}
+
+	// tombstone sync reaches c, then every tombstone is collected
+	cfg := TombstoneConfig{Retention: 300 * time.Millisecond, Interval: 50 * time.Millisecond, Members: []uint16{a.Port, b.Port, c.Port}}
+	for _, p := range []*Peer{a, b, c} {
+		defer p.StartTombstoneGC(cfg)()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if len(c.Rumors("gone")) != 0 || len(c.Tombstones()) != 1 {
+		t.Fatalf("expected c to delete gone, got %v", c.Words)
+	}
+	for i := 0; len(a.Tombstones())+len(b.Tombstones())+len(c.Tombstones()) > 0; i++ {
+		if i > 100 {
+			t.Fatalf("expected tombstones to be collected, got %v %v %v", a.Tombstones(), b.Tombstones(), c.Tombstones())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// collected ids are still refused (for a retention period)
+	c.mu.Lock()
+	c.Words[id] = "gone"
+	c.mu.Unlock()
+	if err := c.SyncWith(context.Background(), b.Port, Push); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Rumors("gone")) != 0 {
+		t.Fatal("collected rumor brought back")
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	// a - b - c: b relays news to c without delivering it
+	a, b, c := NewPeer(4595), NewPeer(4596), NewPeer(4597)
+	time.Sleep(100 * time.Millisecond)
+	a.Register(int(b.Port))
+	b.Register(int(c.Port))
+	news := c.Subscribe("news")
+	sports := b.Subscribe("sports")
+
+	for _, m := range [][2]string{{"news", "one"}, {"sports", "goal"}, {"news", "two"}} {
+		if err := a.Publish(m[0], m[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Publish("bad:topic", "x"); err == nil {
+		t.Fatal("expected an invalid topic error")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	got := make([]string, 0)
+	for len(news) > 0 {
+		m := <-news
+		if m.Topic != "news" || m.Origin != a.Port {
+			t.Fatalf("unexpected message %+v", m)
+		}
+		got = append(got, m.Payload)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != "[one two]" || len(sports) != 1 {
+		t.Fatalf("expected news [one two] and 1 sports message, got %v and %d", got, len(sports))
+	}
+	if len(b.Rumors("pub:news:one")) != 1 {
+		t.Fatal("expected b to relay (and store) news")
+	}
+
+	c.Unsubscribe("news")
+	if _, ok := <-news; ok || len(c.Topics()) != 0 {
+		t.Fatal("expected the subscription to be closed")
+	}
+}
+
+func TestSource(t *testing.T) {
+	da, err := ParseSource("da")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := Language("da")
+	if da != again || !contains(da.(*dictionary).words, "adelsmænd") {
+		t.Fatal("expected dansk.txt loaded once, as UTF-8")
+	}
+	r := common.NewRand(1)
+	if w, ok := da.Next(r); !ok || w == "" {
+		t.Fatal("expected a word")
+	}
+	if w, _ := ParseSource("random:5"); len(word(w.Next(r))) != 5 {
+		t.Fatal("expected 5 letters")
+	}
+
+	path := t.TempDir() + "/trace.txt"
+	if err := os.WriteFile(path, []byte("# replayed\nfirst\n\nsecond\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := ParseSource("trace:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if word(tr.Next(r)) != "first" || word(tr.Next(r)) != "second" {
+		t.Fatal("expected the trace lines in order")
+	}
+	if _, ok := tr.Next(r); ok {
+		t.Fatal("expected the trace to be exhausted")
+	}
+	for _, spec := range []string{"fr", "random:0", "file:missing.txt", "trace:"} {
+		if _, err := ParseSource(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestMemTransport(t *testing.T) {
+	// dozens of peers in one process (ports 1-40 are never bound), a slow one on the way
+	pool := make([]*Peer, 40)
+	for i := range pool {
+		pool[i] = NewPeer(uint16(i + 1))
+	}
+	for i := 1; i < len(pool); i++ {
+		pool[(i-1)/3].Register(int(pool[i].Port))
+	}
+	mem.SetDelay(pool[4].Port, 50*time.Millisecond)
+	defer mem.SetDelay(pool[4].Port, 0)
+
+	start := time.Now()
+	pool[0].Gossip("in-memory", pool[0].Port)
+	deadline := time.Now().Add(5 * time.Second)
+	for _, p := range pool {
+		for len(p.Rumors("in-memory")) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("peer %d never got the rumor", p.Port)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// peer 4 relays to 13-15
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("converged in %s through a delayed peer", time.Since(start))
+	}
+}
+
+func word(w string, ok bool) string {
+	return w
+}
 
-		time.Sleep(5 * time.Second)
+func contains(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
 	}
+	return false
 }
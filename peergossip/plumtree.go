@@ -0,0 +1,181 @@
+package peergossip
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"token-ring/common"
+	"token-ring/metrics"
+)
+
+// Plumtree (epidemic broadcast trees, Leitão et al.): flooding sends every rumor over every link.
+// In Plumtree mode a peer eagerly pushes rumors (Word) to its eager neighbours only and announces
+// them to the lazy ones (IHAVE). Neighbours start eager, a duplicate moves its sender to lazy
+// (PRUNE), so eager links converge to a spanning tree. A peer that hears of a rumor through IHAVE
+// and doesn't receive it in time asks the announcer for it (GRAFT), which also makes the link
+// eager again and repairs the tree:
+//
+//	pt-ihave:<id>  -> ""
+//	pt-graft:<id>  -> "" (the rumor follows as a Word)
+//	pt-prune:      -> ""
+
+type BroadcastMode int
+
+const (
+	Flood BroadcastMode = iota
+	Plumtree
+)
+
+var broadcastModes = []string{"flood", "plumtree"}
+
+// time waited for a rumor announced by IHAVE before grafting the announcer (then the next announcer, half of it)
+const graftTimeout = 500 * time.Millisecond
+
+var plumtreeMessages = metrics.NewCounter("peergossip_plumtree_messages_total", "Plumtree messages sent by type (gossip, ihave, graft, prune)", "peer", "type")
+var plumtreeSaved = metrics.NewCounter("peergossip_plumtree_saved_total", "Rumor payloads not sent (IHAVE on a lazy link instead of a flooded Word)", "peer")
+var plumtreeRedundant = metrics.NewCounter("peergossip_plumtree_redundant_total", "Rumors received more than once (each prunes a link)", "peer")
+
+type plumtree struct {
+	lazy    map[uint16]bool // neighbours not in the tree, the rest are eager
+	missing map[string]*announced
+}
+
+// rumor known through IHAVE only
+type announced struct {
+	by    []uint16
+	timer *common.Timer
+}
+
+func newPlumtree() *plumtree {
+	return &plumtree{lazy: make(map[uint16]bool), missing: make(map[string]*announced)}
+}
+
+func (m BroadcastMode) String() string {
+	if m < Flood || m > Plumtree {
+		return fmt.Sprintf("broadcastmode(%d)", int(m))
+	}
+	return broadcastModes[m]
+}
+
+func ParseBroadcastMode(s string) (BroadcastMode, error) {
+	for i, v := range broadcastModes {
+		if strings.EqualFold(s, v) {
+			return BroadcastMode(i), nil
+		}
+	}
+	return Flood, fmt.Errorf("unknown broadcast mode %q (flood, plumtree)", s)
+}
+
+// Word in Plumtree mode, n is the times id was seen (p.mu must be held)
+func (p *Peer) plumtreeReceive(ctx context.Context, id string, word string, hops int, from uint16, n int, stored bool) {
+	if n == 1 && !stored {
+		p.store(id, word)
+		if a, ok := p.pt.missing[id]; ok {
+			p.Sched.Cancel(a.timer)
+			delete(p.pt.missing, id)
+		}
+		delete(p.pt.lazy, from)
+		p.Sched.Go(func() { p.plumtreeBroadcast(ctx, id, word, hops, from) })
+		return
+	}
+
+	port := strconv.Itoa(int(p.Port))
+	duplicates.Inc(port)
+	plumtreeRedundant.Inc(port)
+	if !p.pt.lazy[from] {
+		p.pt.lazy[from] = true
+		p.Log.Info("pruning", "peer", from, "id", id)
+		p.Sched.Go(func() {
+			plumtreeMessages.Inc(port, "prune")
+			if _, err := p.call(context.Background(), from, "pt-prune", ""); err != nil {
+				p.Log.Warn("prune failed", "peer", from, "err", err)
+			}
+		})
+	}
+}
+
+// eager push to the tree, IHAVE to the lazy neighbours
+func (p *Peer) plumtreeBroadcast(ctx context.Context, id string, word string, hops int, from uint16) {
+	if !p.Strategy.forwards(hops) {
+		hopLimited.Inc(strconv.Itoa(int(p.Port)))
+		return
+	}
+	port := strconv.Itoa(int(p.Port))
+	for _, peer := range p.neighbours() {
+		if peer == from {
+			continue
+		}
+		p.mu.Lock()
+		lazy := p.pt.lazy[peer]
+		p.mu.Unlock()
+		if lazy {
+			plumtreeMessages.Inc(port, "ihave")
+			plumtreeSaved.Inc(port)
+			if _, err := p.call(ctx, peer, "pt-ihave", id); err != nil {
+				p.Log.Warn("ihave failed", "peer", peer, "err", err)
+			}
+			continue
+		}
+		plumtreeMessages.Inc(port, "gossip")
+		p.send(ctx, peer, id, word, hops+1)
+	}
+}
+
+// handles pt-* control messages
+func (p *Peer) plumtreeControl(kind string, payload string, sender uint16) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch kind {
+	case "pt-ihave":
+		id := payload
+		if _, ok := p.Words[id]; ok || p.forgotten(id) {
+			return "", nil
+		}
+		a, ok := p.pt.missing[id]
+		if !ok {
+			a = &announced{}
+			a.timer = p.Sched.After(graftTimeout, func() { p.Sched.Go(func() { p.graft(id) }) })
+			p.pt.missing[id] = a
+		}
+		a.by = append(a.by, sender)
+		return "", nil
+	case "pt-graft":
+		delete(p.pt.lazy, sender)
+		if word, ok := p.Words[payload]; ok {
+			plumtreeMessages.Inc(strconv.Itoa(int(p.Port)), "gossip")
+			p.Sched.Go(func() { p.send(context.Background(), sender, payload, word, 1) })
+		}
+		return "", nil
+	case "pt-prune":
+		p.pt.lazy[sender] = true
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown plumtree message %q", kind)
+}
+
+// asks the first announcer of a missing rumor for it, adding the link to the tree
+func (p *Peer) graft(id string) {
+	p.mu.Lock()
+	a, ok := p.pt.missing[id]
+	if !ok || len(a.by) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	peer := a.by[0]
+	a.by = a.by[1:]
+	if len(a.by) > 0 {
+		a.timer = p.Sched.After(graftTimeout/2, func() { p.Sched.Go(func() { p.graft(id) }) })
+	} else {
+		delete(p.pt.missing, id)
+	}
+	delete(p.pt.lazy, peer)
+	p.mu.Unlock()
+
+	p.Log.Info("grafting", "peer", peer, "id", id)
+	plumtreeMessages.Inc(strconv.Itoa(int(p.Port)), "graft")
+	if _, err := p.call(context.Background(), peer, "pt-graft", id); err != nil {
+		p.Log.Warn("graft failed", "peer", peer, "err", err)
+	}
+}
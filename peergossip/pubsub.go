@@ -0,0 +1,94 @@
+package peergossip
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"token-ring/metrics"
+)
+
+// Topic publish/subscribe: Publish gossips the rumor
+//
+//	pub:<topic>:<payload>
+//
+// which is relayed (and synced) by every peer like any other rumor, but only delivered to the
+// application by peers subscribed to topic, once per rumor, on the channels returned by Subscribe.
+
+const pubPrefix = "pub:"
+
+// buffered messages per subscription, deliveries to a full subscription are dropped
+const SUB_BUFFER = 64
+
+var delivered = metrics.NewCounter("peergossip_delivered_total", "Published messages delivered to subscribers", "peer", "topic")
+var undelivered = metrics.NewCounter("peergossip_undelivered_total", "Published messages dropped on full subscriptions", "peer", "topic")
+
+type Msg struct {
+	ID      string `json:"id"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Origin  uint16 `json:"origin"`
+}
+
+// Publish gossips payload on topic
+func (p *Peer) Publish(topic string, payload string) error {
+	if topic == "" || strings.Contains(topic, ":") {
+		return fmt.Errorf("invalid topic %q", topic)
+	}
+	p.Gossip(fmt.Sprintf("%s%s:%s", pubPrefix, topic, payload), p.Port)
+	return nil
+}
+
+// Subscribe to messages published on topic (from now on), the channel is closed by Unsubscribe
+func (p *Peer) Subscribe(topic string) <-chan Msg {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch := make(chan Msg, SUB_BUFFER)
+	p.subs[topic] = append(p.subs[topic], ch)
+	return ch
+}
+
+// Unsubscribe closes every subscription to topic
+func (p *Peer) Unsubscribe(topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ch := range p.subs[topic] {
+		close(ch)
+	}
+	delete(p.subs, topic)
+}
+
+// Topics subscribed to
+func (p *Peer) Topics() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make(map[string]bool)
+	for topic := range p.subs {
+		res[topic] = true
+	}
+	return sortedKeys(res)
+}
+
+// delivers a pub rumor to the topic subscribers (p.mu must be held)
+func (p *Peer) deliver(id string, word string) {
+	split := strings.SplitN(strings.TrimPrefix(word, pubPrefix), ":", 2)
+	if len(split) != 2 {
+		p.Log.Warn("malformed publication", "id", id)
+		return
+	}
+	subs := p.subs[split[0]]
+	if len(subs) == 0 {
+		return
+	}
+	origin, _ := strconv.Atoi(strings.SplitN(id, "-", 2)[0])
+	m := Msg{ID: id, Topic: split[0], Payload: split[1], Origin: uint16(origin)}
+	port := strconv.Itoa(int(p.Port))
+	for _, ch := range subs {
+		select {
+		case ch <- m:
+			delivered.Inc(port, m.Topic)
+		default:
+			undelivered.Inc(port, m.Topic)
+			p.Log.Warn("subscription full, dropping", "topic", m.Topic, "id", id)
+		}
+	}
+}
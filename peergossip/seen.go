@@ -0,0 +1,74 @@
+package peergossip
+
+import "time"
+
+// Bounded cache of recently seen rumor ids: entries expire after ttl and the oldest are evicted
+// past size, so dedup state doesn't grow over long runs. Counts how many times each id was seen.
+// Not safe for concurrent use (guarded by Peer.mu).
+type seenCache struct {
+	size  int
+	ttl   time.Duration
+	count map[string]int
+	order []seenEntry // insertion order, oldest first
+	// called with every id dropped (expired or evicted), nil - none
+	evict func(id string)
+}
+
+type seenEntry struct {
+	id string
+	at time.Time
+}
+
+func newSeenCache(size int, ttl time.Duration) *seenCache {
+	return &seenCache{
+		size:  size,
+		ttl:   ttl,
+		count: make(map[string]int),
+		order: make([]seenEntry, 0),
+	}
+}
+
+// add marks id as seen at now and returns how many times it was seen (1 the first time)
+func (c *seenCache) add(id string, now time.Time) int {
+	c.expire(now)
+	if n, ok := c.count[id]; ok {
+		c.count[id] = n + 1
+		return n + 1
+	}
+	c.count[id] = 1
+	c.order = append(c.order, seenEntry{id: id, at: now})
+	if len(c.order) > c.size {
+		c.drop(c.order[0].id)
+		c.order = c.order[1:]
+	}
+	return 1
+}
+
+// has reports whether id was seen (and hasn't expired) at now
+func (c *seenCache) has(id string, now time.Time) bool {
+	c.expire(now)
+	return c.count[id] > 0
+}
+
+func (c *seenCache) len() int {
+	return len(c.order)
+}
+
+// drops entries older than ttl
+func (c *seenCache) expire(now time.Time) {
+	i := 0
+	for i < len(c.order) && now.Sub(c.order[i].at) > c.ttl {
+		c.drop(c.order[i].id)
+		i++
+	}
+	if i > 0 {
+		c.order = append(c.order[:0:0], c.order[i:]...)
+	}
+}
+
+func (c *seenCache) drop(id string) {
+	delete(c.count, id)
+	if c.evict != nil {
+		c.evict(id)
+	}
+}
@@ -0,0 +1,195 @@
+package peergossip
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Sources of the words gossiped by PoissonWordProcess (Peer.Source, English by default):
+//
+//	en, da         built-in dictionaries (engmix.txt, dansk.txt), a random word per event
+//	file:<path>    dictionary file, one word per line
+//	random[:n]     random strings of n letters (8)
+//	trace:<path>   replays the lines of path in order, then stops (shared by a pool, lines are
+//	               taken by whichever peer fires next); empty lines and # comments are skipped
+//
+// Files are loaded once (dictionaries are shared) and found relative to the working directory,
+// the executable or the peergossip sources. Latin-1 files (dansk.txt) are read as UTF-8.
+type Source interface {
+	// next word (random ones drawn from r), false once the source is exhausted
+	Next(r *mrand.Rand) (string, bool)
+}
+
+var languages = map[string]string{"en": "engmix.txt", "da": "dansk.txt"}
+
+type dictionary struct {
+	words []string
+}
+
+type randomStrings struct {
+	n int
+}
+
+type trace struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// dictionaries by resolved path
+var dictionaries = struct {
+	sync.Mutex
+	m map[string]*dictionary
+}{m: make(map[string]*dictionary)}
+
+func (d *dictionary) Next(r *mrand.Rand) (string, bool) {
+	return d.words[r.Intn(len(d.words))], true
+}
+
+func (s randomStrings) Next(r *mrand.Rand) (string, bool) {
+	b := make([]byte, s.n)
+	for i := range b {
+		b[i] = byte('a' + r.Intn(26))
+	}
+	return string(b), true
+}
+
+func (t *trace) Next(r *mrand.Rand) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.lines) == 0 {
+		return "", false
+	}
+	w := t.lines[0]
+	t.lines = t.lines[1:]
+	return w, true
+}
+
+// Language dictionary source: en or da
+func Language(lang string) (Source, error) {
+	file, ok := languages[lang]
+	if !ok {
+		return nil, fmt.Errorf("unknown language %q (en, da)", lang)
+	}
+	return Dictionary(file)
+}
+
+// Dictionary source of the words in path (loaded once)
+func Dictionary(path string) (Source, error) {
+	path, err := locate(path)
+	if err != nil {
+		return nil, err
+	}
+	dictionaries.Lock()
+	defer dictionaries.Unlock()
+	if d, ok := dictionaries.m[path]; ok {
+		return d, nil
+	}
+	words, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty dictionary %s", path)
+	}
+	d := &dictionary{words: words}
+	dictionaries.m[path] = d
+	return d, nil
+}
+
+func RandomStrings(n int) Source {
+	return randomStrings{n: n}
+}
+
+// Trace source replaying the lines of path
+func Trace(path string) (Source, error) {
+	path, err := locate(path)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "#") {
+			res = append(res, l)
+		}
+	}
+	return &trace{lines: res}, nil
+}
+
+// ParseSource: en, da, file:<path>, random[:n] or trace:<path>
+func ParseSource(spec string) (Source, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "en", "da":
+		return Language(kind)
+	case "file":
+		return Dictionary(arg)
+	case "trace":
+		return Trace(arg)
+	case "random":
+		n := 8
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid random string length %q", arg)
+			}
+		}
+		return RandomStrings(n), nil
+	}
+	return nil, fmt.Errorf("unknown source %q (en, da, file:<path>, random[:n], trace:<path>)", spec)
+}
+
+// aux
+
+// path as given, else next to the executable, else next to the peergossip sources
+func locate(path string) (string, error) {
+	candidates := []string{path}
+	if !filepath.IsAbs(path) {
+		if exe, err := os.Executable(); err == nil {
+			candidates = append(candidates, filepath.Join(filepath.Dir(exe), path))
+		}
+		if _, src, _, ok := runtime.Caller(0); ok {
+			candidates = append(candidates, filepath.Join(filepath.Dir(src), path))
+		}
+	}
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && !fi.IsDir() {
+			return filepath.Abs(c)
+		}
+	}
+	return "", fmt.Errorf("%s not found (working directory, executable or peergossip directory)", path)
+}
+
+// non empty lines of path, Latin-1 lines converted to UTF-8
+func readLines(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if l == "" {
+			continue
+		}
+		if !utf8.ValidString(l) {
+			runes := make([]rune, 0, len(l))
+			for i := 0; i < len(l); i++ {
+				runes = append(runes, rune(l[i]))
+			}
+			l = string(runes)
+		}
+		res = append(res, l)
+	}
+	return res, nil
+}
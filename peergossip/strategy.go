@@ -0,0 +1,113 @@
+package peergossip
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+)
+
+// Strategy - how a peer spreads rumors (rumor mongering):
+//
+//	Fanout   - neighbours a rumor is forwarded to per round, a random subset (0 - every neighbour)
+//	MaxHops  - hops a rumor travels before it is no longer forwarded, carried in the message (0 - unlimited)
+//	Stop     - when a peer loses interest in a rumor, after its n-th duplicate
+//	Feedback - blind: the receiver of a duplicate decides (Stop) whether to forward it again.
+//	           feedback: the sender keeps forwarding rounds and counts replies from peers that already
+//	           knew the rumor (and failed sends), until Stop.
+//	MaxRounds - feedback: forwarding rounds a sender makes at most (0 - unlimited)
+//
+// The default (every neighbour, unlimited hops, coin 1/5, blind) is the assignment's protocol.
+type Strategy struct {
+	Fanout    int
+	MaxHops   int
+	Stop      StopRule
+	Feedback  bool
+	MaxRounds int
+}
+
+type StopRule interface {
+	// Stop reports whether to stop spreading a rumor after its n-th duplicate (random choices from r)
+	Stop(n int, r *mrand.Rand) bool
+	String() string
+}
+
+// stop with probability 1/K on every duplicate
+type Coin struct {
+	K int
+}
+
+// stop after K duplicates
+type Counter struct {
+	K int
+}
+
+var DefaultStrategy = Strategy{Stop: Coin{K: 5}}
+
+func (c Coin) Stop(n int, r *mrand.Rand) bool {
+	return r.Float64() < 1.0/float64(c.K)
+}
+
+func (c Coin) String() string {
+	return fmt.Sprintf("coin:%d", c.K)
+}
+
+func (c Counter) Stop(n int, r *mrand.Rand) bool {
+	return n >= c.K
+}
+
+func (c Counter) String() string {
+	return fmt.Sprintf("counter:%d", c.K)
+}
+
+// ParseStop parses "coin:K" or "counter:K"
+func ParseStop(s string) (StopRule, error) {
+	kind, v, _ := strings.Cut(s, ":")
+	k, err := strconv.Atoi(v)
+	if err != nil || k < 1 {
+		return nil, fmt.Errorf("invalid stop rule %q (coin:K, counter:K)", s)
+	}
+	switch kind {
+	case "coin":
+		return Coin{K: k}, nil
+	case "counter":
+		return Counter{K: k}, nil
+	}
+	return nil, fmt.Errorf("invalid stop rule %q (coin:K, counter:K)", s)
+}
+
+func (s Strategy) String() string {
+	mode := "blind"
+	if s.Feedback {
+		mode = "feedback"
+	}
+	if s.Feedback && s.MaxRounds > 0 {
+		mode += fmt.Sprintf(" max-rounds=%d", s.MaxRounds)
+	}
+	return fmt.Sprintf("fanout=%d max-hops=%d stop=%s %s", s.Fanout, s.MaxHops, s.Stop, mode)
+}
+
+// neighbours a rumor received from gossipeer is forwarded to (the random subset drawn from r)
+func (s Strategy) targets(r *mrand.Rand, neighbours []uint16, gossipeer uint16) []uint16 {
+	res := make([]uint16, 0, len(neighbours))
+	for _, peer := range neighbours {
+		if peer != gossipeer {
+			res = append(res, peer)
+		}
+	}
+	if s.Fanout > 0 && len(res) > s.Fanout {
+		r.Shuffle(len(res), func(i, j int) { res[i], res[j] = res[j], res[i] })
+		res = res[:s.Fanout]
+	}
+	return res
+}
+
+// whether a feedback sender makes another forwarding round after round
+func (s Strategy) another(round int) bool {
+	return s.MaxRounds == 0 || round < s.MaxRounds
+}
+
+// whether a rumor that travelled hops is forwarded
+func (s Strategy) forwards(hops int) bool {
+	return s.MaxHops == 0 || hops < s.MaxHops
+}
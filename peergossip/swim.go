@@ -0,0 +1,493 @@
+package peergossip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	mrand "math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"token-ring/common"
+	"token-ring/metrics"
+)
+
+// SWIM membership: Registry is otherwise only filled by Register calls and never pruned.
+// Every protocol period a peer probes a member (round robin over a shuffled list):
+//
+//	sw-ping:[update, ...]                           -> [update, ...] (ack)
+//	sw-ping-req:{"target": port, "updates": [...]}  -> {"ack": bool, "updates": [...]}
+//
+// If the target doesn't ack within Timeout, Helpers other members are asked to probe it (ping-req).
+// Without any ack the target is suspected, and declared dead after Suspicion unless it refutes
+// by raising its incarnation number. Membership updates (alive, suspect, dead) are piggybacked on
+// every ping, ack and gossiped Word, each one a bounded number of times (λ log n), so peers discover
+// each other from a single seed and Registry follows the alive and suspected members.
+
+type MemberState int
+
+const (
+	Alive MemberState = iota
+	Suspect
+	Dead
+)
+
+var memberStates = []string{"alive", "suspect", "dead"}
+
+type SWIMConfig struct {
+	Period    time.Duration // protocol period, a probe each
+	Timeout   time.Duration // direct probe timeout, the rest of the period is left to ping-req
+	Helpers   int           // members asked to probe indirectly (k)
+	Suspicion time.Duration // suspect -> dead
+}
+
+var DefaultSWIM = SWIMConfig{Period: time.Second, Timeout: 300 * time.Millisecond, Helpers: 3, Suspicion: 5 * time.Second}
+
+// λ, updates are piggybacked λ * log2(members) times
+const retransmit = 3
+
+// updates per message
+const piggyback = 8
+
+type Member struct {
+	Port        uint16      `json:"port"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+}
+
+type swim struct {
+	mu      sync.Mutex
+	cfg     SWIMConfig
+	inc     uint64
+	members map[uint16]*member
+	updates []*update
+	probes  []uint16 // remaining probe targets this round
+	rng     *mrand.Rand
+}
+
+type member struct {
+	Member
+	since time.Time // last state change
+}
+
+type update struct {
+	Member
+	sent int
+}
+
+type pingReq struct {
+	Target  uint16   `json:"target"`
+	Updates []Member `json:"updates"`
+}
+
+type pingReqReply struct {
+	Ack     bool     `json:"ack"`
+	Updates []Member `json:"updates"`
+}
+
+var probes = metrics.NewCounter("peergossip_swim_probes_total", "SWIM probes by result (ack, indirect, failed)", "peer", "result")
+var members = metrics.NewGauge("peergossip_swim_members", "SWIM members by state", "peer", "state")
+
+func (s MemberState) String() string {
+	if s < Alive || s > Dead {
+		return fmt.Sprintf("memberstate(%d)", int(s))
+	}
+	return memberStates[s]
+}
+
+func (s MemberState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *MemberState) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	for i, name := range memberStates {
+		if v == name {
+			*s = MemberState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown member state %q", v)
+}
+
+// Validate checks the periods: probes time out within the period (ping-req gets the rest)
+func (c SWIMConfig) Validate() error {
+	if c.Period <= 0 || c.Timeout <= 0 || c.Suspicion <= 0 {
+		return fmt.Errorf("swim: period, timeout and suspicion must be positive")
+	}
+	if c.Timeout >= c.Period {
+		return fmt.Errorf("swim: timeout %s must be shorter than the period %s", c.Timeout, c.Period)
+	}
+	if c.Helpers < 0 {
+		return fmt.Errorf("swim: negative helpers %d", c.Helpers)
+	}
+	return nil
+}
+
+// StartSWIM starts the membership protocol with the current Registry as members, until stop is called
+// (cfg must be valid, see Validate)
+func (p *Peer) StartSWIM(cfg SWIMConfig) (stop func()) {
+	if err := cfg.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+	sw := &swim{cfg: cfg, members: make(map[uint16]*member), updates: make([]*update, 0), rng: common.NewRand(p.Rand.Int63())}
+	// announce ourselves and the members we start with
+	sw.enqueue(Member{Port: p.Port, State: Alive})
+	for _, port := range p.neighbours() {
+		sw.members[port] = &member{Member: Member{Port: port, State: Alive}, since: p.Sched.Now()}
+		sw.enqueue(Member{Port: port, State: Alive})
+	}
+	p.mu.Lock()
+	p.sw = sw
+	p.mu.Unlock()
+
+	stopPeriods := p.Sched.Every(cfg.Period, func() { p.protocolPeriod(sw) })
+	return func() {
+		stopPeriods()
+		p.mu.Lock()
+		p.sw = nil
+		p.mu.Unlock()
+	}
+}
+
+// Members known through SWIM (nil if it isn't running)
+func (p *Peer) Members() []Member {
+	sw := p.swim()
+	if sw == nil {
+		return nil
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	res := make([]Member, 0, len(sw.members))
+	for _, m := range sw.members {
+		res = append(res, m.Member)
+	}
+	return res
+}
+
+// a probe, indirect probes if it fails, and suspicion timeouts
+func (p *Peer) protocolPeriod(sw *swim) {
+	target, ok := sw.next()
+	if ok {
+		port := strconv.Itoa(int(p.Port))
+		if p.probe(sw, target, sw.cfg.Timeout) {
+			probes.Inc(port, "ack")
+		} else if p.probeIndirect(sw, target) {
+			probes.Inc(port, "indirect")
+		} else {
+			probes.Inc(port, "failed")
+			sw.mu.Lock()
+			if m, ok := sw.members[target]; ok && m.State == Alive {
+				p.apply(sw, Member{Port: target, State: Suspect, Incarnation: m.Incarnation})
+			}
+			sw.mu.Unlock()
+		}
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for _, m := range sw.members {
+		if m.State == Suspect && p.Sched.Now().Sub(m.since) > sw.cfg.Suspicion {
+			p.apply(sw, Member{Port: m.Port, State: Dead, Incarnation: m.Incarnation})
+		}
+	}
+	p.updateMembers(sw)
+}
+
+// sw-ping target, true on ack
+func (p *Peer) probe(sw *swim, target uint16, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	b, err := json.Marshal(sw.piggyback())
+	if err != nil {
+		return false
+	}
+	res, err := p.call(ctx, target, "sw-ping", string(b))
+	if err != nil {
+		return false
+	}
+	updates := make([]Member, 0)
+	if err := json.Unmarshal([]byte(res), &updates); err == nil {
+		p.mergeMembers(sw, target, updates)
+	}
+	return true
+}
+
+// asks Helpers random members to probe target, true if any acks within the period
+func (p *Peer) probeIndirect(sw *swim, target uint16) bool {
+	helpers := sw.helpers(target)
+	if len(helpers) == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sw.cfg.Period-sw.cfg.Timeout)
+	defer cancel()
+	acks := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func(h uint16) {
+			b, err := json.Marshal(pingReq{Target: target, Updates: sw.piggyback()})
+			if err != nil {
+				acks <- false
+				return
+			}
+			res, err := p.call(ctx, h, "sw-ping-req", string(b))
+			if err != nil {
+				acks <- false
+				return
+			}
+			reply := pingReqReply{}
+			if err := json.Unmarshal([]byte(res), &reply); err != nil {
+				acks <- false
+				return
+			}
+			p.mergeMembers(sw, h, reply.Updates)
+			acks <- reply.Ack
+		}(h)
+	}
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+	return false
+}
+
+// handles sw-* control messages
+func (p *Peer) swimControl(kind string, payload string, sender uint16) (string, error) {
+	sw := p.swim()
+	if sw == nil {
+		return "", fmt.Errorf("swim is not running")
+	}
+	switch kind {
+	case "sw-ping":
+		updates := make([]Member, 0)
+		if err := json.Unmarshal([]byte(payload), &updates); err != nil {
+			return "", err
+		}
+		p.mergeMembers(sw, sender, updates)
+		b, err := json.Marshal(sw.piggyback())
+		return string(b), err
+	case "sw-ping-req":
+		req := pingReq{}
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", err
+		}
+		p.mergeMembers(sw, sender, req.Updates)
+		ack := p.probe(sw, req.Target, sw.cfg.Timeout)
+		b, err := json.Marshal(pingReqReply{Ack: ack, Updates: sw.piggyback()})
+		return string(b), err
+	}
+	return "", fmt.Errorf("unknown swim message %q", kind)
+}
+
+// applies piggybacked updates, a message from an unknown sender makes it a member
+func (p *Peer) mergeMembers(sw *swim, sender uint16, updates []Member) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if _, ok := sw.members[sender]; !ok && sender != p.Port {
+		p.apply(sw, Member{Port: sender, State: Alive})
+	}
+	for _, u := range updates {
+		p.apply(sw, u)
+	}
+	p.updateMembers(sw)
+}
+
+// applies an update if it overrides the known state (sw.mu must be held):
+// alive overrides a lower incarnation, suspect an equal or lower one and dead always
+func (p *Peer) apply(sw *swim, u Member) {
+	if u.Port == p.Port {
+		// refute suspicion by raising the incarnation
+		if u.State != Alive && u.Incarnation >= sw.inc {
+			sw.inc = u.Incarnation + 1
+			p.Log.Info("refuting", "state", u.State.String(), "incarnation", sw.inc)
+			sw.enqueue(Member{Port: p.Port, State: Alive, Incarnation: sw.inc})
+		}
+		return
+	}
+
+	m, ok := sw.members[u.Port]
+	if ok {
+		switch u.State {
+		case Alive:
+			if u.Incarnation <= m.Incarnation {
+				return
+			}
+		case Suspect:
+			if m.State == Dead || u.Incarnation < m.Incarnation || (m.State == Suspect && u.Incarnation == m.Incarnation) {
+				return
+			}
+		case Dead:
+			if m.State == Dead {
+				return
+			}
+		}
+	} else {
+		if u.State == Dead {
+			return
+		}
+		m = &member{}
+		sw.members[u.Port] = m
+	}
+	m.Member, m.since = u, p.Sched.Now()
+	sw.enqueue(u)
+	p.Log.Info("member", "peer", u.Port, "state", u.State.String(), "incarnation", u.Incarnation)
+
+	if u.State == Dead {
+		p.removeNeighbour(u.Port)
+	} else {
+		p.addNeighbour(u.Port)
+	}
+}
+
+// sets the members gauge (sw.mu must be held)
+func (p *Peer) updateMembers(sw *swim) {
+	count := make([]int, len(memberStates))
+	for _, m := range sw.members {
+		count[m.State] += 1
+	}
+	for i, n := range count {
+		members.Set(float64(n), strconv.Itoa(int(p.Port)), memberStates[i])
+	}
+}
+
+func (p *Peer) swim() *swim {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sw
+}
+
+func (p *Peer) addNeighbour(port uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range p.Registry {
+		if v == port {
+			return
+		}
+	}
+	p.Registry = append(p.Registry, port)
+}
+
+func (p *Peer) removeNeighbour(port uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	registry := make([]uint16, 0, len(p.Registry))
+	for _, v := range p.Registry {
+		if v != port {
+			registry = append(registry, v)
+		}
+	}
+	p.Registry = registry
+}
+
+// next probe target, round robin over the alive and suspected members in random order
+func (sw *swim) next() (uint16, bool) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for {
+		if len(sw.probes) == 0 {
+			for port, m := range sw.members {
+				if m.State != Dead {
+					sw.probes = append(sw.probes, port)
+				}
+			}
+			if len(sw.probes) == 0 {
+				return 0, false
+			}
+			// sorted first, the shuffle alone repeats with the seed
+			sort.Slice(sw.probes, func(i, j int) bool { return sw.probes[i] < sw.probes[j] })
+			sw.rng.Shuffle(len(sw.probes), func(i, j int) { sw.probes[i], sw.probes[j] = sw.probes[j], sw.probes[i] })
+		}
+		port := sw.probes[0]
+		sw.probes = sw.probes[1:]
+		if m, ok := sw.members[port]; ok && m.State != Dead {
+			return port, true
+		}
+	}
+}
+
+// up to Helpers alive members other than target
+func (sw *swim) helpers(target uint16) []uint16 {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	res := make([]uint16, 0)
+	for port, m := range sw.members {
+		if port != target && m.State == Alive {
+			res = append(res, port)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	sw.rng.Shuffle(len(res), func(i, j int) { res[i], res[j] = res[j], res[i] })
+	if len(res) > sw.cfg.Helpers {
+		res = res[:sw.cfg.Helpers]
+	}
+	return res
+}
+
+// queues an update for dissemination, replacing older ones about the same member (sw.mu must be held)
+func (sw *swim) enqueue(m Member) {
+	for i, u := range sw.updates {
+		if u.Port == m.Port {
+			sw.updates = append(sw.updates[:i], sw.updates[i+1:]...)
+			break
+		}
+	}
+	sw.updates = append(sw.updates, &update{Member: m})
+}
+
+// least sent updates for a message, dropped once sent λ log n times
+func (sw *swim) piggyback() []Member {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	limit := retransmit * int(math.Ceil(math.Log2(float64(len(sw.members)+2))))
+	sort.SliceStable(sw.updates, func(i, j int) bool { return sw.updates[i].sent < sw.updates[j].sent })
+	res := make([]Member, 0, piggyback)
+	kept := make([]*update, 0, len(sw.updates))
+	for _, u := range sw.updates {
+		if len(res) < piggyback {
+			res = append(res, u.Member)
+			u.sent += 1
+		}
+		if u.sent < limit {
+			kept = append(kept, u)
+		}
+	}
+	sw.updates = kept
+	return res
+}
+
+// updates piggybacked on Word messages, "<port>/<state>/<incarnation>" comma separated (no ":", the word follows)
+func encodeUpdates(updates []Member) string {
+	res := make([]string, 0, len(updates))
+	for _, u := range updates {
+		res = append(res, fmt.Sprintf("%d/%d/%d", u.Port, u.State, u.Incarnation))
+	}
+	return strings.Join(res, ",")
+}
+
+func decodeUpdates(s string) ([]Member, error) {
+	res := make([]Member, 0)
+	if s == "" {
+		return res, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		fields := strings.Split(v, "/")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid update %q", v)
+		}
+		port, perr := strconv.ParseUint(fields[0], 10, 16)
+		state, serr := strconv.Atoi(fields[1])
+		inc, ierr := strconv.ParseUint(fields[2], 10, 64)
+		if perr != nil || serr != nil || ierr != nil || state < int(Alive) || state > int(Dead) {
+			return nil, fmt.Errorf("invalid update %q", v)
+		}
+		res = append(res, Member{Port: uint16(port), State: MemberState(state), Incarnation: inc})
+	}
+	return res, nil
+}
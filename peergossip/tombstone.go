@@ -0,0 +1,259 @@
+package peergossip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"token-ring/metrics"
+)
+
+// Deletes: Delete removes a rumor and gossips "del:<id>" (a rumor that is forwarded but not stored).
+// Every peer keeps a tombstone for the deleted id, so the rumor isn't brought back by a stale peer
+// (gossip or anti-entropy). Peers that missed the delete get it through tombstone sync rounds
+// (StartTombstoneGC), which also carry, per tombstone, the members known to have it:
+//
+//	ts-sync:{"id": {"at": ..., "seen": [port, ...]}, ...} -> {"tombstones": {...}, "stable": ["id", ...]}
+//
+// A tombstone is causally stable once every member has seen it, and it is collected when stable and
+// older than the retention. Collected ids are remembered for another retention period, a peer that
+// still syncs them is told they are stable (and collects them in turn) instead of re-adding them.
+
+const delPrefix = "del:"
+
+var tombstones = metrics.NewGauge("peergossip_tombstones", "Tombstones of deleted rumors held by a peer", "peer")
+var collected = metrics.NewCounter("peergossip_tombstones_collected_total", "Tombstones dropped once seen by every member", "peer")
+
+type TombstoneConfig struct {
+	Retention time.Duration // tombstones are kept at least this long
+	Interval  time.Duration // sync rounds with a random neighbour
+	Members   []uint16      // peers that must see a tombstone before it is collected (nil - SWIM members, else Registry)
+}
+
+var DefaultTombstones = TombstoneConfig{Retention: time.Minute, Interval: 5 * time.Second}
+
+type tombstone struct {
+	At     int64    `json:"at"` // unix nano, deletion (or receipt) time
+	Seen   []uint16 `json:"seen"`
+	stable bool
+}
+
+type tombstoneReply struct {
+	Tombstones map[string]*tombstone `json:"tombstones"`
+	Stable     []string              `json:"stable"`
+}
+
+// Delete removes rumor id and gossips the delete
+func (p *Peer) Delete(id string) error {
+	p.mu.Lock()
+	if _, ok := p.Words[id]; !ok {
+		p.mu.Unlock()
+		return fmt.Errorf("unknown rumor %q", id)
+	}
+	p.bury(id, p.Sched.Now().UnixNano(), nil)
+	p.mu.Unlock()
+	p.Gossip(delPrefix+id, p.Port)
+	return nil
+}
+
+// Rumors ids carrying word
+func (p *Peer) Rumors(word string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make([]string, 0)
+	for id, w := range p.Words {
+		if w == word {
+			res = append(res, id)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Tombstones ids held
+func (p *Peer) Tombstones() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make([]string, 0, len(p.tombs))
+	for id := range p.tombs {
+		res = append(res, id)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// StartTombstoneGC runs a tombstone sync round every cfg.Interval and collects stable tombstones,
+// until stop is called (without it tombstones are never dropped)
+func (p *Peer) StartTombstoneGC(cfg TombstoneConfig) (stop func()) {
+	p.mu.Lock()
+	p.buried = newSeenCache(SEEN_SIZE, cfg.Retention)
+	p.mu.Unlock()
+	return p.Sched.Every(cfg.Interval, func() {
+		if registry := p.neighbours(); len(registry) > 0 {
+			addr := registry[p.Rand.Intn(len(registry))]
+			if err := p.syncTombstones(context.Background(), addr); err != nil {
+				p.Log.Warn("tombstone sync failed", "peer", addr, "err", err)
+			}
+		}
+		p.collect(cfg)
+	})
+}
+
+// push-pull of tombstones with addr
+func (p *Peer) syncTombstones(ctx context.Context, addr uint16) error {
+	p.mu.Lock()
+	b, err := json.Marshal(p.tombs)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	res, err := p.call(ctx, addr, "ts-sync", string(b))
+	if err != nil {
+		return err
+	}
+	reply := tombstoneReply{}
+	if err := json.Unmarshal([]byte(res), &reply); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mergeTombstones(reply.Tombstones)
+	for _, id := range reply.Stable {
+		if t, ok := p.tombs[id]; ok {
+			t.stable = true
+		}
+	}
+	return nil
+}
+
+// handles ts-sync control messages
+func (p *Peer) tombstoneControl(payload string) (string, error) {
+	theirs := make(map[string]*tombstone)
+	if err := json.Unmarshal([]byte(payload), &theirs); err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reply := tombstoneReply{Tombstones: p.tombs, Stable: make([]string, 0)}
+	for id := range theirs {
+		if p.wasCollected(id) {
+			reply.Stable = append(reply.Stable, id)
+		}
+	}
+	p.mergeTombstones(theirs)
+	b, err := json.Marshal(reply)
+	return string(b), err
+}
+
+// drops tombstones seen by every member and older than cfg.Retention
+func (p *Peer) collect(cfg TombstoneConfig) {
+	members := cfg.Members
+	if len(members) == 0 {
+		members = p.gcMembers()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.Sched.Now()
+	for id, t := range p.tombs {
+		if now.Sub(time.Unix(0, t.At)) < cfg.Retention || !(t.stable || seenBy(t, members)) {
+			continue
+		}
+		delete(p.tombs, id)
+		p.buried.add(id, now)
+		collected.Inc(strconv.Itoa(int(p.Port)))
+		p.Log.Info("tombstone collected", "id", id)
+	}
+	tombstones.Set(float64(len(p.tombs)), strconv.Itoa(int(p.Port)))
+}
+
+// SWIM members that aren't dead, else Registry, and p
+func (p *Peer) gcMembers() []uint16 {
+	res := []uint16{p.Port}
+	if ms := p.Members(); ms != nil {
+		for _, m := range ms {
+			if m.State != Dead {
+				res = append(res, m.Port)
+			}
+		}
+		return res
+	}
+	return append(res, p.neighbours()...)
+}
+
+// removes rumor id and records its tombstone, seen by p and seen (p.mu must be held)
+func (p *Peer) bury(id string, at int64, seen []uint16) {
+	delete(p.Words, id)
+	p.updateKnown()
+	t, ok := p.tombs[id]
+	if !ok {
+		t = &tombstone{At: at, Seen: []uint16{p.Port}}
+		p.tombs[id] = t
+		p.Log.Info("deleted", "id", id)
+	}
+	for _, port := range seen {
+		if !containsPort(t.Seen, port) {
+			t.Seen = append(t.Seen, port)
+		}
+	}
+	tombstones.Set(float64(len(p.tombs)), strconv.Itoa(int(p.Port)))
+}
+
+// tombstones from a sync, collected ones are not re-added (p.mu must be held)
+func (p *Peer) mergeTombstones(theirs map[string]*tombstone) {
+	for id, t := range theirs {
+		if p.wasCollected(id) {
+			continue
+		}
+		at := t.At
+		if mine, ok := p.tombs[id]; ok && mine.At < at {
+			at = mine.At
+		}
+		p.bury(id, at, t.Seen)
+		p.tombs[id].At = at
+	}
+}
+
+// whether id was deleted, its rumor must not be stored again (p.mu must be held)
+func (p *Peer) deleted(id string) bool {
+	if _, ok := p.tombs[id]; ok {
+		return true
+	}
+	return p.wasCollected(id)
+}
+
+// whether id's tombstone was collected (within a retention period, p.mu must be held)
+func (p *Peer) wasCollected(id string) bool {
+	return p.buried != nil && p.buried.has(id, p.Sched.Now())
+}
+
+// applies a "del:<id>" rumor (p.mu must be held)
+func (p *Peer) applyDelete(word string) {
+	id := strings.TrimPrefix(word, delPrefix)
+	if p.wasCollected(id) {
+		return
+	}
+	p.bury(id, p.Sched.Now().UnixNano(), nil)
+}
+
+// aux
+
+func seenBy(t *tombstone, members []uint16) bool {
+	for _, m := range members {
+		if !containsPort(t.Seen, m) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsPort(ports []uint16, port uint16) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
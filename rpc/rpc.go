@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+	"token-ring/logging"
+	"token-ring/metrics"
+
+	"google.golang.org/grpc"
+)
+
+// Shared gRPC server/client setup for every module.
+// Both ends run the same interceptor chain: trace context propagation (see trace.go),
+// a debug log entry per RPC and a latency histogram. Transport is plaintext unless
+// mutual TLS was enabled (see tls.go), over TCP ports unless another transport was set (see transport.go).
+
+var latency = metrics.NewHistogram("rpc_duration_seconds", "gRPC call latency", metrics.DefBuckets, "method", "side")
+var calls = metrics.NewCounter("rpc_calls_total", "gRPC calls", "method", "side", "code")
+
+// Logger used by the interceptors, RPCs are logged at debug level (nil - logging.Default)
+var Log *logging.Logger
+
+// NewServer returns a grpc server for the peer at port with the interceptor chain installed
+func NewServer(port uint16, opts ...grpc.ServerOption) *grpc.Server {
+	if creds, _ := transportCreds(); creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	opts = append(opts, grpc.ChainUnaryInterceptor(serverInterceptor(port)))
+	return grpc.NewServer(opts...)
+}
+
+// Conn to a peer, a grpc client connection or the calls of a Caller transport
+type Conn interface {
+	grpc.ClientConnInterface
+	Close() error
+}
+
+// Dial connects to the local peer at addr (port) through the current transport (see transport.go)
+// with the interceptor chain installed, Caller transports carry the calls themselves
+func Dial(addr int, opts ...grpc.DialOption) (Conn, error) {
+	_, creds := transportCreds()
+	t := currentTransport()
+	if c, ok := t.(Caller); ok {
+		return callerConn{c, uint16(addr)}, nil
+	}
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithChainUnaryInterceptor(clientInterceptor(addr)),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return t.Dial(ctx, uint16(addr))
+		}),
+	}, opts...)
+	return grpc.Dial(fmt.Sprintf(":%d", addr), opts...)
+}
+
+func serverInterceptor(port uint16) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		parent, ok := remoteParent(ctx)
+		if ok {
+			ctx = contextWithSpan(ctx, parent)
+		}
+		span := newSpan(ctx, info.FullMethod, "server")
+		span.Attrs["port"] = fmt.Sprintf("%d", port)
+
+		res, err := handler(contextWithSpan(ctx, span), req)
+		finish(span, err)
+		return res, err
+	}
+}
+
+func clientInterceptor(addr int) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		span := newSpan(ctx, method, "client")
+		span.Attrs["target"] = fmt.Sprintf("%d", addr)
+		if parent, ok := SpanFromContext(ctx); ok {
+			if port, ok := parent.Attrs["port"]; ok {
+				span.Attrs["port"] = port
+			}
+		}
+
+		err := invoker(injectSpan(ctx, span), method, req, reply, cc, opts...)
+		finish(span, err)
+		return err
+	}
+}
+
+// records a finished span: export, log and metrics
+func finish(span Span, err error) {
+	span.End = time.Now()
+	code := "ok"
+	if err != nil {
+		span.Error = err.Error()
+		code = "error"
+	}
+	export(span)
+
+	d := span.End.Sub(span.Start)
+	latency.Observe(d.Seconds(), span.Name, span.Kind)
+	calls.Inc(span.Name, span.Kind, code)
+	l := Log
+	if l == nil {
+		l = logging.Default
+	}
+	l.Debug("rpc", "method", span.Name, "side", span.Kind, "duration", d, "trace", span.TraceID, "span", span.SpanID, "parent", span.ParentID, "err", span.Error, "attrs", span.Attrs)
+}
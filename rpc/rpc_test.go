@@ -0,0 +1,211 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"token-ring/certs"
+	grpcapi "token-ring/grpcapi"
+)
+
+type memExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (e *memExporter) Export(s Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+// forwards every ping to next (if set), continuing the trace in ctx
+type relay struct {
+	next int
+	grpcapi.UnimplementedShellServer
+}
+
+func (r *relay) Ping(ctx context.Context, in *grpcapi.Message) (*grpcapi.Message, error) {
+	if r.next == 0 {
+		return in, nil
+	}
+	conn, err := Dial(r.next)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return grpcapi.NewShellClient(conn).Ping(ctx, in)
+}
+
+func serve(t *testing.T, port uint16, next int) {
+	l, err := Listen(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcs := NewServer(port)
+	grpcapi.RegisterShellServer(grpcs, &relay{next: next})
+	go grpcs.Serve(l)
+	t.Cleanup(grpcs.Stop)
+}
+
+func TestTracePropagation(t *testing.T) {
+	e := &memExporter{}
+	SetExporter(e)
+	defer SetExporter(nil)
+	serve(t, 4550, 4551)
+	serve(t, 4551, 0)
+
+	conn, err := Dial(4550)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := grpcapi.NewShellClient(conn).Ping(context.Background(), &grpcapi.Message{Body: "t:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// client -> 4550 (server, client) -> 4551 (server)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(e.spans))
+	}
+	byID := make(map[string]Span)
+	for _, s := range e.spans {
+		if s.TraceID != e.spans[0].TraceID {
+			t.Fatalf("spans in different traces: %+v", e.spans)
+		}
+		byID[s.SpanID] = s
+	}
+	hop := e.spans[0] // 4551 server span finishes first
+	if hop.Kind != "server" || hop.Attrs["port"] != "4551" {
+		t.Fatalf("unexpected first span: %+v", hop)
+	}
+	depth := 0
+	for hop.ParentID != "" {
+		hop = byID[hop.ParentID]
+		depth += 1
+	}
+	if depth != 3 || hop.Kind != "client" || hop.Attrs["target"] != "4550" {
+		t.Fatalf("unexpected root span %+v at depth %d", hop, depth)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, err := certs.NewCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := ca.Issue("node", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogueCA, err := certs.NewCA("rogue CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogue, err := rogueCA.Issue("node", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DisableTLS()
+
+	if err := UseTLS(ca.PEM, node.Cert, node.Key); err != nil {
+		t.Fatal(err)
+	}
+	serve(t, 4552, 0)
+	if err := ping(4552); err != nil {
+		t.Fatalf("expected call with a valid certificate to succeed: %s", err)
+	}
+
+	if err := UseTLS(rogueCA.PEM, rogue.Cert, rogue.Key); err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(4552); err == nil {
+		t.Fatal("expected call with a certificate from another CA to fail")
+	}
+
+	DisableTLS()
+	if err := ping(4552); err == nil {
+		t.Fatal("expected plaintext call to fail")
+	}
+}
+
+func ping(addr int) error {
+	conn, err := Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = grpcapi.NewShellClient(conn).Ping(ctx, &grpcapi.Message{Body: "t:0"})
+	return err
+}
+
+func TestMemTransport(t *testing.T) {
+	mem := NewMemTransport()
+	SetTransport(mem)
+	defer SetTransport(nil)
+	e := &memExporter{}
+	SetExporter(e)
+	defer SetExporter(nil)
+
+	// dozens of relays, no port is bound: 1 -> 2 -> ... -> 40
+	for port := uint16(1); port <= 40; port++ {
+		next := int(port) + 1
+		if port == 40 {
+			next = 0
+		}
+		serve(t, port, next)
+	}
+	if _, err := mem.Listen(1); err == nil {
+		t.Fatal("listened twice on a port")
+	}
+	if err := ping(1); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	if len(e.spans) != 80 || e.spans[0].TraceID != e.spans[79].TraceID {
+		t.Fatalf("%d spans", len(e.spans))
+	}
+	e.mu.Unlock()
+
+	// faults: down ports refuse connections, delayed ones are slower
+	mem.SetDown(40, true)
+	if err := ping(40); err == nil {
+		t.Fatal("down port answered")
+	}
+	if err := ping(1); err == nil {
+		t.Fatal("relay through a down port answered")
+	}
+	mem.SetDown(40, false)
+	if err := ping(40); err != nil {
+		t.Fatal(err)
+	}
+	mem.SetDelay(20, 100*time.Millisecond)
+	start := time.Now()
+	if err := ping(20); err != nil || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("delayed ping took %s (%v)", time.Since(start), err)
+	}
+	if err := ping(4441); err == nil {
+		t.Fatal("ping to a port nobody listens on answered")
+	}
+
+	// closed connections are forgotten
+	for i := 0; i < 10; i++ {
+		if err := ping(30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for port := uint16(1); port <= 40; port++ {
+		for mem.open(port) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d connections to %d still open", mem.open(port), port)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
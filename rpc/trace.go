@@ -0,0 +1,152 @@
+package rpc
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// OpenTelemetry style spans: every RPC produces a client span (caller) and a server span (callee),
+// linked through the W3C traceparent header ("00-<trace id>-<span id>-01") carried in gRPC metadata.
+// Outgoing calls made while handling an RPC continue the same trace, so a token pass or a multicast
+// can be followed hop by hop.
+type Span struct {
+	TraceID  string            `json:"trace_id"`
+	SpanID   string            `json:"span_id"`
+	ParentID string            `json:"parent_span_id,omitempty"`
+	Name     string            `json:"name"`
+	Kind     string            `json:"kind"` // client, server
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Attrs    map[string]string `json:"attributes,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type Exporter interface {
+	Export(s Span)
+}
+
+// JSON lines span exporter
+type FileExporter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+type spanKey struct{}
+
+const traceparent = "traceparent"
+
+var exporterMu sync.Mutex
+var exporter Exporter
+
+// Sets where finished spans go (nil - spans are not recorded, trace context is still propagated)
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	exporter = e
+}
+
+func export(s Span) {
+	exporterMu.Lock()
+	e := exporter
+	exporterMu.Unlock()
+	if e != nil {
+		e.Export(s)
+	}
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f}, nil
+}
+
+func (e *FileExporter) Export(s Span) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.f.Write(append(b, '\n'))
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
+
+// Span of the RPC being handled (or started) in ctx
+func SpanFromContext(ctx context.Context) (Span, bool) {
+	s, ok := ctx.Value(spanKey{}).(Span)
+	return s, ok
+}
+
+func contextWithSpan(ctx context.Context, s Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// Detach keeps the trace of ctx but drops its deadline/cancellation, for work
+// (ex: gossip forwarding) that outlives the RPC handler that started it.
+func Detach(ctx context.Context) context.Context {
+	if s, ok := SpanFromContext(ctx); ok {
+		return contextWithSpan(context.Background(), s)
+	}
+	return context.Background()
+}
+
+// child of the span in ctx, or the root of a new trace
+func newSpan(ctx context.Context, name string, kind string) Span {
+	s := Span{
+		SpanID: randHex(8),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		Attrs:  make(map[string]string),
+	}
+	if parent, ok := SpanFromContext(ctx); ok {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = randHex(16)
+	}
+	return s
+}
+
+// parent span sent by the caller (only ids are set)
+func remoteParent(ctx context.Context) (Span, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(traceparent)) == 0 {
+		return Span{}, false
+	}
+	split := strings.Split(md.Get(traceparent)[0], "-")
+	if len(split) != 4 || len(split[1]) != 32 || len(split[2]) != 16 {
+		return Span{}, false
+	}
+	return Span{TraceID: split[1], SpanID: split[2]}, true
+}
+
+func injectSpan(ctx context.Context, s Span) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, traceparent, fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID))
+}
+
+// aux
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
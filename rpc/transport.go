@@ -0,0 +1,251 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Transports carry the gRPC connections between peers: TCPTransport (local TCP ports, the default)
+// or MemTransport (in-process pipes, no ports are bound), set with SetTransport before peers start.
+// Peers listen with Listen and Dial connects through the current transport.
+//
+// MemTransport injects faults per port: a down port refuses connections and breaks the open ones,
+// a delayed port holds every write to it by the delay.
+//
+// A transport that is also a Caller carries unary calls itself, without connections (see sim).
+
+type Transport interface {
+	Listen(port uint16) (net.Listener, error)
+	Dial(ctx context.Context, port uint16) (net.Conn, error)
+}
+
+// Caller makes the call of method (ex: "/grpcapi.Shell/Ping") to port, filling reply
+type Caller interface {
+	Call(ctx context.Context, port uint16, method string, req interface{}, reply interface{}) error
+}
+
+// Conn of a Caller transport
+type callerConn struct {
+	c    Caller
+	port uint16
+}
+
+type TCPTransport struct{}
+
+type MemTransport struct {
+	mu        sync.Mutex
+	listeners map[uint16]*bufconn.Listener
+	down      map[uint16]bool
+	delay     map[uint16]time.Duration
+	// open connections per port, removed on Close
+	conns map[uint16]map[*memConn]bool
+}
+
+// buffered bytes per in-memory connection
+const MEM_BUFFER = 256 * 1024
+
+var ErrRefused = errors.New("connection refused")
+
+var transportMu sync.Mutex
+var transport Transport = TCPTransport{}
+
+// SetTransport used by every Listen and Dial afterwards (nil - TCPTransport)
+func SetTransport(t Transport) {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	if t == nil {
+		t = TCPTransport{}
+	}
+	transport = t
+}
+
+func currentTransport() Transport {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	return transport
+}
+
+// Listen on port through the current transport
+func Listen(port uint16) (net.Listener, error) {
+	return currentTransport().Listen(port)
+}
+
+func (TCPTransport) Listen(port uint16) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
+
+func (TCPTransport) Dial(ctx context.Context, port uint16) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", fmt.Sprintf(":%d", port))
+}
+
+func NewMemTransport() *MemTransport {
+	return &MemTransport{
+		listeners: make(map[uint16]*bufconn.Listener),
+		down:      make(map[uint16]bool),
+		delay:     make(map[uint16]time.Duration),
+		conns:     make(map[uint16]map[*memConn]bool),
+	}
+}
+
+func (m *MemTransport) Listen(port uint16) (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.listeners[port]; ok {
+		return nil, fmt.Errorf("listen mem:%d: address already in use", port)
+	}
+	l := bufconn.Listen(MEM_BUFFER)
+	m.listeners[port] = l
+	return &memListener{Listener: l, close: func() { m.unlisten(port, l) }}, nil
+}
+
+func (m *MemTransport) Dial(ctx context.Context, port uint16) (net.Conn, error) {
+	m.mu.Lock()
+	l, ok := m.listeners[port]
+	down := m.down[port]
+	m.mu.Unlock()
+	if !ok || down {
+		return nil, fmt.Errorf("dial mem:%d: %w", port, ErrRefused)
+	}
+	conn, err := l.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mc := &memConn{Conn: conn, delay: func() time.Duration { return m.delayOf(port) }}
+	mc.close = func() { m.forget(port, mc) }
+	m.mu.Lock()
+	if m.conns[port] == nil {
+		m.conns[port] = make(map[*memConn]bool)
+	}
+	m.conns[port][mc] = true
+	m.mu.Unlock()
+	return mc, nil
+}
+
+// SetDown refuses (down) or accepts again connections to port, down closes the open ones
+func (m *MemTransport) SetDown(port uint16, down bool) {
+	m.mu.Lock()
+	m.down[port] = down
+	conns := m.conns[port]
+	if down {
+		delete(m.conns, port)
+	}
+	m.mu.Unlock()
+	if down {
+		// closed without m.mu, Close forgets the connection
+		for c := range conns {
+			c.Close()
+		}
+	}
+}
+
+// SetDelay holds every write to port by d (0 - none)
+func (m *MemTransport) SetDelay(port uint16, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delay[port] = d
+}
+
+// Ports listened on
+func (m *MemTransport) Ports() []uint16 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]uint16, 0, len(m.listeners))
+	for port := range m.listeners {
+		res = append(res, port)
+	}
+	return res
+}
+
+func (m *MemTransport) delayOf(port uint16) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.delay[port]
+}
+
+// drops a closed connection to port
+func (m *MemTransport) forget(port uint16, c *memConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.conns[port], c)
+	if len(m.conns[port]) == 0 {
+		delete(m.conns, port)
+	}
+}
+
+// open connections to port
+func (m *MemTransport) open(port uint16) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns[port])
+}
+
+// frees port once its listener is closed
+func (m *MemTransport) unlisten(port uint16, l *bufconn.Listener) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.listeners[port] == l {
+		delete(m.listeners, port)
+		delete(m.conns, port)
+	}
+}
+
+// aux
+
+type memListener struct {
+	*bufconn.Listener
+	once  sync.Once
+	close func()
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(l.close)
+	return l.Listener.Close()
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr{}
+}
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "mem" }
+func (memAddr) String() string  { return "mem" }
+
+type memConn struct {
+	net.Conn
+	delay func() time.Duration
+	once  sync.Once
+	close func()
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(c.close)
+	return c.Conn.Close()
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	if d := c.delay(); d > 0 {
+		time.Sleep(d)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c callerConn) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	return c.c.Call(ctx, c.port, method, args, reply)
+}
+
+func (c callerConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, fmt.Errorf("%s: streams are not carried by %T", method, c.c)
+}
+
+func (c callerConn) Close() error {
+	return nil
+}
@@ -0,0 +1,276 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"token-ring/common"
+	"token-ring/logging"
+	"token-ring/multicast"
+	"token-ring/peer"
+	"token-ring/peergossip"
+	"token-ring/topology"
+)
+
+// Peer pools of the simulation: the peers of /peer, /peergossip and /multicast on ports 1...N,
+// timed by the simulation scheduler and served by it (see Sim.Call), set up like the orchestrator
+// pools. Peer logs are dropped.
+
+var discard = logging.New(io.Discard, logging.Off, false)
+
+// port of the i-th peer of a pool
+func port(i int) uint16 {
+	return uint16(i + 1)
+}
+
+func ports(n int) []uint16 {
+	res := make([]uint16, n)
+	for i := range res {
+		res[i] = port(i)
+	}
+	return res
+}
+
+// Token ring (see /peer): N peers in a ring, Locked ones locked, Start forwards the token first.
+// The token stops at a peer whose TTL is spent or that is locked.
+
+type TokenRingConfig struct {
+	N      int
+	Locked []int
+	Start  int
+}
+
+type TokenRing struct {
+	sim   *Sim
+	cfg   TokenRingConfig
+	Peers []*peer.Peer
+}
+
+func NewTokenRing(s *Sim, cfg TokenRingConfig) *TokenRing {
+	r := &TokenRing{sim: s, cfg: cfg, Peers: make([]*peer.Peer, cfg.N)}
+	for i := range r.Peers {
+		p := peer.NewPeer(port(i), port((i+1)%cfg.N), 0)
+		p.Sched, p.Log = s.Sched, discard
+		s.serve(p.Port, p)
+		r.Peers[i] = p
+	}
+	peer.Ring(r.Peers...)
+	for _, i := range cfg.Locked {
+		r.Peers[i].SetLock(true)
+	}
+	return r
+}
+
+// Start forwards the token from cfg.Start (peer "fw")
+func (r *TokenRing) Start() {
+	r.sim.Sched.Go(r.Peers[r.cfg.Start].Bind)
+}
+
+// Lines summary, the token stopped at the peer after the highest token
+func (r *TokenRing) Lines() []string {
+	lines := make([]string, 0, len(r.Peers)+1)
+	highest, last := 0, r.cfg.Start
+	for i, p := range r.Peers {
+		st := p.Status()
+		lines = append(lines, fmt.Sprintf("[%d] token=%d ttl=%d locked=%t", i, st.Token, st.TTL, st.Lock == 1))
+		if st.Token > highest {
+			highest, last = st.Token, i
+		}
+	}
+	stopped := (last + 1) % len(r.Peers)
+	reason := "ttl expired"
+	if r.Peers[stopped].Status().Lock == 1 {
+		reason = "next locked"
+	}
+	return append(lines, fmt.Sprintf("highest token: %d, %d passes, stopped at node %d (%s) after %s", highest, r.sim.Sent, stopped, reason, r.sim.Now()))
+}
+
+// Gossip (see /peergossip): peers linked by Graph start rumors on their events and spread them
+// with Strategy and Broadcast, a shared Convergence records every receipt.
+
+type GossipConfig struct {
+	Graph     *topology.Graph
+	Strategy  peergossip.Strategy
+	Broadcast peergossip.BroadcastMode
+	Events    common.EventConfig // per peer, seeded by the simulation rng (bound it with Count or Duration)
+}
+
+type Gossip struct {
+	sim         *Sim
+	cfg         GossipConfig
+	Peers       []*peergossip.Peer
+	Convergence *peergossip.Convergence
+}
+
+func NewGossip(s *Sim, cfg GossipConfig) *Gossip {
+	if cfg.Strategy.Stop == nil {
+		cfg.Strategy.Stop = peergossip.DefaultStrategy.Stop
+	}
+	g := &Gossip{sim: s, cfg: cfg, Peers: make([]*peergossip.Peer, cfg.Graph.N), Convergence: peergossip.NewConvergence()}
+	for i := range g.Peers {
+		g.Peers[i] = peergossip.NewPeerWith(port(i), peergossip.Options{
+			Sched:       s.Sched,
+			Rand:        common.NewRand(s.Rand.Int63()),
+			Log:         discard,
+			Strategy:    cfg.Strategy,
+			Broadcast:   cfg.Broadcast,
+			Convergence: g.Convergence,
+			// words come from Start
+			NoWords: true,
+		})
+		s.serve(port(i), g.Peers[i])
+	}
+	for _, e := range cfg.Graph.Edges() {
+		g.Peers[e[0]].Register(int(port(e[1])))
+	}
+	return g
+}
+
+// Start schedules the word events of every peer
+func (g *Gossip) Start() {
+	for _, p := range g.Peers {
+		cfg := g.cfg.Events
+		cfg.Seed = g.sim.Rand.Int63()
+		p.WordEvents(cfg)
+	}
+}
+
+// Rumor of word started by peer i
+func (g *Gossip) Rumor(i int, word string) {
+	p := g.Peers[i]
+	g.sim.Sched.Go(func() { p.Gossip(word, p.Port) })
+}
+
+// Reports of every rumor, in start order
+func (g *Gossip) Reports() []peergossip.RumorReport {
+	return g.Convergence.Report(ports(len(g.Peers)))
+}
+
+// Lines summary
+func (g *Gossip) Lines() []string {
+	reports := g.Reports()
+	lines := make([]string, 0)
+	full, dups := 0, 0
+	var worst peergossip.RumorReport
+	for _, r := range reports {
+		dups += r.Duplicates
+		if r.Reached == r.Peers {
+			full += 1
+			if r.Converged > worst.Converged {
+				worst = r
+			}
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%d nodes, %d edges, strategy %s, broadcast %s", len(g.Peers), len(g.cfg.Graph.Edges()), g.cfg.Strategy, g.cfg.Broadcast))
+	lines = append(lines, fmt.Sprintf("rumors: %d, known by every node: %d, duplicates: %d, slowest convergence: %s", len(reports), full, dups, worst.Converged))
+	for i, r := range reports {
+		if i == 10 {
+			lines = append(lines, fmt.Sprintf("... %d more rumors", len(reports)-10))
+			break
+		}
+		lines = append(lines, r.String())
+	}
+	return lines
+}
+
+// Multicast (see /multicast): N peers in a full mesh ping every peer on their events, each peer
+// records the pings it delivers ("<msg>:<origin>").
+
+type MulticastConfig struct {
+	N      int
+	Events common.EventConfig // per peer, seeded by the simulation rng
+}
+
+type Multicast struct {
+	sim   *Sim
+	cfg   MulticastConfig
+	Peers []*multicast.Peer
+	mu    sync.Mutex
+	// pings delivered by each peer, in order
+	delivered [][]string
+}
+
+func NewMulticast(s *Sim, cfg MulticastConfig) *Multicast {
+	m := &Multicast{sim: s, cfg: cfg, Peers: make([]*multicast.Peer, cfg.N), delivered: make([][]string, cfg.N)}
+	for i := range m.Peers {
+		i := i
+		p := multicast.NewPeer(port(i), false)
+		p.Sched, p.Log = s.Sched, discard
+		p.OnDeliver = func(body string) {
+			// "<msg>:<origin>:<clock>", a ping is sent to each peer with the origin clock of the time
+			msg := body[:strings.LastIndex(body, ":")]
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.delivered[i] = append(m.delivered[i], msg)
+		}
+		s.serve(p.Port, p)
+		m.Peers[i] = p
+	}
+	// every peer is in its own registry (it acks its own pings), then one ping per pair
+	for i, p := range m.Peers {
+		p.PingPeer(int(port(i)), "hello")
+		for j := i + 1; j < len(m.Peers); j++ {
+			p.PingPeer(int(port(j)), "hello")
+		}
+	}
+	return m
+}
+
+// Start schedules the ping events of every peer
+func (m *Multicast) Start() {
+	for _, p := range m.Peers {
+		cfg := m.cfg.Events
+		cfg.Seed = m.sim.Rand.Int63()
+		p.PingEvents(cfg)
+	}
+}
+
+// Delivered pings of peer i, in order
+func (m *Multicast) Delivered(i int) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.delivered[i]...)
+}
+
+// Agreement reports whether every peer delivered the same sequence (a prefix of the longest one)
+func (m *Multicast) Agreement() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	longest := m.delivered[0]
+	for _, d := range m.delivered {
+		if len(d) > len(longest) {
+			longest = d
+		}
+	}
+	for _, d := range m.delivered {
+		for k, body := range d {
+			if longest[k] != body {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Lines summary
+func (m *Multicast) Lines() []string {
+	lines := make([]string, 0, len(m.Peers)+2)
+	delivered := 0
+	for i, p := range m.Peers {
+		d := m.Delivered(i)
+		delivered += len(d)
+		if i == 10 {
+			lines = append(lines, fmt.Sprintf("... %d more nodes", len(m.Peers)-10))
+		}
+		if i >= 10 {
+			continue
+		}
+		st := p.Status()
+		if len(d) > 3 {
+			d = d[:3]
+		}
+		lines = append(lines, fmt.Sprintf("[%d] clock=%d queue=%d delivered=%d first=%v", i, st.Clock, len(st.Queue), len(m.Delivered(i)), d))
+	}
+	return append(lines, fmt.Sprintf("deliveries: %d, same delivery order everywhere: %t", delivered, m.Agreement()))
+}
@@ -0,0 +1,266 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"token-ring/common"
+	grpcapi "token-ring/grpcapi"
+	"token-ring/rpc"
+)
+
+/*
+	Deterministic discrete-event simulation: the token ring, gossip and multicast peers themselves
+	(see pools.go) run in virtual time, their calls carried in process (no gRPC connections). Every
+	peer is timed by the simulation virtual scheduler, which runs their timers and handed over work
+	one at a time, and draws its random choices (gossip targets, stop coins, words) from an rng
+	seeded by the simulation rng, as do the event times, latencies and losses, so a seed always
+	yields the same run, and a run costs the calls it makes, not their time.
+
+	A call made while the simulation runs is two messages, each a timer after a Latency sample of
+	its own: the request runs the callee handler, the reply resumes the caller, which is parked
+	meanwhile (see common.Scheduler.Await) while other peers go on, so concurrent sends overlap.
+	Requests are lost (refused) with probability Loss. Peers are set up (registered, linked) before
+	Run, their calls are free.
+*/
+
+type Sim struct {
+	Sched   *common.Scheduler // virtual clock of every simulated peer
+	Rand    *rand.Rand
+	Latency Latency // message delays (Constant 1ms)
+	Loss    float64 // probability a call is refused, only gossip peers survive it (the others exit)
+	// Run stops after MaxSteps timers (0 - unlimited): blind gossip of duplicates over a graph with
+	// cycles can grow without bound
+	MaxSteps int
+	// stats (read once Run returned)
+	Sent    int
+	Dropped int
+	Steps   int
+	mu      sync.Mutex
+	start   time.Time
+	running bool
+	// peers by port, handlers of the calls (see Call)
+	servers map[uint16]grpcapi.ShellServer
+}
+
+// virtual time 0
+var epoch = time.Unix(0, 0).UTC()
+
+// New simulation, the rpc transport of the peers created afterwards (one simulation at a time)
+func New(seed int64) *Sim {
+	s := &Sim{
+		Sched:   common.NewVirtualScheduler(epoch),
+		Rand:    common.NewRand(seed),
+		Latency: Constant{D: time.Millisecond},
+		start:   epoch,
+		servers: make(map[uint16]grpcapi.ShellServer),
+	}
+	rpc.SetTransport(s)
+	return s
+}
+
+// Now in virtual time
+func (s *Sim) Now() time.Duration {
+	return s.Sched.Now().Sub(s.start)
+}
+
+// Run runs the timers due up to until (0 - until there are none left), returns the steps run
+func (s *Sim) Run(until time.Duration) int {
+	var t time.Time
+	if until > 0 {
+		t = s.start.Add(until)
+	}
+	max := 0
+	if s.MaxSteps > 0 {
+		if max = s.MaxSteps - s.Steps; max <= 0 {
+			return 0
+		}
+	}
+	s.setRunning(true)
+	defer s.setRunning(false)
+	steps := s.Sched.Run(t, max)
+	s.Steps += steps
+	return steps
+}
+
+// Limited reports whether Run stopped on MaxSteps with timers pending
+func (s *Sim) Limited() bool {
+	return s.MaxSteps > 0 && s.Steps >= s.MaxSteps && s.Sched.Len() > 0
+}
+
+// Pending timers
+func (s *Sim) Pending() int {
+	return s.Sched.Len()
+}
+
+// Listen (rpc.Transport) accepts no connections, the calls of rpc.Dial go through Call to the
+// peers served (see serve)
+func (s *Sim) Listen(port uint16) (net.Listener, error) {
+	return idle{}, nil
+}
+
+// Dial (rpc.Transport) refuses connections
+func (s *Sim) Dial(ctx context.Context, port uint16) (net.Conn, error) {
+	return nil, fmt.Errorf("dial sim:%d: %w", port, rpc.ErrRefused)
+}
+
+// serves the calls to port with srv
+func (s *Sim) serve(port uint16, srv grpcapi.ShellServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers[port] = srv
+}
+
+// Call (rpc.Caller) runs the handler of method at port: right away during setup, else the request
+// and the reply are delivered after a Latency sample each, unless the request is lost
+func (s *Sim) Call(ctx context.Context, port uint16, method string, req interface{}, reply interface{}) error {
+	s.mu.Lock()
+	srv, ok := s.servers[port]
+	running, lost := s.running, false
+	if running {
+		s.Sent += 1
+		if lost = s.Loss > 0 && s.Rand.Float64() < s.Loss; lost {
+			s.Dropped += 1
+		}
+	}
+	s.mu.Unlock()
+	var handler func(context.Context, *grpcapi.Message) (*grpcapi.Message, error)
+	if ok {
+		switch method {
+		case "/grpcapi.Shell/Ping":
+			handler = srv.Ping
+		case "/grpcapi.Shell/Word":
+			handler = srv.Word
+		}
+	}
+	if handler == nil || lost {
+		return fmt.Errorf("call sim:%d%s: %w", port, method, rpc.ErrRefused)
+	}
+	in := &grpcapi.Message{Body: req.(*grpcapi.Message).GetBody()}
+	var res *grpcapi.Message
+	var err error
+	if !running {
+		res, err = handler(ctx, in)
+	} else {
+		s.Sched.Await(func(done func()) {
+			s.Sched.After(s.latency(), func() {
+				res, err = handler(ctx, in)
+				s.Sched.After(s.latency(), done)
+			})
+		})
+	}
+	if err != nil {
+		return err
+	}
+	reply.(*grpcapi.Message).Body = res.GetBody()
+	return nil
+}
+
+func (s *Sim) latency() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Latency.Sample(s.Rand)
+}
+
+func (s *Sim) setRunning(running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = running
+}
+
+// listener of a simulated peer, Accept blocks for good
+type idle struct{}
+
+func (idle) Accept() (net.Conn, error) { select {} }
+
+func (idle) Close() error { return nil }
+
+func (idle) Addr() net.Addr { return simAddr{} }
+
+type simAddr struct{}
+
+func (simAddr) Network() string { return "sim" }
+
+func (simAddr) String() string { return "sim" }
+
+// Latency distributions of message delays
+type Latency interface {
+	Sample(r *rand.Rand) time.Duration
+	String() string
+}
+
+type Constant struct {
+	D time.Duration
+}
+
+// uniform in [Min, Max]
+type Uniform struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Min plus an exponential of mean Mean
+type Exponential struct {
+	Min  time.Duration
+	Mean time.Duration
+}
+
+// normal, negative samples are 0
+type Normal struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func (l Constant) Sample(r *rand.Rand) time.Duration { return l.D }
+
+func (l Constant) String() string { return fmt.Sprintf("const:%s", l.D) }
+
+func (l Uniform) Sample(r *rand.Rand) time.Duration {
+	return l.Min + time.Duration(r.Int63n(int64(l.Max-l.Min)+1))
+}
+
+func (l Uniform) String() string { return fmt.Sprintf("uniform:%s:%s", l.Min, l.Max) }
+
+func (l Exponential) Sample(r *rand.Rand) time.Duration {
+	return l.Min + time.Duration(r.ExpFloat64()*float64(l.Mean))
+}
+
+func (l Exponential) String() string { return fmt.Sprintf("exp:%s:%s", l.Min, l.Mean) }
+
+func (l Normal) Sample(r *rand.Rand) time.Duration {
+	d := time.Duration(r.NormFloat64()*float64(l.StdDev)) + l.Mean
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (l Normal) String() string { return fmt.Sprintf("normal:%s:%s", l.Mean, l.StdDev) }
+
+// ParseLatency: const:<d>, uniform:<min>:<max>, exp:<min>:<mean> or normal:<mean>:<stddev>
+func ParseLatency(spec string) (Latency, error) {
+	split := strings.Split(spec, ":")
+	ds := make([]time.Duration, 0, 2)
+	for _, v := range split[1:] {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid latency %q: bad duration %q", spec, v)
+		}
+		ds = append(ds, d)
+	}
+	switch {
+	case split[0] == "const" && len(ds) == 1:
+		return Constant{D: ds[0]}, nil
+	case split[0] == "uniform" && len(ds) == 2 && ds[0] <= ds[1]:
+		return Uniform{Min: ds[0], Max: ds[1]}, nil
+	case split[0] == "exp" && len(ds) == 2:
+		return Exponential{Min: ds[0], Mean: ds[1]}, nil
+	case split[0] == "normal" && len(ds) == 2:
+		return Normal{Mean: ds[0], StdDev: ds[1]}, nil
+	}
+	return nil, fmt.Errorf("invalid latency %q (const:<d>, uniform:<min>:<max>, exp:<min>:<mean>, normal:<mean>:<stddev>)", spec)
+}
@@ -0,0 +1,199 @@
+package sim
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"testing"
+	"time"
+	"token-ring/common"
+	"token-ring/peer"
+	"token-ring/peergossip"
+	"token-ring/topology"
+)
+
+func TestSimCalls(t *testing.T) {
+	s := New(1)
+	r := NewTokenRing(s, TokenRingConfig{N: 2})
+	// setup calls are free, calls while running are a request and a reply of a latency each
+	if s.Sent != 0 || s.Now() != 0 {
+		t.Fatalf("setup: %d calls, now %s", s.Sent, s.Now())
+	}
+	s.Latency = Constant{D: 10 * time.Millisecond}
+	done := false
+	s.Sched.After(time.Second, func() { done = true })
+	r.Start()
+	if s.Run(500 * time.Millisecond); s.Now() != 500*time.Millisecond || done {
+		t.Fatalf("now %s", s.Now())
+	}
+	// 2 peers, TTL passes each and the refused one
+	if s.Sent != 2*peer.TTL+1 {
+		t.Fatalf("%d calls", s.Sent)
+	}
+	s.Run(0)
+	if !done || s.Now() != time.Second || s.Pending() != 0 {
+		t.Fatalf("now %s, %d pending", s.Now(), s.Pending())
+	}
+
+	// sends of different peers overlap: both rumors reach the other peer after one latency
+	s = New(1)
+	s.Latency = Constant{D: 10 * time.Millisecond}
+	g := NewGossip(s, GossipConfig{Graph: topology.Full(2), Strategy: peergossip.Strategy{Stop: peergossip.Counter{K: 1}, Feedback: true, MaxRounds: 1}})
+	g.Rumor(0, "a")
+	g.Rumor(1, "b")
+	s.Run(0)
+	for _, rep := range g.Reports() {
+		if rep.Reached != 2 || rep.Converged != 10*time.Millisecond {
+			t.Fatalf("%v", g.Lines())
+		}
+	}
+	if s.Sent != 2 || s.Now() != 20*time.Millisecond {
+		t.Fatalf("%d calls, now %s", s.Sent, s.Now())
+	}
+}
+
+func TestLatency(t *testing.T) {
+	for spec, want := range map[string]string{"const:5ms": "const:5ms", "uniform:1ms:10ms": "uniform:1ms:10ms", "exp:1ms:4ms": "exp:1ms:4ms", "normal:10ms:2ms": "normal:10ms:2ms"} {
+		l, err := ParseLatency(spec)
+		if err != nil || l.String() != want {
+			t.Fatalf("%s: %v %v", spec, l, err)
+		}
+		r := mrand.New(mrand.NewSource(1))
+		for i := 0; i < 100; i++ {
+			if d := l.Sample(r); d < 0 {
+				t.Fatalf("%s: sampled %s", spec, d)
+			}
+		}
+	}
+	for _, spec := range []string{"", "const", "uniform:10ms:1ms", "exp:1ms", "gauss:1ms:1ms", "const:x"} {
+		if _, err := ParseLatency(spec); err == nil {
+			t.Errorf("%q parsed", spec)
+		}
+	}
+}
+
+func TestTokenRing(t *testing.T) {
+	s := New(1)
+	r := NewTokenRing(s, TokenRingConfig{N: 4})
+	r.Start()
+	s.Run(0)
+	// every peer passes the token TTL times, the next receipt finds the TTL spent, then the replies
+	// come back around the ring
+	lines := r.Lines()
+	if s.Sent != 17 || r.Peers[0].Status().Token != 16 || !strings.Contains(lines[4], "stopped at node 1 (ttl expired) after 34ms") {
+		t.Fatalf("%v", lines)
+	}
+
+	s = New(1)
+	r = NewTokenRing(s, TokenRingConfig{N: 4, Locked: []int{2}, Start: 0})
+	r.Start()
+	s.Run(0)
+	if lines := r.Lines(); s.Sent != 2 || !strings.Contains(lines[4], "highest token: 1, 2 passes, stopped at node 2 (next locked)") {
+		t.Fatalf("%v", lines)
+	}
+}
+
+func gossipRun(seed int64, strategy peergossip.Strategy, g *topology.Graph) (*Sim, *Gossip) {
+	s := New(seed)
+	s.Latency = Exponential{Min: time.Millisecond, Mean: 5 * time.Millisecond}
+	s.MaxSteps = 100000
+	gs := NewGossip(s, GossipConfig{Graph: g, Strategy: strategy, Events: common.EventConfig{Rate: 1, Count: 3}})
+	gs.Start()
+	s.Run(0)
+	return s, gs
+}
+
+func TestSimGossip(t *testing.T) {
+	tree := topology.Tree(30, 2)
+	ws := topology.WattsStrogatz(30, 4, 0.2, mrand.New(mrand.NewSource(1)))
+	for _, c := range []struct {
+		g        *topology.Graph
+		strategy peergossip.Strategy
+	}{
+		{tree, peergossip.DefaultStrategy},
+		{ws, peergossip.Strategy{Fanout: 2, MaxHops: 6, Stop: peergossip.Coin{K: 5}}},
+		{ws, peergossip.Strategy{Stop: peergossip.Counter{K: 3}, Feedback: true}},
+	} {
+		// same seed, same run
+		s1, g1 := gossipRun(7, c.strategy, c.g)
+		s2, g2 := gossipRun(7, c.strategy, c.g)
+		if fmt.Sprint(g1.Lines()) != fmt.Sprint(g2.Lines()) || s1.Sent != s2.Sent || s1.Now() != s2.Now() {
+			t.Fatalf("%s: not reproducible\n%v\n%v", c.strategy, g1.Lines(), g2.Lines())
+		}
+		reports := g1.Reports()
+		if len(reports) != 90 || s1.Limited() {
+			t.Fatalf("%s: %d rumors, limited %t", c.strategy, len(reports), s1.Limited())
+		}
+		if c.strategy.Fanout == 0 {
+			for _, r := range reports {
+				if r.Reached != 30 {
+					t.Fatalf("%s: %s", c.strategy, r)
+				}
+			}
+		}
+	}
+	_, g7 := gossipRun(7, peergossip.DefaultStrategy, tree)
+	if _, g8 := gossipRun(8, peergossip.DefaultStrategy, tree); fmt.Sprint(g8.Lines()) == fmt.Sprint(g7.Lines()) {
+		t.Fatal("another seed, same run")
+	}
+
+	// lost calls are counted, the peers keep gossiping
+	s := New(1)
+	s.Loss = 0.2
+	gs := NewGossip(s, GossipConfig{Graph: topology.Full(10), Strategy: peergossip.Strategy{Stop: peergossip.Counter{K: 3}, Feedback: true}})
+	gs.Rumor(0, "lossy")
+	if s.Run(0); s.Dropped == 0 || s.Dropped >= s.Sent || gs.Reports()[0].Reached < 2 {
+		t.Fatalf("%d calls, %d dropped: %v", s.Sent, s.Dropped, gs.Lines())
+	}
+
+	// runaway runs stop at MaxSteps
+	s = New(1)
+	s.MaxSteps = 100
+	gs = NewGossip(s, GossipConfig{Graph: topology.Full(10), Strategy: peergossip.DefaultStrategy})
+	for i := 0; i < 10; i++ {
+		gs.Rumor(i, "runaway")
+	}
+	if s.Run(0); !s.Limited() || s.Steps != 100 {
+		t.Fatalf("%d steps, limited %t", s.Steps, s.Limited())
+	}
+}
+
+func TestSimMulticast(t *testing.T) {
+	run := func(seed int64) *Multicast {
+		s := New(seed)
+		s.Latency = Uniform{Min: time.Millisecond, Max: 50 * time.Millisecond}
+		m := NewMulticast(s, MulticastConfig{N: 6, Events: common.EventConfig{Rate: 20, Count: 10}})
+		m.Start()
+		s.Run(0)
+		return m
+	}
+	// pings overlap, the delivery order may differ between peers (see Agreement in Lines)
+	m := run(3)
+	for i, p := range m.Peers {
+		if len(m.Delivered(i)) != 60 || len(p.Status().Queue) != 0 {
+			t.Fatalf("peer %d: %v", i, m.Lines())
+		}
+	}
+	if fmt.Sprint(run(3).Lines()) != fmt.Sprint(m.Lines()) {
+		t.Fatal("not reproducible")
+	}
+}
+
+// large pools run in a wall time budget: calls cost their handlers (and signatures), not their latency
+func TestSimScale(t *testing.T) {
+	start := time.Now()
+	s := New(1)
+	s.Latency = Exponential{Min: time.Millisecond, Mean: 20 * time.Millisecond}
+	g := NewGossip(s, GossipConfig{Graph: topology.Tree(1000, 3), Strategy: peergossip.DefaultStrategy})
+	g.Rumor(0, "far")
+	g.Rumor(999, "wide")
+	s.Run(0)
+	for _, r := range g.Reports() {
+		if r.Reached != 1000 {
+			t.Fatalf("%v", g.Lines())
+		}
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("%d calls took %s", s.Sent, time.Since(start))
+	}
+}
@@ -0,0 +1,267 @@
+package topology
+
+import (
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Overlay topologies for gossip and multicast experiments: undirected graphs over nodes 0..n-1
+// (pool indexes), wired by the orchestrator with one Register (or ping) per edge. Random graphs
+// take a seeded RNG so a sweep can be repeated:
+//
+//	ring, star, tree[:k], grid, full
+//	er[:p]          Erdős–Rényi, every edge with probability p
+//	ws[:k[:beta]]   Watts–Strogatz small world, ring lattice of degree k, edges rewired with probability beta
+//	ba[:m]          Barabási–Albert scale free, every node attaches to m nodes by preferential attachment
+
+type Graph struct {
+	Name string
+	N    int
+	adj  []map[int]bool
+}
+
+var Kinds = []string{"ring", "star", "tree", "grid", "full", "er", "ws", "ba"}
+
+func New(name string, n int) *Graph {
+	g := &Graph{Name: name, N: n, adj: make([]map[int]bool, n)}
+	for i := range g.adj {
+		g.adj[i] = make(map[int]bool)
+	}
+	return g
+}
+
+// Connect adds the edge i-j, returns false for self loops, duplicates and nodes out of range
+func (g *Graph) Connect(i int, j int) bool {
+	if i == j || i < 0 || j < 0 || i >= g.N || j >= g.N || g.adj[i][j] {
+		return false
+	}
+	g.adj[i][j] = true
+	g.adj[j][i] = true
+	return true
+}
+
+func (g *Graph) Linked(i int, j int) bool {
+	return g.adj[i][j]
+}
+
+// Neighbours of i, sorted
+func (g *Graph) Neighbours(i int) []int {
+	res := make([]int, 0, len(g.adj[i]))
+	for j := range g.adj[i] {
+		res = append(res, j)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// Edges as [i, j] pairs with i < j, sorted
+func (g *Graph) Edges() [][2]int {
+	res := make([][2]int, 0)
+	for i := 0; i < g.N; i++ {
+		for _, j := range g.Neighbours(i) {
+			if i < j {
+				res = append(res, [2]int{i, j})
+			}
+		}
+	}
+	return res
+}
+
+// Connected reports whether every node is reachable from node 0
+func (g *Graph) Connected() bool {
+	if g.N == 0 {
+		return true
+	}
+	seen := map[int]bool{0: true}
+	stack := []int{0}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for j := range g.adj[i] {
+			if !seen[j] {
+				seen[j] = true
+				stack = append(stack, j)
+			}
+		}
+	}
+	return len(seen) == g.N
+}
+
+func (g *Graph) String() string {
+	return fmt.Sprintf("%s (%d nodes, %d edges)", g.Name, g.N, len(g.Edges()))
+}
+
+// generators
+
+func Ring(n int) *Graph {
+	g := New("ring", n)
+	for i := 0; i < n; i++ {
+		g.Connect(i, (i+1)%n)
+	}
+	return g
+}
+
+// Star with node 0 at the center
+func Star(n int) *Graph {
+	g := New("star", n)
+	for i := 1; i < n; i++ {
+		g.Connect(0, i)
+	}
+	return g
+}
+
+// Tree k-ary, rooted at node 0 (breadth first numbering)
+func Tree(n int, k int) *Graph {
+	g := New(fmt.Sprintf("tree:%d", k), n)
+	for i := 1; i < n; i++ {
+		g.Connect(i, (i-1)/k)
+	}
+	return g
+}
+
+// Grid of about sqrt(n) rows, filled row by row (the last row may be partial)
+func Grid(n int) *Graph {
+	g := New("grid", n)
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	for i := 0; i < n; i++ {
+		if (i+1)%cols != 0 {
+			g.Connect(i, i+1)
+		}
+		g.Connect(i, i+cols)
+	}
+	return g
+}
+
+func Full(n int) *Graph {
+	g := New("full", n)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			g.Connect(i, j)
+		}
+	}
+	return g
+}
+
+func ErdosRenyi(n int, p float64, rng *mrand.Rand) *Graph {
+	g := New(fmt.Sprintf("er:%g", p), n)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if rng.Float64() < p {
+				g.Connect(i, j)
+			}
+		}
+	}
+	return g
+}
+
+// WattsStrogatz: ring lattice where every node links to its k/2 nearest nodes on each side, then
+// each lattice edge is rewired to a random node with probability beta
+func WattsStrogatz(n int, k int, beta float64, rng *mrand.Rand) *Graph {
+	g := New(fmt.Sprintf("ws:%d:%g", k, beta), n)
+	for i := 0; i < n; i++ {
+		for j := 1; j <= k/2; j++ {
+			g.Connect(i, (i+j)%n)
+		}
+	}
+	for j := 1; j <= k/2; j++ {
+		for i := 0; i < n; i++ {
+			t := (i + j) % n
+			if !g.Linked(i, t) || rng.Float64() >= beta || len(g.adj[i]) >= n-1 {
+				continue
+			}
+			for {
+				r := rng.Intn(n)
+				if r != i && !g.Linked(i, r) {
+					delete(g.adj[i], t)
+					delete(g.adj[t], i)
+					g.Connect(i, r)
+					break
+				}
+			}
+		}
+	}
+	return g
+}
+
+// BarabasiAlbert: starts from a full graph of m+1 nodes, every other node links to m distinct
+// nodes chosen with probability proportional to their degree
+func BarabasiAlbert(n int, m int, rng *mrand.Rand) *Graph {
+	g := New(fmt.Sprintf("ba:%d", m), n)
+	// every node appears once per edge end, picking uniformly from it is picking by degree
+	ends := make([]int, 0)
+	for i := 0; i <= m && i < n; i++ {
+		for j := 0; j < i; j++ {
+			g.Connect(i, j)
+			ends = append(ends, i, j)
+		}
+	}
+	for i := m + 1; i < n; i++ {
+		linked := make([]int, 0, m)
+		for len(linked) < m {
+			if t := ends[rng.Intn(len(ends))]; g.Connect(i, t) {
+				linked = append(linked, t)
+			}
+		}
+		for _, t := range linked {
+			ends = append(ends, i, t)
+		}
+	}
+	return g
+}
+
+// Parse builds a graph of n nodes from spec (see Kinds), random graphs are seeded with seed
+func Parse(spec string, n int, seed int64) (*Graph, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("topology needs at least one node, got %d", n)
+	}
+	split := strings.Split(spec, ":")
+	args := make([]float64, 0)
+	for _, a := range split[1:] {
+		v, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topology %q: %s", spec, err)
+		}
+		args = append(args, v)
+	}
+	arg := func(i int, def float64) float64 {
+		if i < len(args) {
+			return args[i]
+		}
+		return def
+	}
+	rng := mrand.New(mrand.NewSource(seed))
+	switch strings.ToLower(split[0]) {
+	case "ring":
+		return Ring(n), nil
+	case "star":
+		return Star(n), nil
+	case "tree":
+		if k := int(arg(0, 2)); k >= 1 {
+			return Tree(n, k), nil
+		}
+	case "grid":
+		return Grid(n), nil
+	case "full":
+		return Full(n), nil
+	case "er":
+		if p := arg(0, 0.5); p >= 0 && p <= 1 {
+			return ErdosRenyi(n, p, rng), nil
+		}
+	case "ws":
+		k, beta := int(arg(0, 4)), arg(1, 0.2)
+		if k >= 2 && k < n && beta >= 0 && beta <= 1 {
+			return WattsStrogatz(n, k, beta, rng), nil
+		}
+	case "ba":
+		if m := int(arg(0, 2)); m >= 1 && m < n {
+			return BarabasiAlbert(n, m, rng), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown topology %q (%s)", spec, strings.Join(Kinds, ", "))
+	}
+	return nil, fmt.Errorf("invalid topology parameters %q for %d nodes", spec, n)
+}
@@ -0,0 +1,66 @@
+package topology
+
+import (
+	mrand "math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestTopology(t *testing.T) {
+	// spec -> expected edges for 9 nodes (-1 - random)
+	specs := map[string]int{
+		"ring":    9,
+		"star":    8,
+		"tree":    8,
+		"tree:3":  8,
+		"grid":    12,
+		"full":    36,
+		"er:0.5":  -1,
+		"ws:4:.2": 18,
+		"ba:2":    1 + 2*(9-2),
+	}
+	for spec, edges := range specs {
+		g, err := Parse(spec, 9, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edges >= 0 && len(g.Edges()) != edges {
+			t.Errorf("%s: expected %d edges, got %s", spec, edges, g)
+		}
+		if spec != "er:0.5" && !g.Connected() {
+			t.Errorf("%s: not connected %v", spec, g.Edges())
+		}
+		for i := 0; i < g.N; i++ {
+			for _, j := range g.Neighbours(i) {
+				if j == i || !g.Linked(j, i) {
+					t.Fatalf("%s: bad edge %d-%d", spec, i, j)
+				}
+			}
+		}
+
+		// the same seed builds the same graph
+		again, _ := Parse(spec, 9, 1)
+		if !reflect.DeepEqual(g.Edges(), again.Edges()) {
+			t.Errorf("%s: not reproducible with the same seed", spec)
+		}
+	}
+
+	if g := Tree(7, 2); !reflect.DeepEqual(g.Neighbours(0), []int{1, 2}) || !reflect.DeepEqual(g.Neighbours(2), []int{0, 5, 6}) {
+		t.Fatalf("unexpected tree %v", g.Edges())
+	}
+	// beta 0 keeps the lattice, beta 1 rewires it
+	if g := WattsStrogatz(10, 4, 0, mrand.New(mrand.NewSource(1))); !g.Linked(0, 2) || !g.Linked(0, 8) {
+		t.Fatalf("unexpected lattice %v", g.Edges())
+	}
+	a, _ := Parse("ws:4:1", 30, 1)
+	b, _ := Parse("ws:4:1", 30, 2)
+	if reflect.DeepEqual(a.Edges(), b.Edges()) {
+		t.Fatal("expected different graphs for different seeds")
+	}
+
+	for _, spec := range []string{"mesh", "tree:0", "er:2", "ws:20", "ba:9", "ring:x"} {
+		if _, err := Parse(spec, 9, 1); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}